@@ -2,9 +2,14 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"chat/internal/config"
 	"chat/internal/tcp"
@@ -20,11 +25,38 @@ func main() {
 		logger.Fatal("Failed to load config: %v", err)
 	}
 
+	discover := flag.Bool("discover", false, "find servers on the local network and pick one")
+	discoverWait := flag.Duration("discover-timeout", 3*time.Second, "how long to listen for servers")
+	transport := flag.String("transport", cfg.Transport, "connect over tcp, udp or quic")
+	flag.Parse()
+
+	cfg.Transport = strings.ToLower(*transport)
+	if err := cfg.Validate(); err != nil {
+		logger.Fatal("Invalid configuration: %v", err)
+	}
+
 	// Initialize logger
 	log := logger.New("client")
 
-	// Get username and password
 	reader := bufio.NewReader(os.Stdin)
+
+	// Find a server instead of using SERVER_ADDR
+	if *discover {
+		server, err := discoverServer(cfg, *discoverWait, reader)
+		if err != nil {
+			log.Fatal("Discovery failed: %v", err)
+		}
+		cfg.ServerAddr = server.Addr
+		if server.QUIC != "" && useQUIC(cfg, reader) {
+			_, port, err := net.SplitHostPort(server.QUIC)
+			if err != nil {
+				log.Fatal("Invalid QUIC address %q: %v", server.QUIC, err)
+			}
+			cfg.Transport, cfg.QUICPort = "quic", ":"+port
+		}
+	}
+
+	// Get username and password
 	fmt.Print("Enter username: ")
 	username, _ := reader.ReadString('\n')
 	username = strings.TrimSpace(username)
@@ -32,20 +64,38 @@ func main() {
 	password, _ := reader.ReadString('\n')
 	password = strings.TrimSpace(password)
 
-	// Start TCP client
-	tcpClient, err := tcp.NewClient(cfg, log, username, password)
+	// Prompt for a two-factor code only if the server asks for one
+	promptCode := func() string {
+		fmt.Print("Enter two-factor code: ")
+		code, _ := reader.ReadString('\n')
+		return strings.TrimSpace(code)
+	}
+
+	// Start the chat client over the chosen transport
+	tcpClient, first, err := tcp.NewClient(cfg, log, username, password, promptCode)
 	if err != nil {
 		log.Fatal("Failed to start TCP client: %v", err)
 	}
 	defer tcpClient.Close()
+	fmt.Print(first)
 
-	// Start UDP receiver
+	// Start UDP receiver and ask the server to also unicast presence updates
+	// to it, which reaches clients outside the broadcast domain
 	udpReceiver := udp.NewReceiver(cfg, log)
-	go func() {
-		if err := udpReceiver.Start(); err != nil {
-			log.Error("UDP receiver failed: %v", err)
+	if port, err := udpReceiver.Open(); err != nil {
+		log.Error("UDP receiver failed: %v", err)
+	} else {
+		if cfg.PresenceUnicast {
+			if err := tcpClient.RegisterUDP(port); err != nil {
+				log.Error("Failed to register for presence updates: %v", err)
+			}
 		}
-	}()
+		go func() {
+			if err := udpReceiver.Start(); err != nil {
+				log.Error("UDP receiver failed: %v", err)
+			}
+		}()
+	}
 
 	// Start receiving messages
 	go func() {
@@ -64,6 +114,10 @@ func main() {
 			return
 		}
 		msg = strings.TrimSpace(msg)
+		if strings.HasPrefix(msg, "/sendfile ") {
+			sendFile(tcpClient, strings.TrimPrefix(msg, "/sendfile "))
+			continue
+		}
 		if msg != "" {
 			if err := tcpClient.Send(msg); err != nil {
 				log.Error("Failed to send message: %v", err)
@@ -71,4 +125,101 @@ func main() {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+// sendFile sends a file in the background so that chatting continues
+func sendFile(client *tcp.Client, args string) {
+	to, path, ok := strings.Cut(strings.TrimSpace(args), " ")
+	path = strings.TrimSpace(path)
+	if !ok || to == "" || path == "" {
+		fmt.Println("Usage: /sendfile <username> <path>")
+		return
+	}
+	go func() {
+		if err := client.SendFile(to, path); err != nil {
+			fmt.Printf("\nFailed to send %s: %v\n", path, err)
+		} else {
+			fmt.Printf("\nSent %s to %s\n", path, to)
+		}
+		fmt.Print("Message: ")
+	}()
+}
+
+// useQUIC reports whether to connect to a discovered server over its TLS
+// secured QUIC transport, asking unless --transport chose one
+func useQUIC(cfg config.Config, reader *bufio.Reader) bool {
+	switch cfg.Transport {
+	case "quic":
+		return true
+	case "udp":
+		return false
+	}
+	fmt.Print("The server offers TLS over QUIC, use it? [Y/n]: ")
+	line, _ := reader.ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "" || answer == "y" || answer == "yes"
+}
+
+// discoverServer lists the servers announcing themselves and returns the chosen one
+func discoverServer(cfg config.Config, wait time.Duration, reader *bufio.Reader) (udp.Server, error) {
+	verifier, err := udp.NewVerifier(cfg)
+	if err != nil {
+		return udp.Server{}, err
+	}
+	var warnMu sync.Mutex
+	warned := make(map[string]bool)
+	verifier.SetOnReject(func(from string, err error) {
+		warnMu.Lock()
+		defer warnMu.Unlock()
+		if key := from + " " + err.Error(); !warned[key] {
+			warned[key] = true
+			fmt.Printf("Ignoring server at %s: %v\n", from, err)
+		}
+	})
+
+	fmt.Printf("Looking for servers for %s...\n", wait)
+	var (
+		mdnsServers []udp.Server
+		mdnsErr     error
+		wg          sync.WaitGroup
+	)
+	if cfg.MDNSEnabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mdnsServers, mdnsErr = udp.Browse(cfg, wait, verifier)
+		}()
+	}
+	servers, err := udp.Discover(cfg, wait, verifier)
+	wg.Wait()
+	if err != nil && mdnsErr != nil {
+		return udp.Server{}, err
+	}
+	// Servers found both ways are listed once, preferring the UDP announcement
+	servers = udp.Merge(servers, mdnsServers)
+	if len(servers) == 0 {
+		return udp.Server{}, fmt.Errorf("no servers found")
+	}
+	for i, s := range servers {
+		tls := ""
+		if s.TLS && s.QUIC != "" {
+			tls = ", TLS over QUIC " + s.QUIC
+		}
+		fmt.Printf("%d) %s  %s  (%d users, protocol %d%s)\n", i+1, s.Name, s.Addr, s.UserCount, s.Protocol, tls)
+	}
+	if len(servers) == 1 {
+		fmt.Printf("Connecting to %s\n", servers[0].Name)
+		return servers[0], nil
+	}
+	for {
+		fmt.Printf("Choose a server [1-%d]: ", len(servers))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return udp.Server{}, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(line))
+		if err == nil && n >= 1 && n <= len(servers) {
+			return servers[n-1], nil
+		}
+	}
+}
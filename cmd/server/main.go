@@ -1,17 +1,38 @@
 package main
 
 import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"chat/internal/api"
 	"chat/internal/auth"
+	"chat/internal/backup"
+	"chat/internal/bridge"
+	"chat/internal/certs"
 	"chat/internal/config"
 	"chat/internal/database"
+	"chat/internal/export"
+	"chat/internal/federation"
 	"chat/internal/history"
+	"chat/internal/irc"
 	"chat/internal/pool"
+	"chat/internal/quic"
+	"chat/internal/rekey"
+	"chat/internal/retention"
+	"chat/internal/rudp"
+	"chat/internal/secret"
 	"chat/internal/tcp"
 	"chat/internal/udp"
+	"chat/internal/web"
+	"chat/internal/webhook"
 	"chat/pkg/logger"
 )
 
@@ -23,49 +44,672 @@ func main() {
 		logger.Fatal("Failed to load config: %v", err)
 	}
 
+	// Run a maintenance subcommand instead of the server if one was given
+	if len(os.Args) > 1 {
+		if err := runCommand(cfg, os.Args[1], os.Args[2:]); err != nil {
+			logger.Fatal("%v", err)
+		}
+		return
+	}
+
 	// Initialize logger
 	log := logger.New("server")
 
 	// Initialize database
-	db, err := database.New("chat.db")
+	db, keys, err := openStore(cfg)
 	if err != nil {
 		log.Fatal("Failed to initialize database: %v", err)
 	}
 	defer db.Close()
 
+	// Persist messages in batches unless every message must be written before it is delivered
+	var persister *history.Persister
+	if cfg.PersistMode == "async" {
+		persister = history.NewPersister(db, logger.New("persist"), cfg.PersistBatchSize, cfg.PersistFlushInterval, cfg.PersistQueueSize)
+		go persister.Start()
+	}
+
 	// Initialize message history with database
-	hist := history.New(100, db)
+	hist := history.New(100, db, persister)
+
+	// Load the key used to encrypt secrets at rest
+	key, err := secret.LoadKey(cfg.SecretKey, cfg.SecretKeyFile)
+	if err != nil {
+		log.Fatal("Failed to load secret key: %v", err)
+	}
+	box, err := secret.New(key)
+	if err != nil {
+		log.Fatal("Failed to initialize secret box: %v", err)
+	}
 
 	// Initialize authentication manager with database
-	authMgr := auth.New(db)
+	authMgr := auth.New(db, box)
 
 	// Initialize goroutine pool
 	gPool := pool.New(10)
 
 	// Start TCP server
-	tcpServer := tcp.NewServer(cfg, log, hist, authMgr, gPool)
+	tcpServer := tcp.NewServer(cfg, log, db, hist, authMgr, gPool)
+
+	// Notify webhooks of chat events
+	webhooks := webhook.NewDispatcher(cfg, log, db, box)
+	tcpServer.SetWebhooks(webhooks)
+	tcpServer.AddRelay(webhooks)
+	go webhooks.Start()
+
 	go func() {
 		if err := tcpServer.Start(); err != nil {
 			log.Fatal("TCP server failed: %v", err)
 		}
 	}()
 
+	// Serve the UDP chat transport through the same pipeline
+	if cfg.UDPChatPort != "" {
+		udpChat, err := rudp.Listen(cfg.UDPChatPort)
+		if err != nil {
+			log.Fatal("Failed to start UDP chat transport: %v", err)
+		}
+		log.Info("UDP chat transport started on %s", cfg.UDPChatPort)
+		go tcpServer.Serve(udpChat)
+	}
+
+	// Serve the QUIC transport, which also relays files between its clients
+	if cfg.QUICPort != "" {
+		tlsConf, err := certs.ServerConfig(cfg)
+		if err != nil {
+			log.Fatal("Failed to load TLS configuration: %v", err)
+		}
+		quicChat, err := quic.Listen(cfg, log, tlsConf)
+		if err != nil {
+			log.Fatal("Failed to start QUIC transport: %v", err)
+		}
+		quicChat.SetDirectory(tcpServer)
+		log.Info("QUIC transport started on %s (certificate %s)", cfg.QUICPort, certs.Fingerprint(tlsConf))
+		go tcpServer.Serve(quicChat)
+	}
+
+	// Serve browsers through the WebSocket gateway
+	var chatBridge *bridge.Bridge
+	if cfg.HTTPPort != "" {
+		gateway, err := web.Listen(cfg, log)
+		if err != nil {
+			log.Fatal("Failed to start WebSocket gateway: %v", err)
+		}
+		log.Info("WebSocket gateway started on %s", cfg.HTTPPort)
+		go tcpServer.Serve(gateway)
+
+		// Integrations post and read through the HTTP API on the same port
+		gateway.Handle("/api/", api.New(cfg, log, db, authMgr, tcpServer))
+		log.Info("HTTP API available on %s/api/", cfg.HTTPPort)
+
+		// Mirror the default room to Slack-style webhooks, which post back on the same port
+		if cfg.BridgeAdapter == "slack" {
+			slack := bridge.NewSlack(cfg, log)
+			gateway.Handle("/bridge/slack", slack)
+			chatBridge = bridge.New(cfg, log, slack, tcpServer)
+			if err := chatBridge.Start(); err != nil {
+				log.Fatal("Failed to start bridge: %v", err)
+			}
+			tcpServer.AddRelay(chatBridge)
+		}
+	}
+
+	// Serve IRC clients through the IRC gateway
+	if cfg.IRCPort != "" {
+		ircGateway, err := irc.Listen(cfg, log)
+		if err != nil {
+			log.Fatal("Failed to start IRC gateway: %v", err)
+		}
+		ircGateway.SetDirectory(tcpServer)
+		log.Info("IRC gateway started on %s (channel %s)", cfg.IRCPort, cfg.IRCChannel)
+		go tcpServer.Serve(ircGateway)
+	}
+
+	// Relay the default room and private messages to user@server through peer servers
+	var fed *federation.Federation
+	if cfg.Federated() {
+		var tlsConf *tls.Config
+		if cfg.FederationPort != "" {
+			tlsConf, err = certs.ServerConfig(cfg)
+			if err != nil {
+				log.Fatal("Failed to load TLS configuration: %v", err)
+			}
+		}
+		fed = federation.New(cfg, log, tcpServer, tlsConf)
+		tcpServer.AddRelay(fed)
+		if err := fed.Start(); err != nil {
+			log.Fatal("Failed to start federation: %v", err)
+		}
+		if cfg.FederationPort != "" {
+			log.Info("Federation listening on %s (certificate %s)", cfg.FederationPort, certs.Fingerprint(tlsConf))
+		}
+	}
+
+	// Start retention janitor
+	janitor := retention.NewJanitor(cfg, log, db)
+	tcpServer.SetJanitor(janitor)
+	go janitor.Start()
+
+	// Start scheduled backups if the database supports online snapshots
+	var backups *backup.Manager
+	if _, ok := database.SQLitePath(cfg.DatabaseDSN); ok {
+		backups = backup.NewManager(cfg, log, db.(database.Backuper))
+		tcpServer.SetBackups(backups)
+		go backups.Start()
+	}
+
+	// Allow admins to rotate the message key if content is encrypted
+	var rotator *rekey.Rotator
+	if keys != nil {
+		rotator = rekey.New(db.(database.Encrypter), keys, log)
+		tcpServer.SetRotator(rotator)
+	}
+
+	// Every discovery mechanism announces the same instance ID so that
+	// clients can merge what they find
+	instanceID, err := udp.NewInstanceID()
+	if err != nil {
+		log.Fatal("Failed to generate instance ID: %v", err)
+	}
+
+	// Discovery packets are signed so that clients can drop forged user lists
+	signer, err := udp.NewSigner(cfg)
+	if err != nil {
+		log.Fatal("Failed to load discovery key: %v", err)
+	}
+	log.Info("Signing discovery packets with %s", signer.Fingerprint())
+
 	// Start UDP broadcaster
 	udpBroadcaster := udp.NewBroadcaster(cfg, log)
 	udpBroadcaster.SetGetUsers(tcpServer.GetUsers)
+	udpBroadcaster.SetGetStatuses(tcpServer.GetStatuses)
+	udpBroadcaster.SetGetEndpoints(tcpServer.GetEndpoints)
+	udpBroadcaster.SetPresence(tcpServer.Presence())
+	udpBroadcaster.SetInstanceID(instanceID)
+	udpBroadcaster.SetSigner(signer)
 	go func() {
 		if err := udpBroadcaster.Start(); err != nil {
 			log.Fatal("UDP broadcaster failed: %v", err)
 		}
 	}()
 
+	// Advertise _chat._tcp.local over mDNS
+	var advertiser *udp.Advertiser
+	if cfg.MDNSEnabled {
+		advertiser = udp.NewAdvertiser(cfg, log)
+		advertiser.SetGetUsers(tcpServer.GetUsers)
+		advertiser.SetInstanceID(instanceID)
+		advertiser.SetSigner(signer)
+		advertiser.SetRoomCount(func() int {
+			rooms, err := db.ListRooms()
+			if err != nil {
+				return 0
+			}
+			return len(rooms)
+		})
+		go func() {
+			if err := advertiser.Start(); err != nil {
+				log.Error("mDNS advertiser failed: %v", err)
+			}
+		}()
+	}
+
 	// Handle graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
 	log.Info("Shutting down server...")
+	if fed != nil {
+		fed.Shutdown()
+	}
 	tcpServer.Shutdown()
+	webhooks.Shutdown()
+	if chatBridge != nil {
+		chatBridge.Shutdown()
+	}
 	udpBroadcaster.Shutdown()
+	if advertiser != nil {
+		advertiser.Shutdown()
+	}
+	janitor.Shutdown()
+	if backups != nil {
+		backups.Shutdown()
+	}
+	if rotator != nil {
+		rotator.Shutdown()
+	}
 	gPool.Shutdown()
-}
\ No newline at end of file
+	if persister != nil {
+		persister.Shutdown()
+	}
+}
+
+// databaseOptions returns the connection pool settings from cfg
+func databaseOptions(cfg config.Config) database.Options {
+	return database.Options{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+		Synchronous:     cfg.SQLiteSynchronous,
+	}
+}
+
+// openStore opens the configured database, applies migrations and enables
+// message encryption if configured. The keyring is nil without encryption.
+func openStore(cfg config.Config) (database.Store, *secret.Keyring, error) {
+	store, err := database.New(cfg.DatabaseDSN, databaseOptions(cfg))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !cfg.MessageEncryption {
+		return store, nil, nil
+	}
+	enc, ok := store.(database.Encrypter)
+	if !ok {
+		store.Close()
+		return nil, nil, fmt.Errorf("database %q does not support message encryption", cfg.DatabaseDSN)
+	}
+	keys, err := secret.LoadKeyring(cfg.MessageKeys, cfg.MessageKeyFile)
+	if err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("failed to load message keys: %v", err)
+	}
+	enc.SetKeyring(keys)
+	return store, keys, nil
+}
+
+// runCommand runs a server subcommand
+func runCommand(cfg config.Config, name string, args []string) error {
+	switch name {
+	case "migrate":
+		return runMigrate(cfg, args)
+	case "export":
+		return runExport(cfg, args)
+	case "import":
+		return runImport(cfg, args)
+	case "backup":
+		return runBackup(cfg, args)
+	case "restore":
+		return runRestore(cfg, args)
+	case "keys":
+		return runKeys(cfg, args)
+	case "tokens":
+		return runTokens(cfg, args)
+	case "webhooks":
+		return runWebhooks(cfg, args)
+	default:
+		return fmt.Errorf("unknown command %q (available: migrate, export, import, backup, restore, keys, tokens, webhooks)", name)
+	}
+}
+
+// runMigrate shows schema status or applies pending migrations.
+// Usage: server migrate [status|up|dry-run]
+func runMigrate(cfg config.Config, args []string) error {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	store, err := database.Connect(cfg.DatabaseDSN, databaseOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	db, ok := store.(database.Migrator)
+	if !ok {
+		return fmt.Errorf("database %q has no schema to migrate", cfg.DatabaseDSN)
+	}
+
+	status, err := db.Status()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version: %d (latest %d)\n", status.Current, status.Latest)
+
+	switch action {
+	case "status":
+		if len(status.Pending) == 0 {
+			fmt.Println("No pending migrations")
+		}
+		for _, m := range status.Pending {
+			fmt.Printf("pending  %3d  %s\n", m.Version, m.Description)
+		}
+	case "dry-run":
+		checked, err := db.DryRun()
+		for _, m := range checked {
+			fmt.Printf("ok       %3d  %s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Dry run succeeded, %d migration(s) rolled back\n", len(checked))
+	case "up":
+		applied, err := db.Migrate()
+		for _, m := range applied {
+			fmt.Printf("applied  %3d  %s\n", m.Version, m.Description)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Applied %d migration(s)\n", len(applied))
+	default:
+		return fmt.Errorf("unknown migrate action %q (available: status, up, dry-run)", action)
+	}
+	return nil
+}
+
+// runExport writes chat history to a file or stdout.
+// Usage: server export [-format jsonl|csv|mbox] [-user name] [-room name] [-since t] [-until t] [-out file]
+func runExport(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", export.FormatJSONL, "output format: jsonl, csv or mbox")
+	user := fs.String("user", "", "only messages sent or received by this user")
+	room := fs.String("room", "", "only messages in this room")
+	since := fs.String("since", "", "only messages at or after this time (RFC 3339 or 2006-01-02)")
+	until := fs.String("until", "", "only messages before this time (RFC 3339 or 2006-01-02)")
+	out := fs.String("out", "", "output file (default stdout)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := database.MessageFilter{User: *user, Room: *room}
+	var err error
+	if *since != "" {
+		if filter.Since, err = export.ParseTime(*since); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if filter.Until, err = export.ParseTime(*until); err != nil {
+			return err
+		}
+	}
+
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", *out, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	n, err := export.Export(store, w, *format, filter)
+	if err != nil {
+		return fmt.Errorf("failed to export messages: %v", err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d message(s)\n", n)
+	return nil
+}
+
+// runImport loads a JSONL export, skipping messages that are already stored.
+// Usage: server import <file.jsonl>
+func runImport(cfg config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import <file.jsonl>")
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", args[0], err)
+	}
+	defer f.Close()
+
+	store, _, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	read, imported, err := export.Import(store, f)
+	if err != nil {
+		return fmt.Errorf("failed to import messages after %d record(s): %v", read, err)
+	}
+	fmt.Printf("Read %d message(s), imported %d, skipped %d duplicate(s)\n", read, imported, read-imported)
+	return nil
+}
+
+// runBackup takes a snapshot of the database, which may be in use by a running server.
+// Usage: server backup [list]
+func runBackup(cfg config.Config, args []string) error {
+	if _, ok := database.SQLitePath(cfg.DatabaseDSN); !ok {
+		return fmt.Errorf("database %q does not support online backups", cfg.DatabaseDSN)
+	}
+	store, err := database.Connect(cfg.DatabaseDSN, databaseOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	backups := backup.NewManager(cfg, logger.New("backup"), store.(database.Backuper))
+	if len(args) == 0 || args[0] != "list" {
+		if stats := backups.Run(); stats.Err != nil {
+			return stats.Err
+		}
+	}
+	fmt.Println(backups.Report())
+	return nil
+}
+
+// runRestore replaces the database with a snapshot after checking its integrity.
+// The server must be stopped first. Usage: server restore <snapshot>
+func runRestore(cfg config.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: restore <snapshot>")
+	}
+	path, ok := database.SQLitePath(cfg.DatabaseDSN)
+	if !ok {
+		return fmt.Errorf("database %q cannot be restored from a snapshot", cfg.DatabaseDSN)
+	}
+	if err := backup.Restore(args[0], path); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s, previous database kept as %s.pre-restore\n", path, args[0], path)
+	return nil
+}
+
+// runKeys shows message key usage, rotates the key or resumes re-encryption.
+// Usage: server keys [status|rotate|reencrypt]
+func runKeys(cfg config.Config, args []string) error {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	if !cfg.MessageEncryption {
+		return fmt.Errorf("message encryption is not enabled, set MESSAGE_ENCRYPTION=true")
+	}
+	store, keys, err := openStore(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	rotator := rekey.New(store.(database.Encrypter), keys, logger.New("keys"))
+	switch action {
+	case "status":
+	case "rotate":
+		id, err := keys.Rotate()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("New message key %s\n", id)
+		fallthrough
+	case "reencrypt":
+		if stats := rotator.Run(); stats.Err != nil {
+			return stats.Err
+		}
+	default:
+		return fmt.Errorf("unknown keys action %q (available: status, rotate, reencrypt)", action)
+	}
+	fmt.Println(rotator.Report())
+	return nil
+}
+
+// runTokens issues, lists or revokes HTTP API tokens.
+// Usage: server tokens [list|create <name> <username>|revoke <id>]
+func runTokens(cfg config.Config, args []string) error {
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	store, err := database.New(cfg.DatabaseDSN, databaseOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch action {
+	case "list":
+		tokens, err := store.ListAPITokens()
+		if err != nil {
+			return err
+		}
+		if len(tokens) == 0 {
+			fmt.Println("No API tokens")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tUSER\tCREATED\tLAST USED")
+		for _, t := range tokens {
+			lastUsed := "never"
+			if !t.LastUsedAt.IsZero() {
+				lastUsed = t.LastUsedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Username, t.CreatedAt.Format(time.RFC3339), lastUsed)
+		}
+		return w.Flush()
+	case "create":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: tokens create <name> <username>")
+		}
+		// The token is not stored, so it can only be shown now
+		token, id, err := auth.New(store, nil).CreateToken(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API token %d for %s, it will not be shown again:\n%s\n", id, args[2], token)
+	case "revoke":
+		id, err := parseID(args)
+		if err != nil {
+			return err
+		}
+		if err := store.DeleteAPIToken(id); err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API token %d\n", id)
+	default:
+		return fmt.Errorf("unknown tokens action %q (available: list, create, revoke)", action)
+	}
+	return nil
+}
+
+// runWebhooks registers and removes webhooks, and lists or replays failed deliveries.
+// Usage: server webhooks [list|add <event> <url>|remove <id>|failed|retry <id>]
+func runWebhooks(cfg config.Config, args []string) error {
+	action := "list"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	store, err := database.New(cfg.DatabaseDSN, databaseOptions(cfg))
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	key, err := secret.LoadKey(cfg.SecretKey, cfg.SecretKeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load secret key: %v", err)
+	}
+	box, err := secret.New(key)
+	if err != nil {
+		return err
+	}
+	webhooks := webhook.NewDispatcher(cfg, logger.New("webhooks"), store, box)
+
+	switch action {
+	case "list":
+		hooks, err := store.ListWebhooks("")
+		if err != nil {
+			return err
+		}
+		if len(hooks) == 0 {
+			fmt.Println("No webhooks")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEVENT\tURL\tCREATED")
+		for _, h := range hooks {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", h.ID, h.Event, h.URL, h.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	case "add":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: webhooks add <event> <url>")
+		}
+		id, signingKey, err := webhooks.Register(args[1], args[2])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created webhook %d for %s events, signing secret:\n%s\n", id, args[1], signingKey)
+	case "remove":
+		id, err := parseID(args)
+		if err != nil {
+			return err
+		}
+		if err := store.DeleteWebhook(id); err != nil {
+			return err
+		}
+		fmt.Printf("Removed webhook %d\n", id)
+	case "failed":
+		failures, err := store.ListWebhookFailures(100)
+		if err != nil {
+			return err
+		}
+		if len(failures) == 0 {
+			fmt.Println("No failed deliveries")
+			return nil
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tWEBHOOK\tEVENT\tFAILED\tATTEMPTS\tERROR")
+		for _, f := range failures {
+			fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%s\n", f.ID, f.WebhookID, f.Event, f.FailedAt.Format(time.RFC3339), f.Attempts, f.LastError)
+		}
+		return w.Flush()
+	case "retry":
+		id, err := parseID(args)
+		if err != nil {
+			return err
+		}
+		f, exists, err := store.GetWebhookFailure(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("no failed delivery with ID %d", id)
+		}
+		if err := webhooks.Replay(f); err != nil {
+			return fmt.Errorf("delivery %d failed again: %v", id, err)
+		}
+		fmt.Printf("Delivered %d to %s\n", id, f.URL)
+	default:
+		return fmt.Errorf("unknown webhooks action %q (available: list, add, remove, failed, retry)", action)
+	}
+	return nil
+}
+
+// parseID returns the ID argument of a subcommand action
+func parseID(args []string) (int64, error) {
+	if len(args) != 2 {
+		return 0, fmt.Errorf("usage: %s <id>", args[0])
+	}
+	id, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", args[1])
+	}
+	return id, nil
+}
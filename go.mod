@@ -1,8 +1,20 @@
 module chat
 
-go 1.21
+go 1.23
 
 require (
+	github.com/lib/pq v1.12.3
 	github.com/mattn/go-sqlite3 v1.14.22
-	golang.org/x/crypto v0.25.0
-)
\ No newline at end of file
+	github.com/quic-go/quic-go v0.54.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	rsc.io/qr v0.2.0
+)
+
+require (
+	go.uber.org/mock v0.5.0 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
+)
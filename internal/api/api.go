@@ -0,0 +1,412 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat/internal/auth"
+	"chat/internal/config"
+	"chat/internal/database"
+	"chat/internal/message"
+	"chat/internal/tcp"
+	"chat/internal/webhook"
+	"chat/pkg/logger"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	maxBodySize     = 64 * 1024
+	maxMessageSize  = 4096
+)
+
+// Errors returned by the API besides those of the auth package
+var (
+	ErrInvalidRequest = errors.New("ERR026: invalid API request")
+	ErrInternal       = errors.New("ERR027: internal server error")
+)
+
+// Chat is the running chat server the API posts into
+type Chat interface {
+	Post(from, to, text string)
+	PostRoom(from, room, text string)
+	RoomExists(room string) (bool, error)
+	GetUsers() []string
+	GetStatuses() map[string]string
+	Disconnect(username string) bool
+	Notify(e webhook.Event)
+}
+
+// Handler serves the HTTP API under /api/. Every request needs an API
+// token, sent as "Authorization: Bearer <token>", and acts as the user the
+// token was issued for. Room membership is not checked: it only lasts while
+// a user is connected, and tokens act without a session, so a token reads
+// and posts to every room.
+type Handler struct {
+	cfg    config.Config
+	logger *logger.Logger
+	store  database.Store
+	auth   *auth.AuthManager
+	chat   Chat
+	mux    *http.ServeMux
+}
+
+// New creates the API handler
+func New(cfg config.Config, logger *logger.Logger, store database.Store, auth *auth.AuthManager, chat Chat) *Handler {
+	h := &Handler{
+		cfg:    cfg,
+		logger: logger,
+		store:  store,
+		auth:   auth,
+		chat:   chat,
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("GET /api/users", h.listOnline)
+	h.mux.HandleFunc("GET /api/messages", h.listMessages)
+	h.mux.HandleFunc("POST /api/messages", h.postMessage)
+	h.mux.HandleFunc("GET /api/accounts", h.admin(h.listAccounts))
+	h.mux.HandleFunc("POST /api/accounts", h.admin(h.createAccount))
+	h.mux.HandleFunc("PUT /api/accounts/{username}/password", h.admin(h.setPassword))
+	h.mux.HandleFunc("DELETE /api/accounts/{username}", h.admin(h.deleteAccount))
+	h.mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%v: unknown endpoint", ErrInvalidRequest))
+	})
+	return h
+}
+
+// userKey is the context key of the user a request acts as
+type userKey struct{}
+
+// ServeHTTP authenticates the request and dispatches it
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !found {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, auth.ErrInvalidToken)
+		return
+	}
+	token, err := h.auth.AuthenticateToken(strings.TrimSpace(bearer))
+	if errors.Is(err, auth.ErrInvalidToken) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		h.logger.Error("API token lookup failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrInternal)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	h.mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userKey{}, token.Username)))
+}
+
+// admin restricts a handler to admin accounts
+func (h *Handler) admin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !h.cfg.IsAdmin(userOf(r)) {
+			writeError(w, http.StatusForbidden, tcp.ErrNotAdmin)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// onlineUser is an entry of GET /api/users
+type onlineUser struct {
+	Username string `json:"username"`
+	Status   string `json:"status,omitempty"`
+}
+
+// listOnline returns the users with a chat session
+func (h *Handler) listOnline(w http.ResponseWriter, r *http.Request) {
+	statuses := h.chat.GetStatuses()
+	users := h.chat.GetUsers()
+	sort.Strings(users)
+	online := make([]onlineUser, 0, len(users))
+	for _, username := range users {
+		online = append(online, onlineUser{Username: username, Status: statuses[username]})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"users": online})
+}
+
+// storedMessage is an entry of GET /api/messages
+type storedMessage struct {
+	ID   int64     `json:"id"`
+	UID  string    `json:"uid"`
+	Type string    `json:"type"`
+	From string    `json:"from,omitempty"`
+	Room string    `json:"room,omitempty"`
+	Text string    `json:"text"`
+	Time time.Time `json:"time"`
+}
+
+// listMessages returns a page of public history, newest first. Pass the
+// returned next_before as before to fetch the page after it.
+func (h *Handler) listMessages(w http.ResponseWriter, r *http.Request) {
+	filter := database.MessageFilter{Public: true, Newest: true, Limit: defaultPageSize}
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%v: limit must be between 1 and %d", ErrInvalidRequest, maxPageSize))
+			return
+		}
+		filter.Limit = limit
+	}
+	if v := query.Get("before"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("%v: before must be a message ID", ErrInvalidRequest))
+			return
+		}
+		filter.Before = before
+	}
+	if v := query.Get("room"); v != "" {
+		room, ok := h.room(w, v)
+		if !ok {
+			return
+		}
+		filter.Room, filter.Lobby = room, room == ""
+	}
+
+	msgs := make([]storedMessage, 0, filter.Limit)
+	err := h.store.QueryMessages(filter, func(msg database.Message) error {
+		msgs = append(msgs, storedMessage{
+			ID:   msg.ID,
+			UID:  msg.UID,
+			Type: msg.Type.String(),
+			From: msg.From,
+			Room: msg.Room,
+			Text: message.Message{Type: msg.Type, From: msg.From, Room: msg.Room, Content: msg.Content}.Text(),
+			Time: msg.Timestamp,
+		})
+		return nil
+	})
+	if err != nil {
+		h.logger.Error("API history query failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrInternal)
+		return
+	}
+	page := map[string]interface{}{"messages": msgs}
+	if len(msgs) == filter.Limit {
+		page["next_before"] = msgs[len(msgs)-1].ID
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// postRequest is the body of POST /api/messages
+type postRequest struct {
+	To   string `json:"to"`   // Recipient of a private message, empty for everyone
+	Room string `json:"room"` // Room of a public message, empty or lobby for the default room
+	Text string `json:"text"` // A single line
+}
+
+// postMessage sends a message to a room or to a single user
+func (h *Handler) postMessage(w http.ResponseWriter, r *http.Request) {
+	var req postRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	req.Text = strings.TrimSpace(req.Text)
+	switch {
+	case req.Text == "":
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%v: text is required", ErrInvalidRequest))
+		return
+	case strings.ContainsAny(req.Text, "\r\n"):
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%v: text cannot contain line breaks", ErrInvalidRequest))
+		return
+	case len(req.Text) > maxMessageSize:
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%v: text is limited to %d bytes", ErrInvalidRequest, maxMessageSize))
+		return
+	case req.To != "" && req.Room != "":
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%v: a message goes to a user or a room, not both", ErrInvalidRequest))
+		return
+	}
+	room, ok := h.room(w, req.Room)
+	if !ok {
+		return
+	}
+	// Users of federated servers have no account here but are listed while online
+	if req.To != "" && !(h.cfg.Federated() && strings.Contains(req.To, "@") && h.isOnline(req.To)) {
+		if _, exists, err := h.store.GetUserPassword(req.To); err != nil {
+			h.logger.Error("API recipient lookup failed: %v", err)
+			writeError(w, http.StatusInternalServerError, ErrInternal)
+			return
+		} else if !exists {
+			writeError(w, http.StatusNotFound, auth.ErrNoAccount)
+			return
+		}
+	}
+	from := userOf(r)
+	if req.To != "" {
+		h.chat.Post(from, req.To, req.Text)
+	} else {
+		h.chat.PostRoom(from, room, req.Text)
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"from": from, "to": req.To, "room": room, "text": req.Text})
+}
+
+// room returns the stored name of the room given as name or #name, writing
+// the response and reporting false if it is invalid or does not exist
+func (h *Handler) room(w http.ResponseWriter, name string) (string, bool) {
+	if name == "" {
+		return "", true
+	}
+	room, err := tcp.ParseRoom(name)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return "", false
+	}
+	exists, err := h.chat.RoomExists(room)
+	if err != nil {
+		h.logger.Error("API room lookup failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrInternal)
+		return "", false
+	}
+	if !exists {
+		writeError(w, http.StatusNotFound, tcp.ErrNoRoom)
+		return "", false
+	}
+	return room, true
+}
+
+// isOnline reports whether username is listed as online
+func (h *Handler) isOnline(username string) bool {
+	for _, user := range h.chat.GetUsers() {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
+// account is an entry of GET /api/accounts
+type account struct {
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+	Admin    bool   `json:"admin"`
+}
+
+// listAccounts returns every registered user
+func (h *Handler) listAccounts(w http.ResponseWriter, r *http.Request) {
+	users, err := h.store.ListUsers()
+	if err != nil {
+		h.logger.Error("API account listing failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrInternal)
+		return
+	}
+	online := make(map[string]bool)
+	for _, username := range h.chat.GetUsers() {
+		online[username] = true
+	}
+	accounts := make([]account, 0, len(users))
+	for _, username := range users {
+		accounts = append(accounts, account{Username: username, Online: online[username], Admin: h.cfg.IsAdmin(username)})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"accounts": accounts})
+}
+
+// credentials is the body of account requests
+type credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// createAccount registers a user
+func (h *Handler) createAccount(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if !h.accountResult(w, h.auth.CreateAccount(req.Username, req.Password)) {
+		return
+	}
+	h.moderated(r, "account_created", req.Username)
+	writeJSON(w, http.StatusCreated, account{Username: req.Username, Admin: h.cfg.IsAdmin(req.Username)})
+}
+
+// setPassword resets the password of a user
+func (h *Handler) setPassword(w http.ResponseWriter, r *http.Request) {
+	var req credentials
+	if !readJSON(w, r, &req) {
+		return
+	}
+	username := r.PathValue("username")
+	if !h.accountResult(w, h.auth.SetPassword(username, req.Password)) {
+		return
+	}
+	h.moderated(r, "password_reset", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteAccount removes a user and ends its session
+func (h *Handler) deleteAccount(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if !h.accountResult(w, h.auth.DeleteAccount(username)) {
+		return
+	}
+	h.chat.Disconnect(username)
+	h.moderated(r, "account_deleted", username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// moderated logs an account change and notifies moderation webhooks
+func (h *Handler) moderated(r *http.Request, action, username string) {
+	h.logger.Info("%s: %s by %s through the API", username, strings.ReplaceAll(action, "_", " "), userOf(r))
+	h.chat.Notify(webhook.Event{Type: webhook.Moderation, Action: action, Actor: userOf(r), User: username})
+}
+
+// accountResult writes the response for a failed account operation and
+// reports whether err was nil
+func (h *Handler) accountResult(w http.ResponseWriter, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, auth.ErrInvalidAccount):
+		writeError(w, http.StatusBadRequest, err)
+	case errors.Is(err, auth.ErrAccountExists):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, auth.ErrNoAccount):
+		writeError(w, http.StatusNotFound, err)
+	default:
+		h.logger.Error("API account operation failed: %v", err)
+		writeError(w, http.StatusInternalServerError, ErrInternal)
+	}
+	return false
+}
+
+// userOf returns the user a request acts as
+func userOf(r *http.Request) string {
+	username, _ := r.Context().Value(userKey{}).(string)
+	return username
+}
+
+// readJSON decodes the request body into v, writing an error response if it fails
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("%v: %v", ErrInvalidRequest, err))
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as the response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes err as a JSON error response
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
@@ -1,19 +1,76 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
 	"chat/internal/database"
+	"chat/internal/secret"
+	"chat/internal/totp"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Issuer is the issuer name shown in authenticator apps
+const Issuer = "chat"
+
+// recoveryCodeCount is the number of recovery codes issued on enrollment
+const recoveryCodeCount = 8
+
+// Invalid second factors allowed before a user is locked out. The first
+// lockout lasts secondFactorLockout and each further failure doubles it,
+// up to maxSecondFactorLockout.
+const (
+	maxSecondFactorFailures = 5
+	secondFactorLockout     = time.Minute
+	maxSecondFactorLockout  = time.Hour
+)
+
+// Errors returned by two-factor operations
+var (
+	ErrTwoFactorEnabled    = errors.New("ERR006: two-factor authentication already enabled")
+	ErrTwoFactorNotEnabled = errors.New("ERR007: two-factor authentication not enabled")
+	ErrNoPendingEnrollment = errors.New("ERR008: no pending two-factor enrollment, use /2fa enable")
+	ErrInvalidCode         = errors.New("ERR009: invalid two-factor code")
+	ErrTooManyAttempts     = errors.New("ERR029: too many invalid two-factor codes, try again later")
+)
+
+// Enrollment holds the details shown to a user enabling two-factor authentication
+type Enrollment struct {
+	Secret        string
+	URI           string
+	QR            string
+	RecoveryCodes []string
+}
+
 // AuthManager manages user authentication
 type AuthManager struct {
-	db *database.DB
+	db       database.Store
+	box      *secret.Box
+	lastStep map[string]int64
+	failures map[string]*failures // Invalid second factors by user
+	mu       sync.Mutex
+}
+
+// failures counts the invalid second factors of a user since the last valid one
+type failures struct {
+	count       int
+	lockedUntil time.Time
 }
 
 // New creates a new authentication manager with database
-func New(db *database.DB) *AuthManager {
+func New(db database.Store, box *secret.Box) *AuthManager {
 	return &AuthManager{
-		db: db,
+		db:       db,
+		box:      box,
+		lastStep: make(map[string]int64),
+		failures: make(map[string]*failures),
 	}
 }
 
@@ -34,4 +91,179 @@ func (a *AuthManager) Authenticate(username, password string) bool {
 	}
 	// Verify password
 	return bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(password)) == nil
-}
\ No newline at end of file
+}
+
+// TwoFactorEnabled reports whether a user must supply a second factor
+func (a *AuthManager) TwoFactorEnabled(username string) bool {
+	_, enabled, err := a.db.GetTOTP(username)
+	return err == nil && enabled
+}
+
+// VerifySecondFactor checks a TOTP code or a one-time recovery code. After
+// maxSecondFactorFailures invalid codes in a row the user is locked out for
+// a growing time, during which every code is refused with ErrTooManyAttempts.
+func (a *AuthManager) VerifySecondFactor(username, code string) error {
+	if a.lockedOut(username) {
+		return ErrTooManyAttempts
+	}
+	sealed, enabled, err := a.db.GetTOTP(username)
+	if err != nil || !enabled {
+		return ErrTwoFactorNotEnabled
+	}
+	valid := a.checkCode(username, sealed, code)
+	if !valid {
+		used, err := a.db.UseRecoveryCode(username, hashRecoveryCode(code))
+		valid = err == nil && used
+	}
+	a.recordSecondFactor(username, valid)
+	if !valid {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// lockedOut reports whether username is locked out after invalid second factors
+func (a *AuthManager) lockedOut(username string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	f, ok := a.failures[username]
+	return ok && time.Now().Before(f.lockedUntil)
+}
+
+// recordSecondFactor resets the failures of username after a valid second
+// factor, or counts an invalid one and locks the user out past the limit
+func (a *AuthManager) recordSecondFactor(username string, valid bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if valid {
+		delete(a.failures, username)
+		return
+	}
+	f, ok := a.failures[username]
+	if !ok {
+		f = &failures{}
+		a.failures[username] = f
+	}
+	f.count++
+	if over := f.count - maxSecondFactorFailures; over >= 0 {
+		lockout := maxSecondFactorLockout
+		if over < 6 {
+			lockout = min(secondFactorLockout<<over, maxSecondFactorLockout)
+		}
+		f.lockedUntil = time.Now().Add(lockout)
+	}
+}
+
+// BeginEnrollment generates a new TOTP secret and recovery codes for a user.
+// The secret is inactive until confirmed with ConfirmEnrollment.
+func (a *AuthManager) BeginEnrollment(username string) (Enrollment, error) {
+	if a.TwoFactorEnabled(username) {
+		return Enrollment{}, ErrTwoFactorEnabled
+	}
+	key, err := totp.GenerateSecret()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	sealed, err := a.box.Seal(key)
+	if err != nil {
+		return Enrollment{}, fmt.Errorf("failed to encrypt TOTP secret: %v", err)
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return Enrollment{}, err
+	}
+	if err := a.db.SetTOTP(username, sealed, false); err != nil {
+		return Enrollment{}, err
+	}
+	if err := a.db.SaveRecoveryCodes(username, hashes); err != nil {
+		return Enrollment{}, err
+	}
+
+	uri := totp.URI(Issuer, username, key)
+	qr, err := totp.QRText(uri)
+	if err != nil {
+		return Enrollment{}, err
+	}
+	return Enrollment{
+		Secret:        key,
+		URI:           uri,
+		QR:            qr,
+		RecoveryCodes: codes,
+	}, nil
+}
+
+// ConfirmEnrollment activates a pending secret once the user proves they can generate codes
+func (a *AuthManager) ConfirmEnrollment(username, code string) error {
+	sealed, enabled, err := a.db.GetTOTP(username)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return ErrTwoFactorEnabled
+	}
+	if sealed == "" {
+		return ErrNoPendingEnrollment
+	}
+	if !a.checkCode(username, sealed, code) {
+		return ErrInvalidCode
+	}
+	return a.db.SetTOTP(username, sealed, true)
+}
+
+// DisableTwoFactor removes the secret and recovery codes after verifying a second factor
+func (a *AuthManager) DisableTwoFactor(username, code string) error {
+	if !a.TwoFactorEnabled(username) {
+		return ErrTwoFactorNotEnabled
+	}
+	if err := a.VerifySecondFactor(username, code); err != nil {
+		return err
+	}
+	if err := a.db.SetTOTP(username, "", false); err != nil {
+		return err
+	}
+	return a.db.SaveRecoveryCodes(username, nil)
+}
+
+// checkCode validates a TOTP code against a sealed secret and rejects reused codes
+func (a *AuthManager) checkCode(username, sealed, code string) bool {
+	key, err := a.box.Open(sealed)
+	if err != nil {
+		return false
+	}
+	step, ok := totp.Validate(key, code, time.Now())
+	if !ok {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if step <= a.lastStep[username] {
+		return false
+	}
+	a.lastStep[username] = step
+	return true
+}
+
+// generateRecoveryCodes creates recovery codes and their hashes
+func generateRecoveryCodes() ([]string, []string, error) {
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		buf := make([]byte, 5)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, fmt.Errorf("failed to generate recovery code: %v", err)
+		}
+		raw := strings.ToLower(enc.EncodeToString(buf))
+		code := raw[:4] + "-" + raw[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes and hashes a recovery code for storage
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
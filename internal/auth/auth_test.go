@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"chat/internal/database"
+	"chat/internal/secret"
+	"chat/internal/totp"
+)
+
+// enrolled returns a manager with alice enrolled in two-factor authentication
+// and her secret
+func enrolled(t *testing.T) (*AuthManager, string) {
+	t.Helper()
+	box, err := secret.New(make([]byte, secret.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := New(database.NewMemory(), box)
+	if !a.Authenticate("alice", "secret") {
+		t.Fatal("failed to register alice")
+	}
+	e, err := a.BeginEnrollment("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Confirm with the previous step so that the current one is still unused
+	if err := a.ConfirmEnrollment("alice", code(t, e.Secret, -1)); err != nil {
+		t.Fatal(err)
+	}
+	return a, e.Secret
+}
+
+// code returns the TOTP code of key steps time steps from now
+func code(t *testing.T, key string, steps int64) string {
+	t.Helper()
+	c, err := totp.Code(key, totp.Step(time.Now())+steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestUsedTimeStepRejected(t *testing.T) {
+	a, key := enrolled(t)
+
+	current := code(t, key, 0)
+	if err := a.VerifySecondFactor("alice", current); err != nil {
+		t.Fatalf("valid code refused: %v", err)
+	}
+	if err := a.VerifySecondFactor("alice", current); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("replayed code returned %v, want %v", err, ErrInvalidCode)
+	}
+	// A code of an earlier step is still within the skew but was superseded
+	if err := a.VerifySecondFactor("alice", code(t, key, -1)); !errors.Is(err, ErrInvalidCode) {
+		t.Errorf("code of an earlier step returned %v, want %v", err, ErrInvalidCode)
+	}
+	if err := a.VerifySecondFactor("alice", code(t, key, 1)); err != nil {
+		t.Errorf("code of the next step refused: %v", err)
+	}
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	a, key := enrolled(t)
+
+	// lockout returns how long alice is locked out for
+	lockout := func() time.Duration {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		f, ok := a.failures["alice"]
+		if !ok {
+			return 0
+		}
+		return time.Until(f.lockedUntil).Round(time.Minute)
+	}
+	// expire ends the current lockout as if it had run its course
+	expire := func() {
+		a.mu.Lock()
+		a.failures["alice"].lockedUntil = time.Now()
+		a.mu.Unlock()
+	}
+
+	for i := 1; i < maxSecondFactorFailures; i++ {
+		if err := a.VerifySecondFactor("alice", "wrong!"); !errors.Is(err, ErrInvalidCode) {
+			t.Fatalf("failure %d returned %v, want %v", i, err, ErrInvalidCode)
+		}
+		if d := lockout(); d > 0 {
+			t.Fatalf("locked out for %v after %d failures", d, i)
+		}
+	}
+
+	want := secondFactorLockout
+	for i := 0; i < 10; i++ {
+		a.VerifySecondFactor("alice", "wrong!")
+		if d := lockout(); d != want {
+			t.Fatalf("locked out for %v after %d failures, want %v", d, maxSecondFactorFailures+i, want)
+		}
+		// Even a valid code is refused during the lockout
+		if err := a.VerifySecondFactor("alice", code(t, key, 0)); !errors.Is(err, ErrTooManyAttempts) {
+			t.Fatalf("code during the lockout returned %v, want %v", err, ErrTooManyAttempts)
+		}
+		expire()
+		want = min(2*want, maxSecondFactorLockout)
+	}
+
+	// A valid code after the lockout clears the failures
+	if err := a.VerifySecondFactor("alice", code(t, key, 0)); err != nil {
+		t.Fatalf("valid code after the lockout refused: %v", err)
+	}
+	a.VerifySecondFactor("alice", "wrong!")
+	if d := lockout(); d > 0 {
+		t.Errorf("locked out for %v after one failure following a valid code", d)
+	}
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"chat/internal/database"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// tokenPrefix marks API tokens so that they are easy to spot in leaked config
+const tokenPrefix = "chat_"
+
+// Errors returned by API token and account operations
+var (
+	ErrInvalidToken   = errors.New("ERR022: invalid API token")
+	ErrAccountExists  = errors.New("ERR023: account already exists")
+	ErrNoAccount      = errors.New("ERR024: no such account")
+	ErrInvalidAccount = errors.New("ERR025: usernames cannot be empty or contain whitespace, passwords cannot be empty or padded with whitespace")
+)
+
+// CreateToken issues an API token acting as username. The token is only
+// returned here; the store keeps its hash.
+func (a *AuthManager) CreateToken(name, username string) (string, int64, error) {
+	if _, exists, err := a.db.GetUserPassword(username); err != nil {
+		return "", 0, err
+	} else if !exists {
+		return "", 0, ErrNoAccount
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", 0, fmt.Errorf("failed to generate API token: %v", err)
+	}
+	token := tokenPrefix + hex.EncodeToString(buf)
+	id, err := a.db.CreateAPIToken(name, username, hashToken(token), time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	return token, id, nil
+}
+
+// AuthenticateToken returns the stored token matching token and records its use
+func (a *AuthManager) AuthenticateToken(token string) (database.APIToken, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return database.APIToken{}, ErrInvalidToken
+	}
+	stored, exists, err := a.db.GetAPIToken(hashToken(token))
+	if err != nil {
+		return database.APIToken{}, err
+	}
+	if !exists {
+		return database.APIToken{}, ErrInvalidToken
+	}
+	// Tokens of deleted accounts are removed with them, this only guards old rows
+	if _, exists, err := a.db.GetUserPassword(stored.Username); err != nil || !exists {
+		return database.APIToken{}, ErrInvalidToken
+	}
+	if err := a.db.TouchAPIToken(stored.ID, time.Now()); err != nil {
+		return database.APIToken{}, err
+	}
+	return stored, nil
+}
+
+// CreateAccount registers a user without logging in
+func (a *AuthManager) CreateAccount(username, password string) error {
+	if !validAccount(username, password) {
+		return ErrInvalidAccount
+	}
+	if _, exists, err := a.db.GetUserPassword(username); err != nil {
+		return err
+	} else if exists {
+		return ErrAccountExists
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	return a.db.SaveUser(username, string(hash))
+}
+
+// SetPassword replaces the password of an existing user
+func (a *AuthManager) SetPassword(username, password string) error {
+	if !validAccount(username, password) {
+		return ErrInvalidAccount
+	}
+	if _, exists, err := a.db.GetUserPassword(username); err != nil {
+		return err
+	} else if !exists {
+		return ErrNoAccount
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %v", err)
+	}
+	return a.db.SetUserPassword(username, string(hash))
+}
+
+// DeleteAccount removes a user together with its API tokens
+func (a *AuthManager) DeleteAccount(username string) error {
+	if _, exists, err := a.db.GetUserPassword(username); err != nil {
+		return err
+	} else if !exists {
+		return ErrNoAccount
+	}
+	return a.db.DeleteUser(username)
+}
+
+// validAccount reports whether username and password can be used to log in
+// over the line protocol, which trims whitespace and splits commands on it
+func validAccount(username, password string) bool {
+	return username != "" && !strings.ContainsAny(username, " \t\r\n") &&
+		password != "" && password == strings.TrimSpace(password) && !strings.ContainsAny(password, "\r\n")
+}
+
+// hashToken returns the stored form of an API token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
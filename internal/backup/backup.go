@@ -0,0 +1,317 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/database"
+	"chat/pkg/logger"
+)
+
+// Snapshot file names sort by creation time
+const (
+	snapshotPrefix = "chat-"
+	snapshotSuffix = ".db"
+	snapshotLayout = "20060102-150405.000000"
+)
+
+// snapshotParseLayout reads both current names and the whole-second names of
+// older releases, since time.Parse accepts a fraction after the seconds
+const snapshotParseLayout = "20060102-150405"
+
+// Snapshot is a backup file in the backup directory
+type Snapshot struct {
+	Path      string
+	Size      int64
+	CreatedAt time.Time
+}
+
+// Stats describes a backup run
+type Stats struct {
+	StartedAt time.Time
+	Duration  time.Duration
+	Snapshot  Snapshot
+	Rotated   int
+	Err       error
+}
+
+// Manager takes scheduled snapshots of the database and rotates old ones
+type Manager struct {
+	backuper database.Backuper
+	logger   *logger.Logger
+	dir      string
+	interval time.Duration
+	keep     int
+	lastRun  Stats
+	runMu    sync.Mutex // Serializes runs
+	mu       sync.Mutex // Guards lastRun
+	done     chan struct{}
+}
+
+// NewManager creates a backup manager from the backup settings in cfg
+func NewManager(cfg config.Config, logger *logger.Logger, backuper database.Backuper) *Manager {
+	return &Manager{
+		backuper: backuper,
+		logger:   logger,
+		dir:      cfg.BackupDir,
+		interval: cfg.BackupInterval,
+		keep:     cfg.BackupKeep,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start takes a snapshot every interval until Shutdown is called
+func (m *Manager) Start() {
+	if m.interval <= 0 {
+		m.logger.Info("Scheduled backups disabled")
+		return
+	}
+	m.logger.Info("Backups scheduled every %s to %s (keeping %s)", m.interval, m.dir, m.keepString())
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.Run()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// Shutdown stops scheduled backups
+func (m *Manager) Shutdown() {
+	close(m.done)
+}
+
+// Run takes one snapshot, removes snapshots beyond the keep limit and returns the stats
+func (m *Manager) Run() Stats {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	stats := Stats{StartedAt: time.Now()}
+	stats.Snapshot, stats.Err = m.snapshot(stats.StartedAt)
+	if stats.Err == nil {
+		stats.Rotated, stats.Err = m.rotate()
+	}
+	stats.Duration = time.Since(stats.StartedAt)
+
+	if stats.Err != nil {
+		m.logger.Error("Backup failed: %v", stats.Err)
+	} else {
+		m.logger.Info("Backup written to %s (%d bytes) in %s", stats.Snapshot.Path, stats.Snapshot.Size, stats.Duration)
+	}
+
+	m.mu.Lock()
+	m.lastRun = stats
+	m.mu.Unlock()
+	return stats
+}
+
+// snapshot writes a verified snapshot named after now
+func (m *Manager) snapshot(now time.Time) (Snapshot, error) {
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	// Never overwrite an existing snapshot: move to the next free microsecond
+	now = now.UTC()
+	path := snapshotPath(m.dir, now)
+	for {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return Snapshot{}, fmt.Errorf("failed to check snapshot %s: %v", path, err)
+		}
+		now = now.Add(time.Microsecond)
+		path = snapshotPath(m.dir, now)
+	}
+
+	// Write to a temporary name so a partial file never looks like a snapshot
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := m.backuper.Backup(tmp); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+	if err := database.CheckIntegrity(tmp); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, fmt.Errorf("failed to save snapshot: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to stat snapshot: %v", err)
+	}
+	return Snapshot{Path: path, Size: info.Size(), CreatedAt: now}, nil
+}
+
+// snapshotPath returns the path of the snapshot taken at t
+func snapshotPath(dir string, t time.Time) string {
+	return filepath.Join(dir, snapshotPrefix+t.Format(snapshotLayout)+snapshotSuffix)
+}
+
+// rotate removes the oldest snapshots beyond the keep limit
+func (m *Manager) rotate() (int, error) {
+	if m.keep <= 0 {
+		return 0, nil
+	}
+	snapshots, err := m.List()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for len(snapshots)-removed > m.keep {
+		if err := os.Remove(snapshots[removed].Path); err != nil {
+			return removed, fmt.Errorf("failed to remove old snapshot: %v", err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// List returns the snapshots in the backup directory, oldest first
+func (m *Manager) List() ([]Snapshot, error) {
+	entries, err := os.ReadDir(m.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup directory: %v", err)
+	}
+
+	var snapshots []Snapshot
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		createdAt, err := time.Parse(snapshotParseLayout, strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, Snapshot{
+			Path:      filepath.Join(m.dir, name),
+			Size:      info.Size(),
+			CreatedAt: createdAt,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// Report describes the schedule, the last run and the available snapshots
+func (m *Manager) Report() string {
+	m.mu.Lock()
+	last := m.lastRun
+	m.mu.Unlock()
+
+	schedule := "manual only"
+	if m.interval > 0 {
+		schedule = "every " + m.interval.String()
+	}
+	lines := []string{fmt.Sprintf("Backups (%s to %s, keeping %s):", schedule, m.dir, m.keepString())}
+	switch {
+	case last.StartedAt.IsZero():
+		lines = append(lines, "Last run: never")
+	case last.Err != nil:
+		lines = append(lines, fmt.Sprintf("Last run: %s, failed after %s: %v",
+			last.StartedAt.UTC().Format(database.TimeLayout), last.Duration, last.Err))
+	default:
+		lines = append(lines, fmt.Sprintf("Last run: %s, wrote %s (%d bytes) in %s, rotated %d",
+			last.StartedAt.UTC().Format(database.TimeLayout), last.Snapshot.Path, last.Snapshot.Size, last.Duration, last.Rotated))
+	}
+
+	snapshots, err := m.List()
+	if err != nil {
+		lines = append(lines, err.Error())
+	}
+	for _, s := range snapshots {
+		lines = append(lines, fmt.Sprintf("  %s  %s  %d bytes", s.CreatedAt.Format(database.TimeLayout), s.Path, s.Size))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// keepString describes the rotation limit
+func (m *Manager) keepString() string {
+	if m.keep <= 0 {
+		return "all snapshots"
+	}
+	return fmt.Sprintf("%d snapshots", m.keep)
+}
+
+// Restore replaces the SQLite database at dbPath with snapshot. The server must
+// be stopped. The snapshot is copied next to the database and verified with
+// PRAGMA integrity_check before it is swapped in; the previous database is kept
+// as dbPath + ".pre-restore".
+func Restore(snapshot, dbPath string) error {
+	if err := database.CheckIntegrity(snapshot); err != nil {
+		return err
+	}
+
+	// Copy first so the final swap is an atomic rename on the same filesystem
+	staged := dbPath + ".restore"
+	if err := copyFile(snapshot, staged); err != nil {
+		os.Remove(staged)
+		return fmt.Errorf("failed to stage snapshot: %v", err)
+	}
+	if err := database.CheckIntegrity(staged); err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	// Move the old database aside together with its WAL files, which must
+	// never be applied to the restored file
+	previous := dbPath + ".pre-restore"
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(previous + suffix)
+		if err := os.Rename(dbPath+suffix, previous+suffix); err != nil && !os.IsNotExist(err) {
+			os.Remove(staged)
+			return fmt.Errorf("failed to move current database aside: %v", err)
+		}
+	}
+	if err := os.Rename(staged, dbPath); err != nil {
+		return fmt.Errorf("failed to swap in restored database: %v", err)
+	}
+	return nil
+}
+
+// copyFile copies src to dst and syncs dst to disk
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,52 @@
+package bot
+
+import (
+	"time"
+
+	"chat/internal/command"
+)
+
+// Message is a chat message delivered to a bot
+type Message struct {
+	From    string
+	Room    string // Empty for the default room
+	Text    string // Without the prefix naming the sender
+	Private bool   // Sent to the bot alone
+	Time    time.Time
+}
+
+// Bot is an account run inside the server. It receives every message to
+// everyone or to a room and the private messages sent to it, except those
+// sent by bots, and answers through reply: privately to private messages
+// and in the room of the message otherwise. Its name must be listed in
+// BOT_USERS.
+type Bot interface {
+	Name() string
+	HandleMessage(msg Message, reply func(text string))
+}
+
+// Commander is implemented by bots that add chat commands
+type Commander interface {
+	Commands() []command.Command
+}
+
+// funcBot is a Bot backed by a function
+type funcBot struct {
+	name   string
+	handle func(msg Message, reply func(text string))
+}
+
+// New creates a bot named name that handles messages with handle
+func New(name string, handle func(msg Message, reply func(text string))) Bot {
+	return funcBot{name: name, handle: handle}
+}
+
+// Name returns the account name of the bot
+func (b funcBot) Name() string {
+	return b.name
+}
+
+// HandleMessage passes msg to the bot's function
+func (b funcBot) HandleMessage(msg Message, reply func(text string)) {
+	b.handle(msg, reply)
+}
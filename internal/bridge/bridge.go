@@ -0,0 +1,178 @@
+package bridge
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/message"
+	"chat/pkg/logger"
+)
+
+// maxNameLength limits the names of virtual users, suffix excluded
+const maxNameLength = 32
+
+// Message is a message crossing the bridge in either direction
+type Message struct {
+	User string // Sender, a chat user or an external user
+	Text string
+}
+
+// Adapter connects the bridge to an external chat system
+type Adapter interface {
+	// Name identifies the system, such as slack. It is appended to the
+	// names of virtual users.
+	Name() string
+	// Start begins passing messages from the external system to receive,
+	// leaving out those posted by bots, the bridge included
+	Start(receive func(Message)) error
+	// Send posts a message from a chat user to the external system
+	Send(msg Message) error
+	// Close stops receiving messages
+	Close() error
+}
+
+// Chat is the part of the chat server the bridge posts to
+type Chat interface {
+	Post(from, to, text string)
+}
+
+// Bridge mirrors the default room to an external chat system. External
+// users show up as virtual users named "name|adapter" while they are active.
+type Bridge struct {
+	cfg     config.Config
+	logger  *logger.Logger
+	adapter Adapter
+	chat    Chat
+	suffix  string
+	out     chan Message
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	virtual map[string]time.Time // Virtual users by the time they last spoke
+}
+
+// New creates a bridge between chat and the system behind adapter
+func New(cfg config.Config, logger *logger.Logger, adapter Adapter, chat Chat) *Bridge {
+	return &Bridge{
+		cfg:     cfg,
+		logger:  logger,
+		adapter: adapter,
+		chat:    chat,
+		suffix:  "|" + adapter.Name(),
+		out:     make(chan Message, cfg.BridgeQueueSize),
+		done:    make(chan struct{}),
+		virtual: make(map[string]time.Time),
+	}
+}
+
+// Start starts the adapter and the delivery of chat messages to it
+func (b *Bridge) Start() error {
+	if err := b.adapter.Start(b.receive); err != nil {
+		return err
+	}
+	b.wg.Add(1)
+	go b.deliver()
+	b.logger.Info("Bridge to %s started", b.adapter.Name())
+	return nil
+}
+
+// Shutdown stops the adapter. Messages still queued for it are dropped.
+func (b *Bridge) Shutdown() {
+	if err := b.adapter.Close(); err != nil {
+		b.logger.Error("Failed to close %s bridge: %v", b.adapter.Name(), err)
+	}
+	close(b.done)
+	b.wg.Wait()
+}
+
+// Relay queues a message from a chat user in the default room for the
+// external system. Other rooms are not mirrored, and messages from virtual
+// users came from there and are not sent back. It never blocks.
+func (b *Bridge) Relay(msg message.Message) {
+	text := msg.Text()
+	if msg.Type != message.TypeUser || msg.Room != "" || b.Owns(msg.From) || strings.TrimSpace(text) == "" {
+		return
+	}
+	select {
+	case b.out <- Message{User: msg.From, Text: text}:
+	default:
+		b.logger.Error("Bridge queue full, dropped a message from %s", msg.From)
+	}
+}
+
+// Owns reports whether username is a virtual user of the external system
+func (b *Bridge) Owns(username string) bool {
+	return strings.HasSuffix(username, b.suffix)
+}
+
+// Statuses returns no statuses, virtual users cannot set one
+func (b *Bridge) Statuses() map[string]string {
+	return nil
+}
+
+// Users returns the virtual users active within BRIDGE_PRESENCE_TTL
+func (b *Bridge) Users() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cutoff := time.Now().Add(-b.cfg.BridgePresenceTTL)
+	users := make([]string, 0, len(b.virtual))
+	for name, seen := range b.virtual {
+		if seen.Before(cutoff) {
+			delete(b.virtual, name)
+			continue
+		}
+		users = append(users, name)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// deliver sends queued messages to the adapter in order
+func (b *Bridge) deliver() {
+	defer b.wg.Done()
+	for {
+		select {
+		case msg := <-b.out:
+			if err := b.adapter.Send(msg); err != nil {
+				b.logger.Error("Failed to send message from %s to %s: %v", msg.User, b.adapter.Name(), err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// receive posts a message from the external system as its virtual user
+func (b *Bridge) receive(msg Message) {
+	text := strings.TrimSpace(msg.Text)
+	if text == "" {
+		return
+	}
+	user := b.virtualName(msg.User)
+	b.mu.Lock()
+	b.virtual[user] = time.Now()
+	b.mu.Unlock()
+	b.chat.Post(user, "", text)
+}
+
+// virtualName returns the chat name of an external user, keeping only
+// characters that are safe in every client and protocol
+func (b *Bridge) virtualName(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		if sb.Len() >= maxNameLength {
+			break
+		}
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			sb.WriteRune(r)
+		}
+	}
+	if sb.Len() == 0 {
+		sb.WriteString("unknown")
+	}
+	return sb.String() + b.suffix
+}
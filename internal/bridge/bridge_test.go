@@ -0,0 +1,254 @@
+package bridge
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/message"
+	"chat/pkg/logger"
+)
+
+// post is a message the bridge posted to the chat
+type post struct {
+	from, to, text string
+}
+
+// fakeChat records the messages posted to it
+type fakeChat struct {
+	mu    sync.Mutex
+	posts []post
+}
+
+// Post records a message
+func (c *fakeChat) Post(from, to, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.posts = append(c.posts, post{from, to, text})
+}
+
+// posted returns the messages posted so far
+func (c *fakeChat) posted() []post {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]post(nil), c.posts...)
+}
+
+// incoming is an httptest server standing in for an incoming webhook
+type incoming struct {
+	*httptest.Server
+	mu     sync.Mutex
+	bodies []map[string]string
+}
+
+// newIncoming starts an incoming webhook that accepts every message
+func newIncoming(t *testing.T) *incoming {
+	t.Helper()
+	in := &incoming{}
+	in.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		in.mu.Lock()
+		in.bodies = append(in.bodies, body)
+		in.mu.Unlock()
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(in.Close)
+	return in
+}
+
+// received returns the messages posted to the incoming webhook so far
+func (in *incoming) received() []map[string]string {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]map[string]string(nil), in.bodies...)
+}
+
+// newBridge starts a bridge to a Slack adapter posting to in
+func newBridge(t *testing.T, in *incoming, ttl time.Duration) (*Bridge, *Slack, *fakeChat) {
+	t.Helper()
+	cfg := config.Config{
+		BridgeAdapter:          "slack",
+		BridgeSlackIncomingURL: in.URL,
+		BridgeSlackToken:       "token",
+		BridgePresenceTTL:      ttl,
+		BridgeQueueSize:        16,
+		WebhookTimeout:         time.Second,
+	}
+	slack := NewSlack(cfg, logger.New("bridge"))
+	chat := &fakeChat{}
+	b := New(cfg, logger.New("bridge"), slack, chat)
+	if err := b.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Shutdown)
+	return b, slack, chat
+}
+
+// outgoing sends an outgoing webhook request to slack and returns the status
+func outgoing(slack *Slack, contentType, body string) int {
+	req := httptest.NewRequest(http.MethodPost, "/bridge/slack", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	slack.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+// form sends an outgoing webhook request with a form body
+func form(slack *Slack, values url.Values) int {
+	return outgoing(slack, "application/x-www-form-urlencoded", values.Encode())
+}
+
+// waitFor fails the test if cond does not hold within a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRejectsWrongToken(t *testing.T) {
+	_, slack, chat := newBridge(t, newIncoming(t), time.Minute)
+
+	if code := form(slack, url.Values{"token": {"wrong"}, "user_name": {"jane"}, "text": {"hi"}}); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := outgoing(slack, "application/json", `{"user_name":"jane","text":"hi"}`); code != http.StatusUnauthorized {
+		t.Errorf("missing token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if posts := chat.posted(); len(posts) != 0 {
+		t.Errorf("rejected requests were posted: %v", posts)
+	}
+}
+
+func TestFormAndJSONBodies(t *testing.T) {
+	_, slack, chat := newBridge(t, newIncoming(t), time.Minute)
+
+	if code := form(slack, url.Values{"token": {"token"}, "user_name": {"jane"}, "text": {"a &lt;b&gt; &amp; c"}}); code != http.StatusOK {
+		t.Fatalf("form body: status %d", code)
+	}
+	if code := outgoing(slack, "application/json; charset=utf-8", `{"token":"token","user_id":"U123","text":"from JSON"}`); code != http.StatusOK {
+		t.Fatalf("JSON body: status %d", code)
+	}
+	if code := outgoing(slack, "application/json", `{"token":`); code != http.StatusBadRequest {
+		t.Errorf("broken JSON body: status %d, want %d", code, http.StatusBadRequest)
+	}
+
+	want := []post{{"jane|slack", "", "a <b> & c"}, {"U123|slack", "", "from JSON"}}
+	posts := chat.posted()
+	if len(posts) != len(want) {
+		t.Fatalf("posted %v, want %v", posts, want)
+	}
+	for i := range want {
+		if posts[i] != want[i] {
+			t.Errorf("post %d = %v, want %v", i, posts[i], want[i])
+		}
+	}
+}
+
+func TestDropsBotMessages(t *testing.T) {
+	_, slack, chat := newBridge(t, newIncoming(t), time.Minute)
+
+	requests := []url.Values{
+		{"token": {"token"}, "user_name": {"jane"}, "bot_id": {"B123"}, "text": {"from a bot"}},
+		{"token": {"token"}, "user_name": {"slackbot"}, "text": {"reminder"}},
+		{"token": {"token"}, "user_id": {"USLACKBOT"}, "text": {"reminder"}},
+	}
+	for _, values := range requests {
+		if code := form(slack, values); code != http.StatusOK {
+			t.Errorf("%v: status %d, want %d", values, code, http.StatusOK)
+		}
+	}
+	if posts := chat.posted(); len(posts) != 0 {
+		t.Errorf("bot messages were posted: %v", posts)
+	}
+}
+
+func TestRelayAndEcho(t *testing.T) {
+	in := newIncoming(t)
+	b, slack, chat := newBridge(t, in, time.Minute)
+
+	b.Relay(message.NewUserMessage("bob", "ops only").InRoom("ops"))
+	b.Relay(message.NewUserMessage("jane|slack", "came from slack"))
+	b.Relay(message.NewPrivateMessage("bob", "alice", "psst"))
+	b.Relay(message.NewUserMessage("bob", "x < y & z"))
+	waitFor(t, "the incoming webhook", func() bool { return len(in.received()) > 0 })
+
+	time.Sleep(50 * time.Millisecond)
+	bodies := in.received()
+	if len(bodies) != 1 {
+		t.Fatalf("incoming webhook got %v, want only the message of the default room", bodies)
+	}
+	if bodies[0]["username"] != "bob" || bodies[0]["text"] != "x &lt; y &amp; z" {
+		t.Errorf("incoming webhook got %v", bodies[0])
+	}
+
+	// The external system sends the relayed message back as a post of the
+	// incoming webhook's bot
+	echo := url.Values{"token": {"token"}, "user_name": {"bob"}, "bot_id": {"B999"}, "text": {bodies[0]["text"]}}
+	if code := form(slack, echo); code != http.StatusOK {
+		t.Fatalf("echo: status %d", code)
+	}
+	if posts := chat.posted(); len(posts) != 0 {
+		t.Fatalf("the echo was posted: %v", posts)
+	}
+	// A person saying the same text is not an echo, however often
+	for i := 0; i < 2; i++ {
+		form(slack, url.Values{"token": {"token"}, "user_name": {"jane"}, "text": {bodies[0]["text"]}})
+	}
+	want := post{"jane|slack", "", "x < y & z"}
+	if posts := chat.posted(); len(posts) != 2 || posts[0] != want || posts[1] != want {
+		t.Errorf("posted %v, want the message of jane twice", posts)
+	}
+}
+
+func TestVirtualName(t *testing.T) {
+	b := New(config.Config{}, logger.New("bridge"), NewSlack(config.Config{}, logger.New("bridge")), &fakeChat{})
+	tests := []struct {
+		name, want string
+	}{
+		{"jane", "jane|slack"},
+		{"jane.doe@example.com", "janedoeexamplecom|slack"},
+		{"Ünïcode-name_1", "ncode-name_1|slack"},
+		{"bob|slack", "bobslack|slack"},
+		{"[SYSTEM] x", "SYSTEMx|slack"},
+		{"...", "unknown|slack"},
+		{"", "unknown|slack"},
+		{strings.Repeat("a", 40), strings.Repeat("a", maxNameLength) + "|slack"},
+	}
+	for _, tt := range tests {
+		if got := b.virtualName(tt.name); got != tt.want {
+			t.Errorf("virtualName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestVirtualUsersExpire(t *testing.T) {
+	b, slack, _ := newBridge(t, newIncoming(t), 50*time.Millisecond)
+
+	form(slack, url.Values{"token": {"token"}, "user_name": {"jane"}, "text": {"hi"}})
+	if users := b.Users(); len(users) != 1 || users[0] != "jane|slack" {
+		t.Fatalf("Users = %v, want [jane|slack]", users)
+	}
+	if !b.Owns("jane|slack") || b.Owns("jane") {
+		t.Error("Owns does not match the virtual users")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if users := b.Users(); len(users) != 0 {
+		t.Errorf("Users = %v after BridgePresenceTTL, want none", users)
+	}
+}
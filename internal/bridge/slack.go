@@ -0,0 +1,149 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"chat/internal/config"
+	"chat/pkg/logger"
+)
+
+// maxSlackBody limits the requests of outgoing webhooks
+const maxSlackBody = 64 * 1024
+
+// slackEscaper escapes the characters Slack reserves for markup
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackUnescaper reverses slackEscaper
+var slackUnescaper = strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">")
+
+// Slack is an adapter for Slack-style webhooks, which Mattermost and
+// Rocket.Chat also offer. Chat messages are posted to an incoming webhook;
+// the external system posts its messages to the adapter, an http.Handler,
+// through an outgoing webhook carrying a shared token.
+type Slack struct {
+	cfg     config.Config
+	logger  *logger.Logger
+	client  *http.Client
+	mu      sync.Mutex
+	receive func(Message) // Guarded by mu, nil unless started
+}
+
+// slackOutgoing is the JSON form of an outgoing webhook request. Slack
+// sends the same fields form-encoded.
+type slackOutgoing struct {
+	Token    string `json:"token"`
+	UserID   string `json:"user_id"`
+	UserName string `json:"user_name"`
+	Text     string `json:"text"`
+	BotID    string `json:"bot_id"`
+}
+
+// NewSlack creates a Slack-style adapter from the BRIDGE_SLACK_* settings
+func NewSlack(cfg config.Config, logger *logger.Logger) *Slack {
+	return &Slack{
+		cfg:    cfg,
+		logger: logger,
+		client: &http.Client{Timeout: cfg.WebhookTimeout},
+	}
+}
+
+// Name returns the name appended to Slack users in the chat
+func (s *Slack) Name() string {
+	return "slack"
+}
+
+// Start passes messages of outgoing webhook requests to receive
+func (s *Slack) Start(receive func(Message)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receive = receive
+	return nil
+}
+
+// Close makes the adapter refuse outgoing webhook requests
+func (s *Slack) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.receive = nil
+	return nil
+}
+
+// Send posts msg to the incoming webhook under the name of its sender
+func (s *Slack) Send(msg Message) error {
+	body, err := json.Marshal(map[string]string{
+		"username": msg.User,
+		"text":     slackEscaper.Replace(msg.Text),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %v", err)
+	}
+	resp, err := s.client.Post(s.cfg.BridgeSlackIncomingURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("incoming webhook returned %s: %s", resp.Status, bytes.TrimSpace(reply))
+	}
+	return nil
+}
+
+// ServeHTTP accepts the requests of an outgoing webhook
+func (s *Slack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSlackBody)
+	var req slackOutgoing
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form body", http.StatusBadRequest)
+			return
+		}
+		req = slackOutgoing{
+			Token:    r.PostForm.Get("token"),
+			UserID:   r.PostForm.Get("user_id"),
+			UserName: r.PostForm.Get("user_name"),
+			Text:     r.PostForm.Get("text"),
+			BotID:    r.PostForm.Get("bot_id"),
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(s.cfg.BridgeSlackToken)) != 1 {
+		s.logger.Error("Rejected Slack bridge request from %s: invalid token", r.RemoteAddr)
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	receive := s.receive
+	s.mu.Unlock()
+	if receive == nil {
+		http.Error(w, "bridge is not running", http.StatusServiceUnavailable)
+		return
+	}
+	// Messages of bots include those the incoming webhook posted for the chat
+	if req.BotID == "" && req.UserName != "slackbot" && req.UserID != "USLACKBOT" {
+		name := req.UserName
+		if name == "" {
+			name = req.UserID
+		}
+		receive(Message{User: name, Text: slackUnescaper.Replace(req.Text)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
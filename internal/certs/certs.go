@@ -0,0 +1,138 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"chat/internal/config"
+)
+
+// validity is the lifetime of a generated certificate
+const validity = 2 * 365 * 24 * time.Hour
+
+// ServerConfig returns the TLS configuration of the server, loaded from
+// TLS_CERT_FILE and TLS_KEY_FILE. A self-signed certificate for this host is
+// generated on first start if neither file exists.
+func ServerConfig(cfg config.Config) (*tls.Config, error) {
+	_, certErr := os.Stat(cfg.TLSCertFile)
+	_, keyErr := os.Stat(cfg.TLSKeyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		if err := generate(cfg); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// ClientConfig returns the TLS configuration of the client. It trusts the
+// certificates in TLS_CA_FILE if the file exists and the system roots otherwise.
+func ClientConfig(cfg config.Config) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS13}
+	if cfg.TLSCAFile == "" {
+		return conf, nil
+	}
+	data, err := os.ReadFile(cfg.TLSCAFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return conf, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.TLSCAFile)
+	}
+	conf.RootCAs = pool
+	return conf, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of the leaf certificate of conf
+func Fingerprint(conf *tls.Config) string {
+	if len(conf.Certificates) == 0 || len(conf.Certificates[0].Certificate) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(conf.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:])
+}
+
+// generate writes a self-signed certificate valid for the names and
+// addresses of this host. It is its own CA, so clients can trust it by
+// pointing TLS_CA_FILE at the certificate file.
+func generate(cfg config.Config) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate TLS key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("failed to generate certificate serial: %v", err)
+	}
+
+	names := []string{"localhost"}
+	if host, err := os.Hostname(); err == nil && host != "localhost" {
+		names = append(names, host)
+	}
+	if cfg.ServerName != "" && cfg.ServerName != names[len(names)-1] {
+		names = append(names, cfg.ServerName)
+	}
+	ips := []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+				ips = append(ips, ipNet.IP)
+			}
+		}
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: cfg.ServerName, Organization: []string{"chat"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              names,
+		IPAddresses:           ips,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create TLS certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to encode TLS key: %v", err)
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(cfg.TLSKeyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write TLS key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(cfg.TLSCertFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("failed to write TLS certificate: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+)
+
+// Errors returned when running commands
+var (
+	ErrInvalidCommand = errors.New("ERR003: invalid command")
+	ErrNotAdmin       = errors.New("ERR010: command requires an admin account")
+)
+
+// Permission controls who may run a command
+type Permission int
+
+const (
+	Everyone Permission = iota
+	Admin               // Accounts listed in ADMIN_USERS
+)
+
+// Context is passed to a command handler
+type Context struct {
+	Caller string            // User who ran the command
+	Room   string            // Room the caller talks in, empty for the default room
+	Name   string            // Command name without the slash
+	Args   []string          // Words after the command name
+	Input  string            // Everything after the command name, spacing kept
+	Time   time.Time         // When the command was received
+	Reply  func(text string) // Sends text to the caller only
+}
+
+// Handler runs a command. Errors are sent to the caller.
+type Handler func(ctx *Context) error
+
+// Command is a chat command such as /pm
+type Command struct {
+	Name        string // Without the slash
+	Usage       string // Arguments, such as "<username> <message>"
+	Description string
+	Permission  Permission
+	Handler     Handler
+}
+
+// String returns the command as listed by /help
+func (c Command) String() string {
+	line := "/" + c.Name
+	if c.Usage != "" {
+		line += " " + c.Usage
+	}
+	if c.Description != "" {
+		line += ": " + c.Description
+	}
+	if c.Permission == Admin {
+		line += " (admins only)"
+	}
+	return line
+}
+
+// Registry holds the commands users can run. Commands can be added while
+// the server is running.
+type Registry struct {
+	cfg      config.Config
+	commands map[string]Command
+	mu       sync.RWMutex
+}
+
+// NewRegistry creates a registry containing only /help
+func NewRegistry(cfg config.Config) *Registry {
+	r := &Registry{
+		cfg:      cfg,
+		commands: make(map[string]Command),
+	}
+	r.commands["help"] = Command{
+		Name:        "help",
+		Usage:       "[command]",
+		Description: "List the commands you can run, or describe one",
+		Handler:     r.help,
+	}
+	return r
+}
+
+// Register adds a command, failing if its name is taken
+func (r *Registry) Register(cmd Command) error {
+	return r.RegisterAll([]Command{cmd})
+}
+
+// RegisterAll adds several commands, or none of them if one is invalid or
+// its name is taken
+func (r *Registry) RegisterAll(cmds []Command) error {
+	for _, cmd := range cmds {
+		if cmd.Name == "" || strings.ContainsAny(cmd.Name, "/ \t\r\n") {
+			return fmt.Errorf("invalid command name %q", cmd.Name)
+		}
+		if cmd.Handler == nil {
+			return fmt.Errorf("command /%s has no handler", cmd.Name)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool)
+	for _, cmd := range cmds {
+		if _, exists := r.commands[cmd.Name]; exists || seen[cmd.Name] {
+			return fmt.Errorf("command /%s is already registered", cmd.Name)
+		}
+		seen[cmd.Name] = true
+	}
+	for _, cmd := range cmds {
+		r.commands[cmd.Name] = cmd
+	}
+	return nil
+}
+
+// Lookup returns the command named name, without the slash
+func (r *Registry) Lookup(name string) (Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// Available returns the commands username may run, ordered by name
+func (r *Registry) Available(username string) []Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var cmds []Command
+	for _, cmd := range r.commands {
+		if r.allowed(cmd, username) {
+			cmds = append(cmds, cmd)
+		}
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// Run parses input, a line starting with a slash, and runs the command it
+// names. ctx supplies the caller, room, time and reply function.
+func (r *Registry) Run(ctx *Context, input string) error {
+	parts := strings.Fields(input)
+	if len(parts) == 0 {
+		return ErrInvalidCommand
+	}
+	cmd, ok := r.Lookup(strings.TrimPrefix(parts[0], "/"))
+	if !ok {
+		return fmt.Errorf("ERR005: unknown command %s", parts[0])
+	}
+	if !r.allowed(cmd, ctx.Caller) {
+		return ErrNotAdmin
+	}
+	ctx.Name = cmd.Name
+	ctx.Args = parts[1:]
+	ctx.Input = strings.TrimSpace(strings.TrimPrefix(input, parts[0]))
+	return cmd.Handler(ctx)
+}
+
+// allowed reports whether username may run cmd
+func (r *Registry) allowed(cmd Command, username string) bool {
+	return cmd.Permission != Admin || r.cfg.IsAdmin(username)
+}
+
+// help lists the commands available to the caller, or describes the one named
+func (r *Registry) help(ctx *Context) error {
+	if len(ctx.Args) > 0 {
+		name := strings.TrimPrefix(ctx.Args[0], "/")
+		cmd, ok := r.Lookup(name)
+		if !ok || !r.allowed(cmd, ctx.Caller) {
+			return fmt.Errorf("ERR005: unknown command /%s", name)
+		}
+		ctx.Reply(cmd.String())
+		return nil
+	}
+	lines := []string{"Available commands:"}
+	for _, cmd := range r.Available(ctx.Caller) {
+		lines = append(lines, "  "+cmd.String())
+	}
+	ctx.Reply(strings.Join(lines, "\n"))
+	return nil
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +19,108 @@ type Config struct {
 	DialTimeout       time.Duration
 	BroadcastInterval time.Duration
 	HeartbeatInterval time.Duration
+	SecretKey         string
+	SecretKeyFile     string
+	DatabaseDSN       string
+	AdminUsers        []string
+	BotUsers          []string
+	ExportDir         string
+
+	// Message retention, zero values keep messages forever
+	RetentionMaxAge         time.Duration
+	RetentionMaxRows        int
+	PrivateRetentionMaxAge  time.Duration
+	PrivateRetentionMaxRows int
+	RetentionInterval       time.Duration
+	RetentionBatchSize      int
+	RetentionArchive        bool
+
+	// Message persistence and database pool
+	PersistMode          string
+	PersistBatchSize     int
+	PersistFlushInterval time.Duration
+	PersistQueueSize     int
+	SQLiteSynchronous    string
+	DBMaxOpenConns       int
+	DBMaxIdleConns       int
+	DBConnMaxLifetime    time.Duration
+
+	// Online backups, a zero interval disables scheduled snapshots
+	BackupDir      string
+	BackupInterval time.Duration
+	BackupKeep     int
+
+	// Encryption of message content at rest
+	MessageEncryption bool
+	MessageKeys       string
+	MessageKeyFile    string
+
+	// Server discovery
+	ServerName    string // Announced to clients, defaults to the hostname
+	AdvertiseAddr string // TCP address announced to clients, defaults to TCPPort
+	ServerAddr    string // TCP address the client connects to, defaults to localhost
+
+	// Multicast discovery, used together with or instead of BroadcastAddr
+	MulticastGroups     []string // IPv4 or IPv6 group:port addresses
+	MulticastInterfaces []string // Interface names, empty for the system default
+	MulticastTTL        int      // TTL or IPv6 hop limit of sent packets
+	MulticastLoopback   bool     // Deliver packets to listeners on the same host
+
+	// mDNS/DNS-SD advertisement of _chat._tcp.local
+	MDNSEnabled bool
+	MDNSPort    int
+
+	// Authentication of discovery packets
+	DiscoveryKeyFile       string        // Ed25519 key of the server, generated if missing
+	DiscoverySecret        string        // Shared HMAC secret, used instead of the Ed25519 key if set
+	DiscoveryMaxAge        time.Duration // Older packets and replayed nonces are dropped
+	DiscoveryRequireSigned bool          // Drop unsigned packets from older servers
+	DiscoveryKnownServers  string        // Server keys pinned by the client on first use
+	DiscoveryPacketSize    int           // Largest discovery datagram, kept under the path MTU
+
+	// Presence updates, sent on change with a full snapshot every PresenceKeepalive
+	PresenceKeepalive time.Duration
+	PresenceUnicast   bool // Also send updates to the UDP port each client registers
+
+	// Reliable UDP chat transport, an empty port disables it on the server
+	UDPChatPort string
+	Transport   string // Transport the client connects with, tcp, udp or quic
+
+	// QUIC transport, an empty port disables it on the server
+	QUICPort    string
+	TLSCertFile string // Server certificate, generated self-signed if missing and a TLS listener is configured
+	TLSKeyFile  string
+	TLSCAFile   string // Certificates the client trusts, system roots if missing
+	DownloadDir string // Where the client saves received files
+	FileMaxSize int64  // Largest file sent with /sendfile, in bytes
+
+	// WebSocket gateway, browser client and HTTP API, disabled unless a port is set
+	HTTPPort string
+
+	// IRC gateway, disabled unless a port is set
+	IRCPort    string
+	IRCChannel string // Channel mapped onto the default room
+
+	// Outgoing webhooks, registered with the webhooks subcommand
+	WebhookTimeout     time.Duration // Per delivery attempt
+	WebhookMaxAttempts int           // Attempts before a delivery is dead-lettered
+	WebhookBackoff     time.Duration // Delay before the first retry, doubled on each retry
+	WebhookMaxBackoff  time.Duration
+	WebhookQueueSize   int
+	WebhookWorkers     int
+
+	// Bridge of the default room to an external chat system, disabled unless an adapter is set
+	BridgeAdapter          string        // Only slack so far
+	BridgeSlackIncomingURL string        // Incoming webhook chat messages are posted to
+	BridgeSlackToken       string        // Token outgoing webhook requests must carry
+	BridgePresenceTTL      time.Duration // How long external users stay listed after speaking
+	BridgeQueueSize        int
+
+	// Federation with other servers, disabled unless a port or peers are set
+	FederationName   string   // Users of this server are user@name on the others
+	FederationPort   string   // Where peers connect, empty to only dial out
+	FederationPeers  []string // name=host:port of the peers to dial
+	FederationSecret string   // Shared by all servers of the federation
 }
 
 // Load loads configuration from environment variables or defaults
@@ -29,6 +134,79 @@ func Load() (Config, error) {
 		DialTimeout:       parseDuration(getEnv("DIAL_TIMEOUT", "10s")),
 		BroadcastInterval: parseDuration(getEnv("BROADCAST_INTERVAL", "5s")),
 		HeartbeatInterval: parseDuration(getEnv("HEARTBEAT_INTERVAL", "15s")),
+		SecretKey:         getEnv("SECRET_KEY", ""),
+		SecretKeyFile:     getEnv("SECRET_KEY_FILE", "chat.key"),
+		DatabaseDSN:       getEnv("DATABASE_DSN", "sqlite://chat.db"),
+		AdminUsers:        parseList(getEnv("ADMIN_USERS", "")),
+		BotUsers:          parseList(getEnv("BOT_USERS", "")),
+		ExportDir:         getEnv("EXPORT_DIR", "exports"),
+
+		RetentionMaxAge:         parseDuration(getEnv("RETENTION_MAX_AGE", "0s")),
+		RetentionMaxRows:        parseInt(getEnv("RETENTION_MAX_ROWS", "0")),
+		PrivateRetentionMaxAge:  parseDuration(getEnv("PRIVATE_RETENTION_MAX_AGE", "0s")),
+		PrivateRetentionMaxRows: parseInt(getEnv("PRIVATE_RETENTION_MAX_ROWS", "0")),
+		RetentionInterval:       parseDuration(getEnv("RETENTION_INTERVAL", "1h")),
+		RetentionBatchSize:      parseInt(getEnv("RETENTION_BATCH_SIZE", "500")),
+		RetentionArchive:        parseBool(getEnv("RETENTION_ARCHIVE", "false")),
+
+		PersistMode:          getEnv("PERSIST_MODE", "async"),
+		PersistBatchSize:     parseInt(getEnv("PERSIST_BATCH_SIZE", "100")),
+		PersistFlushInterval: parseDuration(getEnv("PERSIST_FLUSH_INTERVAL", "50ms")),
+		PersistQueueSize:     parseInt(getEnv("PERSIST_QUEUE_SIZE", "1000")),
+		SQLiteSynchronous:    strings.ToUpper(getEnv("SQLITE_SYNCHRONOUS", "NORMAL")),
+		DBMaxOpenConns:       parseInt(getEnv("DB_MAX_OPEN_CONNS", "8")),
+		DBMaxIdleConns:       parseInt(getEnv("DB_MAX_IDLE_CONNS", "4")),
+		DBConnMaxLifetime:    parseDuration(getEnv("DB_CONN_MAX_LIFETIME", "30m")),
+		BackupDir:            getEnv("BACKUP_DIR", "backups"),
+		BackupInterval:       parseDuration(getEnv("BACKUP_INTERVAL", "0s")),
+		BackupKeep:           parseInt(getEnv("BACKUP_KEEP", "7")),
+		MessageEncryption:    parseBool(getEnv("MESSAGE_ENCRYPTION", "false")),
+		MessageKeys:          getEnv("MESSAGE_KEYS", ""),
+		MessageKeyFile:       getEnv("MESSAGE_KEY_FILE", "message.keys"),
+		ServerName:           getEnv("SERVER_NAME", hostname()),
+		AdvertiseAddr:        getEnv("ADVERTISE_ADDR", ""),
+		ServerAddr:           getEnv("SERVER_ADDR", ""),
+		MulticastGroups:      parseList(getEnv("MULTICAST_GROUPS", "")),
+		MulticastInterfaces:  parseList(getEnv("MULTICAST_INTERFACES", "")),
+		MulticastTTL:         parseInt(getEnv("MULTICAST_TTL", "1")),
+		MulticastLoopback:    parseBool(getEnv("MULTICAST_LOOPBACK", "true")),
+		MDNSEnabled:          parseBool(getEnv("MDNS_ENABLED", "true")),
+		MDNSPort:             parseInt(getEnv("MDNS_PORT", "5353")),
+
+		DiscoveryKeyFile:       getEnv("DISCOVERY_KEY_FILE", "discovery.key"),
+		DiscoverySecret:        getEnv("DISCOVERY_SECRET", ""),
+		DiscoveryMaxAge:        parseDuration(getEnv("DISCOVERY_MAX_AGE", "30s")),
+		DiscoveryRequireSigned: parseBool(getEnv("DISCOVERY_REQUIRE_SIGNED", "true")),
+		DiscoveryKnownServers:  getEnv("DISCOVERY_KNOWN_SERVERS", "known_servers"),
+		DiscoveryPacketSize:    parseInt(getEnv("DISCOVERY_PACKET_SIZE", "1200")),
+		PresenceKeepalive:      parseDuration(getEnv("PRESENCE_KEEPALIVE", "30s")),
+		PresenceUnicast:        parseBool(getEnv("PRESENCE_UNICAST", "true")),
+		UDPChatPort:            getEnv("UDP_CHAT_PORT", ""),
+		Transport:              strings.ToLower(getEnv("TRANSPORT", "tcp")),
+		QUICPort:               getEnv("QUIC_PORT", ""),
+		TLSCertFile:            getEnv("TLS_CERT_FILE", "tls.crt"),
+		TLSKeyFile:             getEnv("TLS_KEY_FILE", "tls.key"),
+		TLSCAFile:              getEnv("TLS_CA_FILE", "tls.crt"),
+		DownloadDir:            getEnv("DOWNLOAD_DIR", "downloads"),
+		FileMaxSize:            int64(parseInt(getEnv("FILE_MAX_SIZE", "10485760"))),
+		HTTPPort:               getEnv("HTTP_PORT", ""),
+		IRCPort:                getEnv("IRC_PORT", ""),
+		IRCChannel:             getEnv("IRC_CHANNEL", "#chat"),
+		WebhookTimeout:         parseDuration(getEnv("WEBHOOK_TIMEOUT", "10s")),
+		WebhookMaxAttempts:     parseInt(getEnv("WEBHOOK_MAX_ATTEMPTS", "5")),
+		WebhookBackoff:         parseDuration(getEnv("WEBHOOK_BACKOFF", "2s")),
+		WebhookMaxBackoff:      parseDuration(getEnv("WEBHOOK_MAX_BACKOFF", "5m")),
+		WebhookQueueSize:       parseInt(getEnv("WEBHOOK_QUEUE_SIZE", "1000")),
+		WebhookWorkers:         parseInt(getEnv("WEBHOOK_WORKERS", "4")),
+		BridgeAdapter:          strings.ToLower(getEnv("BRIDGE_ADAPTER", "")),
+		BridgeSlackIncomingURL: getEnv("BRIDGE_SLACK_INCOMING_URL", ""),
+		BridgeSlackToken:       getEnv("BRIDGE_SLACK_TOKEN", ""),
+		BridgePresenceTTL:      parseDuration(getEnv("BRIDGE_PRESENCE_TTL", "30m")),
+		BridgeQueueSize:        parseInt(getEnv("BRIDGE_QUEUE_SIZE", "100")),
+		FederationName:         getEnv("FEDERATION_NAME", ""),
+		FederationPort:         getEnv("FEDERATION_PORT", ""),
+		FederationPeers:        parseList(getEnv("FEDERATION_PEERS", "")),
+		FederationSecret:       getEnv("FEDERATION_SECRET", ""),
 	}
 	if err := cfg.Validate(); err != nil {
 		return Config{}, err
@@ -38,25 +216,219 @@ func Load() (Config, error) {
 
 // TCPAddr returns the TCP server address
 func (c Config) TCPAddr() string {
+	if c.ServerAddr != "" {
+		return c.ServerAddr
+	}
 	return "localhost" + c.TCPPort
 }
 
+// ChatUDPAddr returns the address of the UDP chat transport, on the host of TCPAddr
+func (c Config) ChatUDPAddr() string {
+	return c.onServerHost(c.UDPChatPort)
+}
+
+// ChatQUICAddr returns the address of the QUIC transport, on the host of TCPAddr
+func (c Config) ChatQUICAddr() string {
+	return c.onServerHost(c.QUICPort)
+}
+
+// onServerHost returns the address of port on the host of TCPAddr
+func (c Config) onServerHost(port string) string {
+	host, _, err := net.SplitHostPort(c.TCPAddr())
+	if err != nil {
+		return "localhost" + port
+	}
+	_, portNum, err := net.SplitHostPort(port)
+	if err != nil {
+		return "localhost" + port
+	}
+	return net.JoinHostPort(host, portNum)
+}
+
+// AnnounceAddr returns the TCP address announced in discovery packets
+func (c Config) AnnounceAddr() string {
+	if c.AdvertiseAddr != "" {
+		return c.AdvertiseAddr
+	}
+	return c.TCPPort
+}
+
+// AnnounceQUICAddr returns the QUIC address announced in discovery packets,
+// on the host of AnnounceAddr, or an empty string without QUIC
+func (c Config) AnnounceQUICAddr() string {
+	if c.QUICPort == "" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(c.AnnounceAddr())
+	if err != nil {
+		return c.QUICPort
+	}
+	_, port, err := net.SplitHostPort(c.QUICPort)
+	if err != nil {
+		return c.QUICPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
 // UDPAddr returns the UDP broadcast address
 func (c Config) UDPAddr() string {
 	return c.BroadcastAddr
 }
 
+// IsAdmin reports whether username is listed in ADMIN_USERS
+func (c Config) IsAdmin(username string) bool {
+	for _, admin := range c.AdminUsers {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// IsBot reports whether username is listed in BOT_USERS
+func (c Config) IsBot(username string) bool {
+	for _, bot := range c.BotUsers {
+		if bot == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Federated reports whether the server federates with other servers
+func (c Config) Federated() bool {
+	return c.FederationPort != "" || len(c.FederationPeers) > 0
+}
+
 // Validate checks configuration validity
 func (c Config) Validate() error {
-	if c.TCPPort == "" || c.UDPPort == "" || c.BroadcastAddr == "" {
-		return fmt.Errorf("ports or broadcast address cannot be empty")
+	if c.TCPPort == "" || c.UDPPort == "" {
+		return fmt.Errorf("ports cannot be empty")
+	}
+	if c.BroadcastAddr == "" && len(c.MulticastGroups) == 0 {
+		return fmt.Errorf("broadcast address and multicast groups cannot both be empty")
+	}
+	for _, group := range c.MulticastGroups {
+		addr, err := net.ResolveUDPAddr("udp", group)
+		if err != nil || !addr.IP.IsMulticast() || addr.Port == 0 {
+			return fmt.Errorf("invalid multicast group %q, expected group:port", group)
+		}
+	}
+	if c.MulticastTTL < 1 || c.MulticastTTL > 255 {
+		return fmt.Errorf("multicast TTL must be between 1 and 255")
+	}
+	if c.MDNSPort < 1 || c.MDNSPort > 65535 {
+		return fmt.Errorf("mDNS port must be between 1 and 65535")
+	}
+	if c.DiscoveryMaxAge <= 0 {
+		return fmt.Errorf("discovery max age must be positive")
+	}
+	if c.DiscoveryPacketSize < 1024 || c.DiscoveryPacketSize > 65507 {
+		return fmt.Errorf("discovery packet size must be between 1024 and 65507")
+	}
+	if c.PresenceKeepalive <= 0 {
+		return fmt.Errorf("presence keepalive must be positive")
+	}
+	if c.Transport != "tcp" && c.Transport != "udp" && c.Transport != "quic" {
+		return fmt.Errorf("transport must be tcp, udp or quic")
+	}
+	if c.Transport == "udp" && c.UDPChatPort == "" {
+		return fmt.Errorf("UDP transport requires UDP_CHAT_PORT")
+	}
+	if c.Transport == "quic" && c.QUICPort == "" {
+		return fmt.Errorf("QUIC transport requires QUIC_PORT")
+	}
+	if c.QUICPort != "" && (c.TLSCertFile == "" || c.TLSKeyFile == "") {
+		return fmt.Errorf("QUIC transport requires TLS_CERT_FILE and TLS_KEY_FILE")
+	}
+	if len(c.IRCChannel) < 2 || len(c.IRCChannel) > 50 || c.IRCChannel[0] != '#' || strings.ContainsAny(c.IRCChannel, " ,:\a\r\n") {
+		return fmt.Errorf("IRC channel must start with # and contain no spaces, commas or colons")
+	}
+	if c.FileMaxSize <= 0 {
+		return fmt.Errorf("file max size must be positive")
+	}
+	if c.DiscoverySecret == "" && c.DiscoveryKeyFile == "" {
+		return fmt.Errorf("discovery key file or secret is required")
+	}
+	if c.DatabaseDSN == "" {
+		return fmt.Errorf("database DSN cannot be empty")
+	}
+	if c.ExportDir == "" {
+		return fmt.Errorf("export directory cannot be empty")
+	}
+	if c.RetentionMaxAge < 0 || c.RetentionMaxRows < 0 || c.PrivateRetentionMaxAge < 0 || c.PrivateRetentionMaxRows < 0 {
+		return fmt.Errorf("retention limits cannot be negative, and max ages must be durations such as 720h")
+	}
+	if c.RetentionInterval <= 0 || c.RetentionBatchSize <= 0 {
+		return fmt.Errorf("retention interval must be a positive duration and batch size positive")
+	}
+	if c.PersistMode != "async" && c.PersistMode != "sync" {
+		return fmt.Errorf("persist mode must be async or sync")
+	}
+	if c.PersistBatchSize <= 0 || c.PersistFlushInterval <= 0 || c.PersistQueueSize <= 0 {
+		return fmt.Errorf("persist batch size, flush interval and queue size must be positive")
+	}
+	switch c.SQLiteSynchronous {
+	case "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return fmt.Errorf("SQLite synchronous must be OFF, NORMAL, FULL or EXTRA")
+	}
+	if c.DBMaxOpenConns < 0 || c.DBMaxIdleConns < 0 || c.DBConnMaxLifetime < 0 {
+		return fmt.Errorf("database pool settings cannot be negative")
+	}
+	if c.BackupDir == "" {
+		return fmt.Errorf("backup directory cannot be empty")
+	}
+	if c.BackupInterval < 0 || c.BackupKeep < 0 {
+		return fmt.Errorf("backup interval must be a duration such as 24h and keep count cannot be negative")
+	}
+	if c.MessageEncryption && c.MessageKeys == "" && c.MessageKeyFile == "" {
+		return fmt.Errorf("message encryption requires MESSAGE_KEYS or MESSAGE_KEY_FILE")
+	}
+	if c.WebhookTimeout <= 0 || c.WebhookMaxAttempts <= 0 || c.WebhookBackoff <= 0 || c.WebhookMaxBackoff < c.WebhookBackoff {
+		return fmt.Errorf("webhook timeout, attempts and backoff must be positive, with max backoff at least the backoff")
+	}
+	if c.WebhookQueueSize <= 0 || c.WebhookWorkers <= 0 {
+		return fmt.Errorf("webhook queue size and workers must be positive")
+	}
+	if c.BridgeAdapter != "" && c.BridgeAdapter != "slack" {
+		return fmt.Errorf("bridge adapter must be slack or empty")
+	}
+	if c.BridgeAdapter == "slack" && (c.BridgeSlackIncomingURL == "" || c.BridgeSlackToken == "" || c.HTTPPort == "") {
+		return fmt.Errorf("Slack bridge requires BRIDGE_SLACK_INCOMING_URL, BRIDGE_SLACK_TOKEN and HTTP_PORT")
+	}
+	if c.BridgePresenceTTL <= 0 || c.BridgeQueueSize <= 0 {
+		return fmt.Errorf("bridge presence TTL and queue size must be positive")
+	}
+	if c.Federated() {
+		if c.FederationName == "" || strings.ContainsAny(c.FederationName, "@=, \t") {
+			return fmt.Errorf("federation requires FEDERATION_NAME without @, =, commas or spaces")
+		}
+		if len(c.FederationSecret) < 16 {
+			return fmt.Errorf("federation requires a FEDERATION_SECRET of at least 16 characters")
+		}
+		for _, peer := range c.FederationPeers {
+			name, addr, ok := strings.Cut(peer, "=")
+			if !ok || name == "" || addr == "" || name == c.FederationName {
+				return fmt.Errorf("invalid federation peer %q, expected name=host:port", peer)
+			}
+		}
 	}
 	if c.TCPTimeout <= 0 || c.UDPTimeout <= 0 || c.DialTimeout <= 0 || c.BroadcastInterval <= 0 || c.HeartbeatInterval <= 0 {
-		return fmt.Errorf("timeouts must be positive")
+		return fmt.Errorf("timeouts and intervals must be positive durations")
 	}
 	return nil
 }
 
+// hostname returns the host name, or "chat" if it cannot be determined
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "chat"
+	}
+	return name
+}
+
 // getEnv retrieves environment variable or fallback
 func getEnv(key, fallback string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -65,11 +437,38 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-// parseDuration parses duration string or returns default
+// parseDuration parses a duration string or returns -1 so Validate
+// rejects it. Go durations have no day unit, 30d must be written 720h.
 func parseDuration(s string) time.Duration {
-	d, err := time.ParseDuration(s)
+	d, err := time.ParseDuration(strings.TrimSpace(s))
 	if err != nil {
-		return 30 * time.Second
+		return -1
 	}
 	return d
-}
\ No newline at end of file
+}
+
+// parseInt parses an integer string or returns -1 so Validate rejects it
+func parseInt(s string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// parseBool parses a boolean string or returns false
+func parseBool(s string) bool {
+	b, err := strconv.ParseBool(strings.TrimSpace(s))
+	return err == nil && b
+}
+
+// parseList splits a comma separated list, dropping empty entries
+func parseList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
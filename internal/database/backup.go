@@ -0,0 +1,58 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Backup writes a consistent snapshot of the database to path without blocking writers
+func (db *DB) Backup(path string) error {
+	if db.dialect.backup == nil {
+		return fmt.Errorf("%s does not support online backups", db.dialect.name)
+	}
+	if err := db.dialect.backup(db.conn, path); err != nil {
+		return fmt.Errorf("failed to back up database: %v", err)
+	}
+	return nil
+}
+
+// sqliteBackup copies the database inside one read transaction with VACUUM INTO.
+// The snapshot is also compacted, and path must not exist yet.
+func sqliteBackup(conn *sql.DB, path string) error {
+	_, err := conn.Exec("VACUUM INTO ?", path)
+	return err
+}
+
+// CheckIntegrity runs PRAGMA integrity_check on the SQLite file at path
+func CheckIntegrity(path string) error {
+	conn, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer conn.Close()
+
+	rows, err := conn.Query("PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("failed to check integrity of %s: %v", path, err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return fmt.Errorf("failed to check integrity of %s: %v", path, err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check integrity of %s: %v", path, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity check of %s failed: %s", path, strings.Join(problems, "; "))
+	}
+	return nil
+}
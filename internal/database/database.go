@@ -1,65 +1,171 @@
 package database
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"strings"
+	"time"
+
+	"chat/internal/message"
+	"chat/internal/secret"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// DB manages the SQLite database connection
+// DB is the database/sql implementation of Store, used for SQLite and PostgreSQL
 type DB struct {
-	conn *sql.DB
+	conn    *sql.DB
+	dialect dialect
+	keys    *secret.Keyring // Encrypts message content if set
+}
+
+// dialect captures the differences between SQL backends
+type dialect struct {
+	name       string
+	driver     string
+	migrations []Migration
+	// numbered reports whether placeholders are $1, $2... instead of ?
+	numbered bool
+	vacuum   func(conn *sql.DB) error
+	// backup writes a consistent snapshot to path, nil if unsupported
+	backup func(conn *sql.DB, path string) error
+	// driverDSN adds backend specific connection settings to the DSN
+	driverDSN func(dsn string, opts Options) string
+	// tableExists counts the tables named by its only parameter
+	tableExists string
+}
+
+// sqlite is the default local backend
+var sqlite = dialect{
+	name:        "SQLite",
+	driver:      "sqlite3",
+	migrations:  sqliteMigrations,
+	vacuum:      sqliteVacuum,
+	backup:      sqliteBackup,
+	driverDSN:   sqliteDSN,
+	tableExists: "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?",
 }
 
-// New creates and initializes a new SQLite database
-func New(filePath string) (*DB, error) {
-	conn, err := sql.Open("sqlite3", filePath)
+// openSQL opens a database/sql backend without touching its schema
+func openSQL(d dialect, dsn string, opts Options) (*DB, error) {
+	if d.driverDSN != nil {
+		dsn = d.driverDSN(dsn, opts)
+	}
+	conn, err := sql.Open(d.driver, dsn)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open SQLite database: %v", err)
+		return nil, fmt.Errorf("failed to open %s database: %v", d.name, err)
+	}
+	conn.SetMaxOpenConns(opts.MaxOpenConns)
+	conn.SetMaxIdleConns(opts.MaxIdleConns)
+	conn.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	return &DB{conn: conn, dialect: d}, nil
+}
+
+// sqliteDSN enables WAL so readers do not block the writer, and sets the
+// sync level and busy timeout on every pooled connection
+func sqliteDSN(path string, opts Options) string {
+	params := []string{"_journal_mode=WAL", "_busy_timeout=5000"}
+	if opts.Synchronous != "" {
+		params = append(params, "_synchronous="+opts.Synchronous)
 	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + strings.Join(params, "&")
+}
 
-	// Create tables if not exist
-	if err := createTables(conn); err != nil {
-		conn.Close()
-		return nil, err
+// rebind rewrites ? placeholders for the dialect
+func (db *DB) rebind(query string) string {
+	if !db.dialect.numbered {
+		return query
 	}
+	var sb strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&sb, "$%d", n)
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
 
-	return &DB{conn: conn}, nil
+// exec runs a statement with dialect placeholders
+func (db *DB) exec(query string, args ...interface{}) (sql.Result, error) {
+	return db.conn.Exec(db.rebind(query), args...)
 }
 
-// createTables creates the users and messages tables if they don't exist
-func createTables(conn *sql.DB) error {
-	usersTable := `
-	CREATE TABLE IF NOT EXISTS users (
-		username TEXT PRIMARY KEY,
-		password_hash TEXT NOT NULL
-	);`
-	messagesTable := `
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		from_username TEXT,
-		to_username TEXT,
-		content TEXT NOT NULL,
-		timestamp TEXT NOT NULL
-	);`
+// query runs a query with dialect placeholders
+func (db *DB) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return db.conn.Query(db.rebind(query), args...)
+}
+
+// queryRow runs a single row query with dialect placeholders
+func (db *DB) queryRow(query string, args ...interface{}) *sql.Row {
+	return db.conn.QueryRow(db.rebind(query), args...)
+}
 
-	_, err := conn.Exec(usersTable)
+// SaveUser saves a user with hashed password
+func (db *DB) SaveUser(username, passwordHash string) error {
+	_, err := db.exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, passwordHash)
 	if err != nil {
-		return fmt.Errorf("failed to create users table: %v", err)
+		return fmt.Errorf("failed to save user: %v", err)
 	}
-	_, err = conn.Exec(messagesTable)
+	return nil
+}
+
+// SetUserPassword replaces the password hash of an existing user
+func (db *DB) SetUserPassword(username, passwordHash string) error {
+	res, err := db.exec("UPDATE users SET password_hash = ? WHERE username = ?", passwordHash, username)
 	if err != nil {
-		return fmt.Errorf("failed to create messages table: %v", err)
+		return fmt.Errorf("failed to set user password: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to set user password: %s does not exist", username)
 	}
 	return nil
 }
 
-// SaveUser saves a user with hashed password
-func (db *DB) SaveUser(username, passwordHash string) error {
-	_, err := db.conn.Exec("INSERT INTO users (username, password_hash) VALUES (?, ?)", username, passwordHash)
+// ListUsers returns all registered usernames in order
+func (db *DB) ListUsers() ([]string, error) {
+	rows, err := db.query("SELECT username FROM users ORDER BY username")
 	if err != nil {
-		return fmt.Errorf("failed to save user: %v", err)
+		return nil, fmt.Errorf("failed to list users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %v", err)
+		}
+		users = append(users, username)
+	}
+	return users, rows.Err()
+}
+
+// DeleteUser removes a user with its recovery codes and API tokens. Messages
+// and sessions are kept for the record.
+func (db *DB) DeleteUser(username string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"recovery_codes", "api_tokens", "users"} {
+		if _, err := tx.Exec(db.rebind("DELETE FROM "+table+" WHERE username = ?"), username); err != nil {
+			return fmt.Errorf("failed to delete user: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete user: %v", err)
 	}
 	return nil
 }
@@ -67,7 +173,7 @@ func (db *DB) SaveUser(username, passwordHash string) error {
 // GetUserPassword retrieves the hashed password for a user
 func (db *DB) GetUserPassword(username string) (string, bool, error) {
 	var passwordHash string
-	err := db.conn.QueryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&passwordHash)
+	err := db.queryRow("SELECT password_hash FROM users WHERE username = ?", username).Scan(&passwordHash)
 	if err == sql.ErrNoRows {
 		return "", false, nil
 	}
@@ -77,18 +183,119 @@ func (db *DB) GetUserPassword(username string) (string, bool, error) {
 	return passwordHash, true, nil
 }
 
-// SaveMessage saves a message to the database
-func (db *DB) SaveMessage(from, to, content, timestamp string) error {
-	_, err := db.conn.Exec("INSERT INTO messages (from_username, to_username, content, timestamp) VALUES (?, ?, ?, ?)", from, to, content, timestamp)
+// SetTOTP stores the encrypted TOTP secret and enrollment state for a user
+func (db *DB) SetTOTP(username, encryptedSecret string, enabled bool) error {
+	_, err := db.exec("UPDATE users SET totp_secret = ?, totp_enabled = ? WHERE username = ?", encryptedSecret, enabled, username)
+	if err != nil {
+		return fmt.Errorf("failed to save TOTP secret: %v", err)
+	}
+	return nil
+}
+
+// GetTOTP retrieves the encrypted TOTP secret and whether it is enabled
+func (db *DB) GetTOTP(username string) (string, bool, error) {
+	var (
+		encryptedSecret string
+		enabled         bool
+	)
+	err := db.queryRow("SELECT totp_secret, totp_enabled FROM users WHERE username = ?", username).Scan(&encryptedSecret, &enabled)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get TOTP secret: %v", err)
+	}
+	return encryptedSecret, enabled, nil
+}
+
+// SaveRecoveryCodes replaces the recovery code hashes of a user
+func (db *DB) SaveRecoveryCodes(username string, codeHashes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to save recovery codes: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(db.rebind("DELETE FROM recovery_codes WHERE username = ?"), username); err != nil {
+		return fmt.Errorf("failed to clear recovery codes: %v", err)
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(db.rebind("INSERT INTO recovery_codes (username, code_hash) VALUES (?, ?)"), username, hash); err != nil {
+			return fmt.Errorf("failed to save recovery code: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save recovery codes: %v", err)
+	}
+	return nil
+}
+
+// UseRecoveryCode deletes a matching recovery code and reports whether it existed
+func (db *DB) UseRecoveryCode(username, codeHash string) (bool, error) {
+	result, err := db.exec("DELETE FROM recovery_codes WHERE username = ? AND code_hash = ?", username, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to use recovery code: %v", err)
+	}
+	return n == 1, nil
+}
+
+// SaveMessage saves a message to the database and returns its ID
+func (db *DB) SaveMessage(msg Message) (int64, error) {
+	var id int64
+	uid, err := messageUID(msg)
+	if err != nil {
+		return 0, err
+	}
+	keyID, content, err := db.sealContent(uid, msg.Content)
+	if err != nil {
+		return 0, err
+	}
+	err = db.queryRow("INSERT INTO messages (uid, type, from_username, to_username, room, reply_to, content, key_id, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id",
+		uid, msg.Type.String(), msg.From, msg.To, msg.Room, nullID(msg.ReplyTo), content, keyID, toMillis(msg.Timestamp)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save message: %v", err)
+	}
+	return id, nil
+}
+
+// SaveMessages saves a batch of messages in a single transaction
+func (db *DB) SaveMessages(msgs []Message) error {
+	tx, err := db.conn.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to save message: %v", err)
+		return fmt.Errorf("failed to save messages: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(db.rebind("INSERT INTO messages (uid, type, from_username, to_username, room, reply_to, content, key_id, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		return fmt.Errorf("failed to save messages: %v", err)
+	}
+	defer stmt.Close()
+	for _, msg := range msgs {
+		uid, err := messageUID(msg)
+		if err != nil {
+			return err
+		}
+		keyID, content, err := db.sealContent(uid, msg.Content)
+		if err != nil {
+			return err
+		}
+		_, err = stmt.Exec(uid, msg.Type.String(), msg.From, msg.To, msg.Room, nullID(msg.ReplyTo), content, keyID, toMillis(msg.Timestamp))
+		if err != nil {
+			return fmt.Errorf("failed to save message: %v", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to save messages: %v", err)
 	}
 	return nil
 }
 
 // LoadRecentMessages loads the recent N messages from the database
 func (db *DB) LoadRecentMessages(limit int) ([]string, error) {
-	rows, err := db.conn.Query("SELECT from_username, to_username, content, timestamp FROM messages ORDER BY id DESC LIMIT ?", limit)
+	rows, err := db.query("SELECT uid, content, key_id, timestamp FROM messages ORDER BY id DESC LIMIT ?", limit)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load recent messages: %v", err)
 	}
@@ -96,18 +303,554 @@ func (db *DB) LoadRecentMessages(limit int) ([]string, error) {
 
 	var messages []string
 	for rows.Next() {
-		var from, to, content, timestamp string
-		if err := rows.Scan(&from, &to, &content, &timestamp); err != nil {
+		var (
+			uid, content, keyID string
+			millis              int64
+		)
+		if err := rows.Scan(&uid, &content, &keyID, &millis); err != nil {
 			return nil, fmt.Errorf("failed to scan message: %v", err)
 		}
-		// Format message string (e.g., "[timestamp] [from] to [to]: content")
-		formatted := fmt.Sprintf("[%s] %s", timestamp, content)
-		messages = append([]string{formatted}, messages...)  // Reverse to chronological order
+		content, err := db.openContent(uid, keyID, content)
+		if err != nil {
+			return nil, err
+		}
+		formatted := fmt.Sprintf("[%s] %s", fromMillis(millis).Format(TimeLayout), content)
+		messages = append([]string{formatted}, messages...) // Reverse to chronological order
 	}
 	return messages, nil
 }
 
+// QueryMessages calls fn for each message matching f in ID order, or in
+// reverse ID order if f.Newest is set
+func (db *DB) QueryMessages(f MessageFilter, fn func(Message) error) error {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if f.User != "" {
+		conds = append(conds, "(m.from_username = ? OR m.to_username = ?)")
+		args = append(args, f.User, f.User)
+	}
+	if f.Room != "" || f.Lobby {
+		conds = append(conds, "m.room = ?")
+		args = append(args, lobbyOr(f))
+	}
+	if !f.Since.IsZero() {
+		conds = append(conds, "m.timestamp >= ?")
+		args = append(args, toMillis(f.Since))
+	}
+	if !f.Until.IsZero() {
+		conds = append(conds, "m.timestamp < ?")
+		args = append(args, toMillis(f.Until))
+	}
+	if f.Before > 0 {
+		conds = append(conds, "m.id < ?")
+		args = append(args, f.Before)
+	}
+	if f.Public {
+		conds = append(conds, "m.type <> ?")
+		args = append(args, message.TypePrivate.String())
+	}
+	query := `SELECT m.id, m.uid, m.type, m.from_username, m.to_username, m.room, m.reply_to, r.uid, m.content, m.key_id, m.timestamp
+		FROM messages m LEFT JOIN messages r ON r.id = m.reply_to`
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	query += " ORDER BY m.id"
+	if f.Newest {
+		query += " DESC"
+	}
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.query(query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query messages: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			msg      Message
+			msgType  string
+			replyTo  sql.NullInt64
+			replyUID sql.NullString
+			keyID    string
+			millis   int64
+		)
+		if err := rows.Scan(&msg.ID, &msg.UID, &msgType, &msg.From, &msg.To, &msg.Room, &replyTo, &replyUID, &msg.Content, &keyID, &millis); err != nil {
+			return fmt.Errorf("failed to scan message: %v", err)
+		}
+		if msg.Content, err = db.openContent(msg.UID, keyID, msg.Content); err != nil {
+			return err
+		}
+		if msg.Type, err = message.ParseType(msgType); err != nil {
+			return err
+		}
+		msg.ReplyTo = replyTo.Int64
+		msg.ReplyToUID = replyUID.String
+		msg.Timestamp = fromMillis(millis)
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ImportMessages inserts messages that are not stored yet, matching them by UID.
+// ReplyToUID is resolved to the local ID of the replied message.
+func (db *DB) ImportMessages(msgs []Message) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to import messages: %v", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(db.rebind(`INSERT INTO messages (uid, type, from_username, to_username, room, reply_to, content, key_id, timestamp)
+		VALUES (?, ?, ?, ?, ?, (SELECT id FROM messages WHERE uid = ?), ?, ?, ?)
+		ON CONFLICT (uid) DO NOTHING`))
+	if err != nil {
+		return 0, fmt.Errorf("failed to import messages: %v", err)
+	}
+	defer stmt.Close()
+
+	imported := 0
+	for _, msg := range msgs {
+		if msg.UID == "" {
+			return imported, fmt.Errorf("failed to import message: missing id")
+		}
+		keyID, content, err := db.sealContent(msg.UID, msg.Content)
+		if err != nil {
+			return imported, err
+		}
+		result, err := stmt.Exec(msg.UID, msg.Type.String(), msg.From, msg.To, msg.Room, msg.ReplyToUID, content, keyID, toMillis(msg.Timestamp))
+		if err != nil {
+			return imported, fmt.Errorf("failed to import message %s: %v", msg.UID, err)
+		}
+		if n, err := result.RowsAffected(); err == nil && n > 0 {
+			imported++
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to import messages: %v", err)
+	}
+	return imported, nil
+}
+
+// PurgeMessages removes one batch of expired messages and returns how many were removed
+func (db *DB) PurgeMessages(p Purge) (int64, error) {
+	if p.Before.IsZero() && p.Keep <= 0 {
+		return 0, nil
+	}
+	class := "type <> 'private'"
+	if p.Private {
+		class = "type = 'private'"
+	}
+	var (
+		conds []string
+		args  []interface{}
+	)
+	if !p.Before.IsZero() {
+		conds = append(conds, "timestamp < ?")
+		args = append(args, toMillis(p.Before))
+	}
+	if p.Keep > 0 {
+		// Everything older than the Keep-th newest message of the same class
+		conds = append(conds, "id < (SELECT id FROM messages WHERE "+class+" ORDER BY id DESC LIMIT 1 OFFSET ?)")
+		args = append(args, p.Keep-1)
+	}
+	selectIDs := "SELECT id FROM messages WHERE " + class + " AND (" + strings.Join(conds, " OR ") + ") ORDER BY id LIMIT ?"
+	args = append(args, p.Limit)
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge messages: %v", err)
+	}
+	defer tx.Rollback()
+	if p.Archive {
+		_, err := tx.Exec(db.rebind(`INSERT INTO messages_archive (id, uid, type, from_username, to_username, room, reply_to, content, key_id, timestamp, archived_at)
+			SELECT id, uid, type, from_username, to_username, room, reply_to, content, key_id, timestamp, ? FROM messages WHERE id IN (`+selectIDs+`)`),
+			append([]interface{}{toMillis(time.Now())}, args...)...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to archive messages: %v", err)
+		}
+	}
+	result, err := tx.Exec(db.rebind("DELETE FROM messages WHERE id IN ("+selectIDs+")"), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge messages: %v", err)
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge messages: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to purge messages: %v", err)
+	}
+	return n, nil
+}
+
+// Vacuum returns space freed by deleted rows to the operating system
+func (db *DB) Vacuum() error {
+	if err := db.dialect.vacuum(db.conn); err != nil {
+		return fmt.Errorf("failed to vacuum database: %v", err)
+	}
+	return nil
+}
+
+// sqliteVacuum runs an incremental vacuum, switching the file to incremental
+// auto_vacuum with one full VACUUM the first time
+func sqliteVacuum(db *sql.DB) error {
+	// The auto_vacuum pragma only applies to the connection that runs VACUUM
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	var mode int
+	if err := conn.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return err
+	}
+	if mode != 2 {
+		if _, err := conn.ExecContext(ctx, "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, "VACUUM")
+		return err
+	}
+	_, err = conn.ExecContext(ctx, "PRAGMA incremental_vacuum")
+	return err
+}
+
+// messageUID returns the UID of msg, generating one for new messages
+func messageUID(msg Message) (string, error) {
+	if msg.UID != "" {
+		return msg.UID, nil
+	}
+	return NewUID()
+}
+
+// NewUID generates a random globally unique message ID
+func NewUID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate message ID: %v", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// nullID stores a zero ID as NULL
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// toMillis converts a time to UTC epoch milliseconds
+func toMillis(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// fromMillis converts UTC epoch milliseconds to a time
+func fromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms).UTC()
+}
+
+// StartSession records a new login and returns its ID
+func (db *DB) StartSession(username, remoteAddr string, startedAt time.Time) (int64, error) {
+	var id int64
+	err := db.queryRow("INSERT INTO sessions (username, remote_addr, started_at, ended_at) VALUES (?, ?, ?, '') RETURNING id",
+		username, remoteAddr, startedAt.UTC().Format(TimeLayout)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to start session: %v", err)
+	}
+	return id, nil
+}
+
+// EndSession marks a session as finished
+func (db *DB) EndSession(id int64, endedAt time.Time) error {
+	_, err := db.exec("UPDATE sessions SET ended_at = ? WHERE id = ?", endedAt.UTC().Format(TimeLayout), id)
+	if err != nil {
+		return fmt.Errorf("failed to end session: %v", err)
+	}
+	return nil
+}
+
+// ListSessions returns the most recent sessions of a user, newest first
+func (db *DB) ListSessions(username string, limit int) ([]Session, error) {
+	rows, err := db.query("SELECT id, username, remote_addr, started_at, ended_at FROM sessions WHERE username = ? ORDER BY id DESC LIMIT ?", username, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var (
+			session        Session
+			started, ended string
+		)
+		if err := rows.Scan(&session.ID, &session.Username, &session.RemoteAddr, &started, &ended); err != nil {
+			return nil, fmt.Errorf("failed to scan session: %v", err)
+		}
+		session.StartedAt, _ = time.Parse(TimeLayout, started)
+		if ended != "" {
+			session.EndedAt, _ = time.Parse(TimeLayout, ended)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// CreateRoom saves a new room
+func (db *DB) CreateRoom(name, createdBy string, createdAt time.Time) error {
+	_, err := db.exec("INSERT INTO rooms (name, created_by, created_at) VALUES (?, ?, ?)", name, createdBy, createdAt.UTC().Format(TimeLayout))
+	if err != nil {
+		return fmt.Errorf("failed to create room: %v", err)
+	}
+	return nil
+}
+
+// ListRooms returns all rooms ordered by name
+func (db *DB) ListRooms() ([]Room, error) {
+	rows, err := db.query("SELECT name, created_by, created_at FROM rooms ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rooms: %v", err)
+	}
+	defer rows.Close()
+
+	var rooms []Room
+	for rows.Next() {
+		var (
+			room    Room
+			created string
+		)
+		if err := rows.Scan(&room.Name, &room.CreatedBy, &created); err != nil {
+			return nil, fmt.Errorf("failed to scan room: %v", err)
+		}
+		room.CreatedAt, _ = time.Parse(TimeLayout, created)
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+// DeleteRoom removes a room
+func (db *DB) DeleteRoom(name string) error {
+	_, err := db.exec("DELETE FROM rooms WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete room: %v", err)
+	}
+	return nil
+}
+
+// CreateAPIToken saves the hash of a new API token and returns its ID
+func (db *DB) CreateAPIToken(name, username, tokenHash string, createdAt time.Time) (int64, error) {
+	var id int64
+	err := db.queryRow("INSERT INTO api_tokens (name, username, token_hash, created_at) VALUES (?, ?, ?, ?) RETURNING id",
+		name, username, tokenHash, createdAt.UTC().Format(TimeLayout)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create API token: %v", err)
+	}
+	return id, nil
+}
+
+// GetAPIToken looks up an API token by its hash
+func (db *DB) GetAPIToken(tokenHash string) (APIToken, bool, error) {
+	row := db.queryRow("SELECT id, name, username, token_hash, created_at, last_used_at FROM api_tokens WHERE token_hash = ?", tokenHash)
+	token, err := scanAPIToken(row)
+	if err == sql.ErrNoRows {
+		return APIToken{}, false, nil
+	}
+	if err != nil {
+		return APIToken{}, false, fmt.Errorf("failed to get API token: %v", err)
+	}
+	return token, true, nil
+}
+
+// TouchAPIToken records when a token was last used
+func (db *DB) TouchAPIToken(id int64, usedAt time.Time) error {
+	_, err := db.exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", usedAt.UTC().Format(TimeLayout), id)
+	if err != nil {
+		return fmt.Errorf("failed to update API token: %v", err)
+	}
+	return nil
+}
+
+// ListAPITokens returns all API tokens ordered by ID
+func (db *DB) ListAPITokens() ([]APIToken, error) {
+	rows, err := db.query("SELECT id, name, username, token_hash, created_at, last_used_at FROM api_tokens ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list API tokens: %v", err)
+	}
+	defer rows.Close()
+
+	var tokens []APIToken
+	for rows.Next() {
+		token, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan API token: %v", err)
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// DeleteAPIToken revokes an API token
+func (db *DB) DeleteAPIToken(id int64) error {
+	res, err := db.exec("DELETE FROM api_tokens WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete API token: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to delete API token: no token with ID %d", id)
+	}
+	return nil
+}
+
+// CreateWebhook registers url for event and returns its ID
+func (db *DB) CreateWebhook(event, url, secret string, createdAt time.Time) (int64, error) {
+	var id int64
+	err := db.queryRow("INSERT INTO webhooks (event, url, secret, created_at) VALUES (?, ?, ?, ?) RETURNING id",
+		event, url, secret, createdAt.UTC().Format(TimeLayout)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook: %v", err)
+	}
+	return id, nil
+}
+
+// ListWebhooks returns the webhooks of event, or all webhooks if event is empty, ordered by ID
+func (db *DB) ListWebhooks(event string) ([]Webhook, error) {
+	query := "SELECT id, event, url, secret, created_at FROM webhooks"
+	var args []interface{}
+	if event != "" {
+		query += " WHERE event = ?"
+		args = append(args, event)
+	}
+	rows, err := db.query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %v", err)
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var (
+			hook    Webhook
+			created string
+		)
+		if err := rows.Scan(&hook.ID, &hook.Event, &hook.URL, &hook.Secret, &created); err != nil {
+			return nil, fmt.Errorf("failed to scan webhook: %v", err)
+		}
+		hook.CreatedAt, _ = time.Parse(TimeLayout, created)
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+// DeleteWebhook removes a webhook. Its failed deliveries are kept.
+func (db *DB) DeleteWebhook(id int64) error {
+	res, err := db.exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to delete webhook: no webhook with ID %d", id)
+	}
+	return nil
+}
+
+// SaveWebhookFailure dead-letters a delivery and returns its ID
+func (db *DB) SaveWebhookFailure(f WebhookFailure) (int64, error) {
+	var id int64
+	err := db.queryRow(`INSERT INTO webhook_failures (webhook_id, event, url, payload, attempts, last_error, failed_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		f.WebhookID, f.Event, f.URL, f.Payload, f.Attempts, f.LastError, f.FailedAt.UTC().Format(TimeLayout)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to save webhook failure: %v", err)
+	}
+	return id, nil
+}
+
+// ListWebhookFailures returns the most recent failed deliveries, newest first
+func (db *DB) ListWebhookFailures(limit int) ([]WebhookFailure, error) {
+	rows, err := db.query(`SELECT id, webhook_id, event, url, payload, attempts, last_error, failed_at
+		FROM webhook_failures ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhook failures: %v", err)
+	}
+	defer rows.Close()
+
+	var failures []WebhookFailure
+	for rows.Next() {
+		f, err := scanWebhookFailure(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan webhook failure: %v", err)
+		}
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+// GetWebhookFailure looks up a failed delivery by ID
+func (db *DB) GetWebhookFailure(id int64) (WebhookFailure, bool, error) {
+	row := db.queryRow(`SELECT id, webhook_id, event, url, payload, attempts, last_error, failed_at
+		FROM webhook_failures WHERE id = ?`, id)
+	f, err := scanWebhookFailure(row)
+	if err == sql.ErrNoRows {
+		return WebhookFailure{}, false, nil
+	}
+	if err != nil {
+		return WebhookFailure{}, false, fmt.Errorf("failed to get webhook failure: %v", err)
+	}
+	return f, true, nil
+}
+
+// scanWebhookFailure reads a webhook_failures row
+func scanWebhookFailure(row rowScanner) (WebhookFailure, error) {
+	var (
+		f      WebhookFailure
+		failed string
+	)
+	if err := row.Scan(&f.ID, &f.WebhookID, &f.Event, &f.URL, &f.Payload, &f.Attempts, &f.LastError, &failed); err != nil {
+		return WebhookFailure{}, err
+	}
+	f.FailedAt, _ = time.Parse(TimeLayout, failed)
+	return f, nil
+}
+
+// DeleteWebhookFailure removes a dead-lettered delivery
+func (db *DB) DeleteWebhookFailure(id int64) error {
+	res, err := db.exec("DELETE FROM webhook_failures WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete webhook failure: %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("failed to delete webhook failure: no failure with ID %d", id)
+	}
+	return nil
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanAPIToken reads an api_tokens row
+func scanAPIToken(row rowScanner) (APIToken, error) {
+	var (
+		token         APIToken
+		created, used string
+	)
+	if err := row.Scan(&token.ID, &token.Name, &token.Username, &token.TokenHash, &created, &used); err != nil {
+		return APIToken{}, err
+	}
+	token.CreatedAt, _ = time.Parse(TimeLayout, created)
+	if used != "" {
+		token.LastUsedAt, _ = time.Parse(TimeLayout, used)
+	}
+	return token, nil
+}
+
 // Close closes the database connection
 func (db *DB) Close() error {
 	return db.conn.Close()
-}
\ No newline at end of file
+}
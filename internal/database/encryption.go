@@ -0,0 +1,147 @@
+package database
+
+import (
+	"fmt"
+
+	"chat/internal/secret"
+)
+
+// encryptedTables hold message content that is sealed with the keyring
+var encryptedTables = []string{"messages", "messages_archive"}
+
+// SetKeyring encrypts the content of new messages with the current key of k.
+// Existing plaintext rows stay readable until ReencryptMessages rewrites them.
+func (db *DB) SetKeyring(k *secret.Keyring) {
+	db.keys = k
+}
+
+// sealContent encrypts content bound to the message UID and returns the key ID,
+// which is empty if encryption is disabled
+func (db *DB) sealContent(uid, content string) (string, string, error) {
+	if db.keys == nil {
+		return "", content, nil
+	}
+	keyID, sealed, err := db.keys.Seal(content, []byte(uid))
+	if err != nil {
+		return "", "", fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	return keyID, sealed, nil
+}
+
+// openContent decrypts content stored with keyID, returning plaintext rows unchanged
+func (db *DB) openContent(uid, keyID, content string) (string, error) {
+	if keyID == "" {
+		return content, nil
+	}
+	if db.keys == nil {
+		return "", fmt.Errorf("message %s is encrypted but no message keys are configured", uid)
+	}
+	plaintext, err := db.keys.Open(keyID, content, []byte(uid))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt message %s: %v", uid, err)
+	}
+	return plaintext, nil
+}
+
+// ReencryptMessages rewrites up to limit messages that are not sealed with the
+// current key, including plaintext ones, and returns how many were rewritten
+func (db *DB) ReencryptMessages(limit int) (int64, error) {
+	if db.keys == nil {
+		return 0, fmt.Errorf("message encryption is not enabled")
+	}
+	var total int64
+	for _, table := range encryptedTables {
+		if total >= int64(limit) {
+			break
+		}
+		n, err := db.reencryptTable(table, limit-int(total))
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// reencryptTable rewrites one batch of rows of table in a single transaction
+func (db *DB) reencryptTable(table string, limit int) (int64, error) {
+	current := db.keys.Current()
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-encrypt messages: %v", err)
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		id                  int64
+		uid, content, keyID string
+	}
+	rows, err := tx.Query(db.rebind("SELECT id, uid, content, key_id FROM "+table+" WHERE key_id <> ? ORDER BY id LIMIT ?"), current, limit)
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-encrypt messages: %v", err)
+	}
+	var batch []row
+	for rows.Next() {
+		var r row
+		if err := rows.Scan(&r.id, &r.uid, &r.content, &r.keyID); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan message: %v", err)
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to re-encrypt messages: %v", err)
+	}
+
+	stmt, err := tx.Prepare(db.rebind("UPDATE " + table + " SET content = ?, key_id = ? WHERE id = ?"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to re-encrypt messages: %v", err)
+	}
+	defer stmt.Close()
+	for _, r := range batch {
+		plaintext, err := db.openContent(r.uid, r.keyID, r.content)
+		if err != nil {
+			return 0, err
+		}
+		keyID, sealed, err := db.sealContent(r.uid, plaintext)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := stmt.Exec(sealed, keyID, r.id); err != nil {
+			return 0, fmt.Errorf("failed to re-encrypt message %s: %v", r.uid, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to re-encrypt messages: %v", err)
+	}
+	return int64(len(batch)), nil
+}
+
+// KeyUsage counts stored and archived messages by key ID. Plaintext messages
+// are counted under the empty ID.
+func (db *DB) KeyUsage() (map[string]int64, error) {
+	usage := make(map[string]int64)
+	for _, table := range encryptedTables {
+		rows, err := db.query("SELECT key_id, COUNT(*) FROM " + table + " GROUP BY key_id")
+		if err != nil {
+			return nil, fmt.Errorf("failed to count message keys: %v", err)
+		}
+		for rows.Next() {
+			var (
+				keyID string
+				count int64
+			)
+			if err := rows.Scan(&keyID, &count); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to count message keys: %v", err)
+			}
+			usage[keyID] += count
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to count message keys: %v", err)
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,535 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"chat/internal/message"
+)
+
+// memoryUser holds the stored fields of a user
+type memoryUser struct {
+	passwordHash  string
+	totpSecret    string
+	totpEnabled   bool
+	recoveryCodes map[string]bool
+}
+
+// Memory is an in-memory Store for tests and throwaway servers
+type Memory struct {
+	mu       sync.Mutex
+	users    map[string]*memoryUser
+	messages []Message
+	archive  []Message
+	lastID   int64
+	sessions []Session
+	rooms    map[string]Room
+	tokens   []APIToken
+	tokenID  int64
+	hooks    []Webhook
+	hookID   int64
+	failures []WebhookFailure
+	failID   int64
+}
+
+// NewMemory creates an empty in-memory store
+func NewMemory() *Memory {
+	return &Memory{
+		users: make(map[string]*memoryUser),
+		rooms: make(map[string]Room),
+	}
+}
+
+// SaveUser saves a user with hashed password
+func (m *Memory) SaveUser(username, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.users[username]; exists {
+		return fmt.Errorf("failed to save user: %s already exists", username)
+	}
+	m.users[username] = &memoryUser{passwordHash: passwordHash, recoveryCodes: make(map[string]bool)}
+	return nil
+}
+
+// SetUserPassword replaces the password hash of an existing user
+func (m *Memory) SetUserPassword(username, passwordHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return fmt.Errorf("failed to set user password: %s does not exist", username)
+	}
+	user.passwordHash = passwordHash
+	return nil
+}
+
+// ListUsers returns all registered usernames in order
+func (m *Memory) ListUsers() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make([]string, 0, len(m.users))
+	for username := range m.users {
+		users = append(users, username)
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// DeleteUser removes a user with its recovery codes and API tokens
+func (m *Memory) DeleteUser(username string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.users, username)
+	kept := m.tokens[:0]
+	for _, token := range m.tokens {
+		if token.Username != username {
+			kept = append(kept, token)
+		}
+	}
+	m.tokens = kept
+	return nil
+}
+
+// GetUserPassword retrieves the hashed password for a user
+func (m *Memory) GetUserPassword(username string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return "", false, nil
+	}
+	return user.passwordHash, true, nil
+}
+
+// SetTOTP stores the encrypted TOTP secret and enrollment state for a user
+func (m *Memory) SetTOTP(username, encryptedSecret string, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if user, exists := m.users[username]; exists {
+		user.totpSecret = encryptedSecret
+		user.totpEnabled = enabled
+	}
+	return nil
+}
+
+// GetTOTP retrieves the encrypted TOTP secret and whether it is enabled
+func (m *Memory) GetTOTP(username string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return "", false, nil
+	}
+	return user.totpSecret, user.totpEnabled, nil
+}
+
+// SaveRecoveryCodes replaces the recovery code hashes of a user
+func (m *Memory) SaveRecoveryCodes(username string, codeHashes []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists {
+		return nil
+	}
+	user.recoveryCodes = make(map[string]bool, len(codeHashes))
+	for _, hash := range codeHashes {
+		user.recoveryCodes[hash] = true
+	}
+	return nil
+}
+
+// UseRecoveryCode deletes a matching recovery code and reports whether it existed
+func (m *Memory) UseRecoveryCode(username, codeHash string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, exists := m.users[username]
+	if !exists || !user.recoveryCodes[codeHash] {
+		return false, nil
+	}
+	delete(user.recoveryCodes, codeHash)
+	return true, nil
+}
+
+// SaveMessage saves a message and returns its ID
+func (m *Memory) SaveMessage(msg Message) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if msg.UID == "" {
+		uid, err := NewUID()
+		if err != nil {
+			return 0, err
+		}
+		msg.UID = uid
+	}
+	m.lastID++
+	msg.ID = m.lastID
+	msg.Timestamp = msg.Timestamp.UTC().Truncate(time.Millisecond)
+	m.messages = append(m.messages, msg)
+	return msg.ID, nil
+}
+
+// SaveMessages saves a batch of messages
+func (m *Memory) SaveMessages(msgs []Message) error {
+	for _, msg := range msgs {
+		if _, err := m.SaveMessage(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadRecentMessages loads the recent N messages in chronological order
+func (m *Memory) LoadRecentMessages(limit int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	start := len(m.messages) - limit
+	if start < 0 {
+		start = 0
+	}
+	var messages []string
+	for _, msg := range m.messages[start:] {
+		messages = append(messages, fmt.Sprintf("[%s] %s", msg.Timestamp.Format(TimeLayout), msg.Content))
+	}
+	return messages, nil
+}
+
+// QueryMessages calls fn for each message matching f in ID order, or in
+// reverse ID order if f.Newest is set
+func (m *Memory) QueryMessages(f MessageFilter, fn func(Message) error) error {
+	m.mu.Lock()
+	var matched []Message
+	for i := range m.messages {
+		msg := m.messages[i]
+		if f.Newest {
+			msg = m.messages[len(m.messages)-1-i]
+		}
+		if f.User != "" && msg.From != f.User && msg.To != f.User {
+			continue
+		}
+		if f.Before > 0 && msg.ID >= f.Before {
+			continue
+		}
+		if f.Public && msg.Type == message.TypePrivate {
+			continue
+		}
+		if (f.Room != "" || f.Lobby) && msg.Room != lobbyOr(f) {
+			continue
+		}
+		if !f.Since.IsZero() && msg.Timestamp.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && !msg.Timestamp.Before(f.Until) {
+			continue
+		}
+		if msg.ReplyTo != 0 {
+			for _, other := range m.messages {
+				if other.ID == msg.ReplyTo {
+					msg.ReplyToUID = other.UID
+				}
+			}
+		}
+		matched = append(matched, msg)
+		if f.Limit > 0 && len(matched) >= f.Limit {
+			break
+		}
+	}
+	m.mu.Unlock()
+
+	// Call fn without the lock so it may use the store
+	for _, msg := range matched {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImportMessages inserts messages that are not stored yet, matching them by UID
+func (m *Memory) ImportMessages(msgs []Message) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	known := make(map[string]int64, len(m.messages))
+	for _, msg := range m.messages {
+		known[msg.UID] = msg.ID
+	}
+	imported := 0
+	for _, msg := range msgs {
+		if msg.UID == "" {
+			return imported, fmt.Errorf("failed to import message: missing id")
+		}
+		if _, exists := known[msg.UID]; exists {
+			continue
+		}
+		m.lastID++
+		msg.ID = m.lastID
+		msg.ReplyTo = known[msg.ReplyToUID]
+		msg.ReplyToUID = ""
+		msg.Timestamp = msg.Timestamp.UTC().Truncate(time.Millisecond)
+		m.messages = append(m.messages, msg)
+		known[msg.UID] = msg.ID
+		imported++
+	}
+	return imported, nil
+}
+
+// PurgeMessages removes one batch of expired messages and returns how many were removed
+func (m *Memory) PurgeMessages(p Purge) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.Before.IsZero() && p.Keep <= 0 {
+		return 0, nil
+	}
+
+	// Count messages of the class so the oldest beyond Keep can be found
+	total := 0
+	for _, msg := range m.messages {
+		if (msg.Type == message.TypePrivate) == p.Private {
+			total++
+		}
+	}
+	var (
+		kept    []Message
+		removed int64
+		seen    int
+	)
+	for _, msg := range m.messages {
+		if (msg.Type == message.TypePrivate) != p.Private {
+			kept = append(kept, msg)
+			continue
+		}
+		seen++
+		expired := (!p.Before.IsZero() && msg.Timestamp.Before(p.Before)) || (p.Keep > 0 && total-seen >= p.Keep)
+		if expired && removed < int64(p.Limit) {
+			if p.Archive {
+				m.archive = append(m.archive, msg)
+			}
+			removed++
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	m.messages = kept
+	return removed, nil
+}
+
+// Vacuum does nothing for the in-memory store
+func (m *Memory) Vacuum() error {
+	return nil
+}
+
+// StartSession records a new login and returns its ID
+func (m *Memory) StartSession(username, remoteAddr string, startedAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id := int64(len(m.sessions) + 1)
+	m.sessions = append(m.sessions, Session{
+		ID:         id,
+		Username:   username,
+		RemoteAddr: remoteAddr,
+		StartedAt:  startedAt.UTC(),
+	})
+	return id, nil
+}
+
+// EndSession marks a session as finished
+func (m *Memory) EndSession(id int64, endedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if id > 0 && int(id) <= len(m.sessions) {
+		m.sessions[id-1].EndedAt = endedAt.UTC()
+	}
+	return nil
+}
+
+// ListSessions returns the most recent sessions of a user, newest first
+func (m *Memory) ListSessions(username string, limit int) ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var sessions []Session
+	for i := len(m.sessions) - 1; i >= 0 && len(sessions) < limit; i-- {
+		if m.sessions[i].Username == username {
+			sessions = append(sessions, m.sessions[i])
+		}
+	}
+	return sessions, nil
+}
+
+// CreateRoom saves a new room
+func (m *Memory) CreateRoom(name, createdBy string, createdAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.rooms[name]; exists {
+		return fmt.Errorf("failed to create room: %s already exists", name)
+	}
+	m.rooms[name] = Room{Name: name, CreatedBy: createdBy, CreatedAt: createdAt.UTC()}
+	return nil
+}
+
+// ListRooms returns all rooms ordered by name
+func (m *Memory) ListRooms() ([]Room, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rooms := make([]Room, 0, len(m.rooms))
+	for _, room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms, nil
+}
+
+// DeleteRoom removes a room
+func (m *Memory) DeleteRoom(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.rooms, name)
+	return nil
+}
+
+// CreateAPIToken saves the hash of a new API token and returns its ID
+func (m *Memory) CreateAPIToken(name, username, tokenHash string, createdAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.TokenHash == tokenHash {
+			return 0, fmt.Errorf("failed to create API token: duplicate token")
+		}
+	}
+	m.tokenID++
+	m.tokens = append(m.tokens, APIToken{ID: m.tokenID, Name: name, Username: username, TokenHash: tokenHash, CreatedAt: createdAt.UTC()})
+	return m.tokenID, nil
+}
+
+// GetAPIToken looks up an API token by its hash
+func (m *Memory) GetAPIToken(tokenHash string) (APIToken, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, token := range m.tokens {
+		if token.TokenHash == tokenHash {
+			return token, true, nil
+		}
+	}
+	return APIToken{}, false, nil
+}
+
+// TouchAPIToken records when a token was last used
+func (m *Memory) TouchAPIToken(id int64, usedAt time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.tokens {
+		if m.tokens[i].ID == id {
+			m.tokens[i].LastUsedAt = usedAt.UTC()
+		}
+	}
+	return nil
+}
+
+// ListAPITokens returns all API tokens ordered by ID
+func (m *Memory) ListAPITokens() ([]APIToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := make([]APIToken, len(m.tokens))
+	copy(tokens, m.tokens)
+	return tokens, nil
+}
+
+// DeleteAPIToken revokes an API token
+func (m *Memory) DeleteAPIToken(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, token := range m.tokens {
+		if token.ID == id {
+			m.tokens = append(m.tokens[:i], m.tokens[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to delete API token: no token with ID %d", id)
+}
+
+// CreateWebhook registers url for event and returns its ID
+func (m *Memory) CreateWebhook(event, url, secret string, createdAt time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hookID++
+	m.hooks = append(m.hooks, Webhook{ID: m.hookID, Event: event, URL: url, Secret: secret, CreatedAt: createdAt.UTC()})
+	return m.hookID, nil
+}
+
+// ListWebhooks returns the webhooks of event, or all webhooks if event is empty, ordered by ID
+func (m *Memory) ListWebhooks(event string) ([]Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var hooks []Webhook
+	for _, hook := range m.hooks {
+		if event == "" || hook.Event == event {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks, nil
+}
+
+// DeleteWebhook removes a webhook. Its failed deliveries are kept.
+func (m *Memory) DeleteWebhook(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, hook := range m.hooks {
+		if hook.ID == id {
+			m.hooks = append(m.hooks[:i], m.hooks[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to delete webhook: no webhook with ID %d", id)
+}
+
+// SaveWebhookFailure dead-letters a delivery and returns its ID
+func (m *Memory) SaveWebhookFailure(f WebhookFailure) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failID++
+	f.ID = m.failID
+	f.FailedAt = f.FailedAt.UTC()
+	m.failures = append(m.failures, f)
+	return f.ID, nil
+}
+
+// ListWebhookFailures returns the most recent failed deliveries, newest first
+func (m *Memory) ListWebhookFailures(limit int) ([]WebhookFailure, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var failures []WebhookFailure
+	for i := len(m.failures) - 1; i >= 0 && len(failures) < limit; i-- {
+		failures = append(failures, m.failures[i])
+	}
+	return failures, nil
+}
+
+// GetWebhookFailure looks up a failed delivery by ID
+func (m *Memory) GetWebhookFailure(id int64) (WebhookFailure, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range m.failures {
+		if f.ID == id {
+			return f, true, nil
+		}
+	}
+	return WebhookFailure{}, false, nil
+}
+
+// DeleteWebhookFailure removes a dead-lettered delivery
+func (m *Memory) DeleteWebhookFailure(id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, f := range m.failures {
+		if f.ID == id {
+			m.failures = append(m.failures[:i], m.failures[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to delete webhook failure: no failure with ID %d", id)
+}
+
+// Close releases the store
+func (m *Memory) Close() error {
+	return nil
+}
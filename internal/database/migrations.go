@@ -0,0 +1,381 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when the database was migrated by a newer build
+var ErrSchemaTooNew = errors.New("database schema is newer than this build supports")
+
+// Migration is a single ordered schema change
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(tx *sql.Tx) error
+}
+
+// sqliteMigrations lists every SQLite schema change in order. Append new entries
+// only; never edit or reorder a migration that has been released.
+var sqliteMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create users and messages tables",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS users (
+				username TEXT PRIMARY KEY,
+				password_hash TEXT NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS messages (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				from_username TEXT,
+				to_username TEXT,
+				content TEXT NOT NULL,
+				timestamp TEXT NOT NULL
+			)`,
+		),
+	},
+	{
+		Version:     2,
+		Description: "add two-factor secrets and recovery codes",
+		Up: func(tx *sql.Tx) error {
+			// Databases created before migrations existed may already have these columns
+			if err := addColumn(tx, "users", "totp_secret", "TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+			if err := addColumn(tx, "users", "totp_enabled", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS recovery_codes (
+				username TEXT NOT NULL,
+				code_hash TEXT NOT NULL,
+				PRIMARY KEY (username, code_hash)
+			)`)
+			return err
+		},
+	},
+	{
+		Version:     3,
+		Description: "create sessions and rooms tables",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				username TEXT NOT NULL,
+				remote_addr TEXT NOT NULL,
+				started_at TEXT NOT NULL,
+				ended_at TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE IF NOT EXISTS rooms (
+				name TEXT PRIMARY KEY,
+				created_by TEXT NOT NULL,
+				created_at TEXT NOT NULL
+			)`,
+		),
+	},
+	{
+		Version:     4,
+		Description: "store message timestamps as epoch milliseconds and add type, room, reply_to and indexes",
+		Up: execAll(
+			// SQLite cannot change a column type, so rebuild the table
+			`CREATE TABLE messages_v4 (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				type TEXT NOT NULL DEFAULT 'user',
+				from_username TEXT NOT NULL DEFAULT '',
+				to_username TEXT NOT NULL DEFAULT '',
+				room TEXT NOT NULL DEFAULT '',
+				reply_to INTEGER REFERENCES messages(id),
+				content TEXT NOT NULL,
+				timestamp INTEGER NOT NULL
+			)`,
+			`INSERT INTO messages_v4 (id, type, from_username, to_username, content, timestamp)
+			SELECT id,
+				CASE
+					WHEN COALESCE(from_username, '') = '' THEN 'system'
+					WHEN COALESCE(to_username, '') <> '' THEN 'private'
+					ELSE 'user'
+				END,
+				COALESCE(from_username, ''),
+				COALESCE(to_username, ''),
+				content,
+				COALESCE(CAST(strftime('%s', timestamp) AS INTEGER), 0) * 1000
+			FROM messages`,
+			`DROP TABLE messages`,
+			`ALTER TABLE messages_v4 RENAME TO messages`,
+			`CREATE INDEX idx_messages_to_id ON messages (to_username, id)`,
+			`CREATE INDEX idx_messages_from_id ON messages (from_username, id)`,
+			`CREATE INDEX idx_messages_timestamp ON messages (timestamp)`,
+		),
+	},
+	{
+		Version:     5,
+		Description: "create messages_archive table for retention",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS messages_archive (
+				id INTEGER PRIMARY KEY,
+				type TEXT NOT NULL,
+				from_username TEXT NOT NULL,
+				to_username TEXT NOT NULL,
+				room TEXT NOT NULL,
+				reply_to INTEGER,
+				content TEXT NOT NULL,
+				timestamp INTEGER NOT NULL,
+				archived_at INTEGER NOT NULL
+			)`,
+		),
+	},
+	{
+		Version:     6,
+		Description: "add globally unique message IDs for export and import",
+		Up: execAll(
+			`ALTER TABLE messages ADD COLUMN uid TEXT`,
+			`UPDATE messages SET uid = lower(hex(randomblob(16))) WHERE uid IS NULL`,
+			`CREATE UNIQUE INDEX idx_messages_uid ON messages (uid)`,
+			`ALTER TABLE messages_archive ADD COLUMN uid TEXT`,
+			`UPDATE messages_archive SET uid = lower(hex(randomblob(16))) WHERE uid IS NULL`,
+		),
+	},
+	{
+		Version:     7,
+		Description: "record the key ID of encrypted message content",
+		Up: execAll(
+			`ALTER TABLE messages ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages_archive ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		Version:     8,
+		Description: "create api_tokens table",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS api_tokens (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				username TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_at TEXT NOT NULL,
+				last_used_at TEXT NOT NULL DEFAULT ''
+			)`,
+		),
+	},
+	{
+		Version:     9,
+		Description: "create webhooks and webhook_failures tables",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS webhooks (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				event TEXT NOT NULL,
+				url TEXT NOT NULL,
+				secret TEXT NOT NULL,
+				created_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX idx_webhooks_event ON webhooks (event)`,
+			`CREATE TABLE IF NOT EXISTS webhook_failures (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				webhook_id INTEGER NOT NULL,
+				event TEXT NOT NULL,
+				url TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				attempts INTEGER NOT NULL,
+				last_error TEXT NOT NULL,
+				failed_at TEXT NOT NULL
+			)`,
+		),
+	},
+}
+
+// MigrationStatus describes the schema state of a database
+type MigrationStatus struct {
+	Current int
+	Latest  int
+	Pending []Migration
+}
+
+// latestVersion returns the schema version this build expects
+func (db *DB) latestVersion() int {
+	return db.dialect.migrations[len(db.dialect.migrations)-1].Version
+}
+
+// Status reports the current schema version and pending migrations. It
+// only reads, so a database without a schema_version table is at version 0.
+func (db *DB) Status() (MigrationStatus, error) {
+	var tables int
+	if err := db.queryRow(db.dialect.tableExists, "schema_version").Scan(&tables); err != nil {
+		return MigrationStatus{}, fmt.Errorf("failed to look up schema_version table: %v", err)
+	}
+	current := 0
+	if tables > 0 {
+		var err error
+		if current, err = schemaVersion(db.conn); err != nil {
+			return MigrationStatus{}, err
+		}
+	}
+	status := MigrationStatus{Current: current, Latest: db.latestVersion()}
+	if current > status.Latest {
+		return status, fmt.Errorf("%w: database is at version %d, this build supports up to %d", ErrSchemaTooNew, current, status.Latest)
+	}
+	status.Pending = db.pendingMigrations(current)
+	return status, nil
+}
+
+// Migrate applies pending migrations, each in its own transaction
+func (db *DB) Migrate() ([]Migration, error) {
+	if err := ensureVersionTable(db.conn); err != nil {
+		return nil, err
+	}
+	status, err := db.Status()
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, m := range status.Pending {
+		tx, err := db.conn.Begin()
+		if err != nil {
+			return applied, fmt.Errorf("failed to begin migration %d: %v", m.Version, err)
+		}
+		if err := db.applyMigration(tx, m); err != nil {
+			tx.Rollback()
+			return applied, err
+		}
+		if err := tx.Commit(); err != nil {
+			return applied, fmt.Errorf("failed to commit migration %d: %v", m.Version, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// DryRun applies pending migrations in a single transaction and rolls it
+// back, leaving the database as it was
+func (db *DB) DryRun() ([]Migration, error) {
+	status, err := db.Status()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin dry run: %v", err)
+	}
+	defer tx.Rollback()
+	if err := ensureVersionTable(tx); err != nil {
+		return nil, err
+	}
+	var checked []Migration
+	for _, m := range status.Pending {
+		if err := db.applyMigration(tx, m); err != nil {
+			return checked, err
+		}
+		checked = append(checked, m)
+	}
+	return checked, nil
+}
+
+// applyMigration runs a migration and records it in schema_version
+func (db *DB) applyMigration(tx *sql.Tx, m Migration) error {
+	// Re-check inside the transaction in case another process got here first
+	current, err := schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if current >= m.Version {
+		return fmt.Errorf("migration %d already applied (schema version %d)", m.Version, current)
+	}
+	if err := m.Up(tx); err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+	}
+	_, err = tx.Exec(db.rebind("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)"),
+		m.Version, m.Description, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d: %v", m.Version, err)
+	}
+	return nil
+}
+
+// pendingMigrations returns migrations newer than version
+func (db *DB) pendingMigrations(version int) []Migration {
+	var pending []Migration
+	for _, m := range db.dialect.migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// ensureVersionTable creates the schema_version table if needed
+func ensureVersionTable(q querier) error {
+	_, err := q.Exec(`
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_version table: %v", err)
+	}
+	return nil
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// schemaVersion returns the highest applied migration version
+func schemaVersion(q querier) (int, error) {
+	var version sql.NullInt64
+	if err := q.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed to read schema version: %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+// execAll returns a migration step that executes statements in order
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumn adds a column to a table if it does not exist yet
+func addColumn(q querier, table, column, definition string) error {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to inspect %s table: %v", table, err)
+	}
+	exists := false
+	for rows.Next() {
+		var (
+			cid, notNull, pk int
+			name, colType    string
+			defaultValue     sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan %s columns: %v", table, err)
+		}
+		if name == column {
+			exists = true
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect %s table: %v", table, err)
+	}
+	if exists {
+		return nil
+	}
+
+	_, err = q.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add %s.%s column: %v", table, column, err)
+	}
+	return nil
+}
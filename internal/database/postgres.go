@@ -0,0 +1,176 @@
+package database
+
+import (
+	"database/sql"
+
+	_ "github.com/lib/pq"
+)
+
+// postgres is the backend for deployments without a local SQLite file
+var postgres = dialect{
+	name:        "PostgreSQL",
+	driver:      "postgres",
+	migrations:  postgresMigrations,
+	numbered:    true,
+	vacuum:      postgresVacuum,
+	tableExists: "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?",
+}
+
+// postgresVacuum reclaims dead message rows without locking out writers
+func postgresVacuum(conn *sql.DB) error {
+	_, err := conn.Exec("VACUUM messages")
+	return err
+}
+
+// postgresMigrations lists every PostgreSQL schema change in order. Versions
+// mirror sqliteMigrations so both backends report the same schema version.
+var postgresMigrations = []Migration{
+	{
+		Version:     1,
+		Description: "create users and messages tables",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS users (
+				username TEXT PRIMARY KEY,
+				password_hash TEXT NOT NULL
+			)`,
+			`CREATE TABLE IF NOT EXISTS messages (
+				id BIGSERIAL PRIMARY KEY,
+				from_username TEXT,
+				to_username TEXT,
+				content TEXT NOT NULL,
+				timestamp TEXT NOT NULL
+			)`,
+		),
+	},
+	{
+		Version:     2,
+		Description: "add two-factor secrets and recovery codes",
+		Up: execAll(
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+			`CREATE TABLE IF NOT EXISTS recovery_codes (
+				username TEXT NOT NULL,
+				code_hash TEXT NOT NULL,
+				PRIMARY KEY (username, code_hash)
+			)`,
+		),
+	},
+	{
+		Version:     3,
+		Description: "create sessions and rooms tables",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id BIGSERIAL PRIMARY KEY,
+				username TEXT NOT NULL,
+				remote_addr TEXT NOT NULL,
+				started_at TEXT NOT NULL,
+				ended_at TEXT NOT NULL DEFAULT ''
+			)`,
+			`CREATE TABLE IF NOT EXISTS rooms (
+				name TEXT PRIMARY KEY,
+				created_by TEXT NOT NULL,
+				created_at TEXT NOT NULL
+			)`,
+		),
+	},
+	{
+		Version:     4,
+		Description: "store message timestamps as epoch milliseconds and add type, room, reply_to and indexes",
+		Up: execAll(
+			`ALTER TABLE messages ADD COLUMN type TEXT NOT NULL DEFAULT 'user'`,
+			`ALTER TABLE messages ADD COLUMN room TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages ADD COLUMN reply_to BIGINT REFERENCES messages(id)`,
+			`UPDATE messages SET
+				from_username = COALESCE(from_username, ''),
+				to_username = COALESCE(to_username, ''),
+				type = CASE
+					WHEN COALESCE(from_username, '') = '' THEN 'system'
+					WHEN COALESCE(to_username, '') <> '' THEN 'private'
+					ELSE 'user'
+				END`,
+			`ALTER TABLE messages ALTER COLUMN from_username SET DEFAULT ''`,
+			`ALTER TABLE messages ALTER COLUMN from_username SET NOT NULL`,
+			`ALTER TABLE messages ALTER COLUMN to_username SET DEFAULT ''`,
+			`ALTER TABLE messages ALTER COLUMN to_username SET NOT NULL`,
+			`ALTER TABLE messages ALTER COLUMN timestamp TYPE BIGINT
+				USING (EXTRACT(EPOCH FROM (timestamp::timestamp AT TIME ZONE 'UTC')) * 1000)::BIGINT`,
+			`CREATE INDEX idx_messages_to_id ON messages (to_username, id)`,
+			`CREATE INDEX idx_messages_from_id ON messages (from_username, id)`,
+			`CREATE INDEX idx_messages_timestamp ON messages (timestamp)`,
+		),
+	},
+	{
+		Version:     5,
+		Description: "create messages_archive table for retention",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS messages_archive (
+				id BIGINT PRIMARY KEY,
+				type TEXT NOT NULL,
+				from_username TEXT NOT NULL,
+				to_username TEXT NOT NULL,
+				room TEXT NOT NULL,
+				reply_to BIGINT,
+				content TEXT NOT NULL,
+				timestamp BIGINT NOT NULL,
+				archived_at BIGINT NOT NULL
+			)`,
+		),
+	},
+	{
+		Version:     6,
+		Description: "add globally unique message IDs for export and import",
+		Up: execAll(
+			`ALTER TABLE messages ADD COLUMN uid TEXT`,
+			`UPDATE messages SET uid = md5(random()::text || id::text) WHERE uid IS NULL`,
+			`CREATE UNIQUE INDEX idx_messages_uid ON messages (uid)`,
+			`ALTER TABLE messages_archive ADD COLUMN uid TEXT`,
+			`UPDATE messages_archive SET uid = md5(random()::text || id::text) WHERE uid IS NULL`,
+		),
+	},
+	{
+		Version:     7,
+		Description: "record the key ID of encrypted message content",
+		Up: execAll(
+			`ALTER TABLE messages ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE messages_archive ADD COLUMN key_id TEXT NOT NULL DEFAULT ''`,
+		),
+	},
+	{
+		Version:     8,
+		Description: "create api_tokens table",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS api_tokens (
+				id BIGSERIAL PRIMARY KEY,
+				name TEXT NOT NULL,
+				username TEXT NOT NULL,
+				token_hash TEXT NOT NULL UNIQUE,
+				created_at TEXT NOT NULL,
+				last_used_at TEXT NOT NULL DEFAULT ''
+			)`,
+		),
+	},
+	{
+		Version:     9,
+		Description: "create webhooks and webhook_failures tables",
+		Up: execAll(
+			`CREATE TABLE IF NOT EXISTS webhooks (
+				id BIGSERIAL PRIMARY KEY,
+				event TEXT NOT NULL,
+				url TEXT NOT NULL,
+				secret TEXT NOT NULL,
+				created_at TEXT NOT NULL
+			)`,
+			`CREATE INDEX idx_webhooks_event ON webhooks (event)`,
+			`CREATE TABLE IF NOT EXISTS webhook_failures (
+				id BIGSERIAL PRIMARY KEY,
+				webhook_id BIGINT NOT NULL,
+				event TEXT NOT NULL,
+				url TEXT NOT NULL,
+				payload TEXT NOT NULL,
+				attempts INTEGER NOT NULL,
+				last_error TEXT NOT NULL,
+				failed_at TEXT NOT NULL
+			)`,
+		),
+	},
+}
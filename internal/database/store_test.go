@@ -0,0 +1,222 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chat/internal/message"
+)
+
+// stores opens each backend that runs without external services
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+	dsns := map[string]string{
+		"memory": "memory://",
+		"sqlite": "sqlite://" + filepath.Join(t.TempDir(), "chat.db"),
+	}
+	opened := make(map[string]Store, len(dsns))
+	for name, dsn := range dsns {
+		store, err := New(dsn, Options{MaxOpenConns: 1, MaxIdleConns: 1})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		t.Cleanup(func() { store.Close() })
+		opened[name] = store
+	}
+	return opened
+}
+
+func TestStoreUsers(t *testing.T) {
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			if _, exists, err := store.GetUserPassword("alice"); err != nil || exists {
+				t.Fatalf("GetUserPassword of unknown user = %v, %v", exists, err)
+			}
+			if err := store.SaveUser("alice", "hash1"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SaveUser("alice", "hash2"); err == nil {
+				t.Error("SaveUser accepted a duplicate user")
+			}
+			if err := store.SaveUser("bob", "hash"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.SetUserPassword("alice", "hash3"); err != nil {
+				t.Fatal(err)
+			}
+			if hash, exists, err := store.GetUserPassword("alice"); err != nil || !exists || hash != "hash3" {
+				t.Errorf("GetUserPassword = %q, %v, %v, want hash3", hash, exists, err)
+			}
+
+			if err := store.SetTOTP("alice", "sealed", true); err != nil {
+				t.Fatal(err)
+			}
+			if secret, enabled, err := store.GetTOTP("alice"); err != nil || secret != "sealed" || !enabled {
+				t.Errorf("GetTOTP = %q, %v, %v", secret, enabled, err)
+			}
+			if err := store.SaveRecoveryCodes("alice", []string{"c1", "c2"}); err != nil {
+				t.Fatal(err)
+			}
+			if used, err := store.UseRecoveryCode("alice", "c1"); err != nil || !used {
+				t.Errorf("first UseRecoveryCode = %v, %v", used, err)
+			}
+			if used, err := store.UseRecoveryCode("alice", "c1"); err != nil || used {
+				t.Errorf("second UseRecoveryCode = %v, %v, want a code to work once", used, err)
+			}
+
+			if err := store.DeleteUser("bob"); err != nil {
+				t.Fatal(err)
+			}
+			users, err := store.ListUsers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(users) != 1 || users[0] != "alice" {
+				t.Errorf("ListUsers = %v, want [alice]", users)
+			}
+		})
+	}
+}
+
+func TestStoreMessages(t *testing.T) {
+	base := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, err := store.SaveMessage(Message{Type: message.TypeUser, From: "alice", Content: "[alice] hi", Timestamp: base})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.SaveMessages([]Message{
+				{Type: message.TypeUser, From: "bob", Room: "ops", ReplyTo: first, Content: "[#ops] [bob] on it", Timestamp: base.Add(time.Second)},
+				{Type: message.TypePrivate, From: "bob", To: "alice", Content: "[PRIVATE from bob] psst", Timestamp: base.Add(2 * time.Second)},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			recent, err := store.LoadRecentMessages(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"[2024-05-01 12:00:01] [#ops] [bob] on it", "[2024-05-01 12:00:02] [PRIVATE from bob] psst"}
+			if len(recent) != 2 || recent[0] != want[0] || recent[1] != want[1] {
+				t.Errorf("LoadRecentMessages = %q, want %q", recent, want)
+			}
+
+			var all []Message
+			if err := store.QueryMessages(MessageFilter{}, func(m Message) error {
+				all = append(all, m)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 3 {
+				t.Fatalf("QueryMessages returned %d messages, want 3", len(all))
+			}
+			if all[0].UID == "" || all[0].UID == all[1].UID {
+				t.Errorf("messages got UIDs %q and %q, want unique ones", all[0].UID, all[1].UID)
+			}
+			reply := all[1]
+			if reply.Room != "ops" || reply.ReplyTo != first || reply.ReplyToUID != all[0].UID {
+				t.Errorf("reply = room %q, reply to %d (%q), want ops, %d (%q)", reply.Room, reply.ReplyTo, reply.ReplyToUID, first, all[0].UID)
+			}
+			if !all[2].Timestamp.Equal(base.Add(2*time.Second)) || all[2].Type != message.TypePrivate || all[2].To != "alice" {
+				t.Errorf("private message = %+v", all[2])
+			}
+
+			tests := []struct {
+				name   string
+				filter MessageFilter
+				want   int
+			}{
+				{"room", MessageFilter{Room: "ops"}, 1},
+				{"lobby", MessageFilter{Lobby: true, Room: "ops"}, 2},
+				{"user", MessageFilter{User: "alice"}, 2},
+				{"public", MessageFilter{Public: true}, 2},
+				{"since", MessageFilter{Since: base.Add(time.Second)}, 2},
+				{"until", MessageFilter{Until: base.Add(time.Second)}, 1},
+				{"before", MessageFilter{Before: all[2].ID, Limit: 1, Newest: true}, 1},
+			}
+			for _, tt := range tests {
+				n := 0
+				if err := store.QueryMessages(tt.filter, func(Message) error { n++; return nil }); err != nil {
+					t.Fatal(err)
+				}
+				if n != tt.want {
+					t.Errorf("%s filter matched %d messages, want %d", tt.name, n, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			first, err := store.StartSession("alice", "127.0.0.1:5000", start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.StartSession("alice", "127.0.0.1:5001", start.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := store.StartSession("bob", "127.0.0.1:5002", start); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.EndSession(first, start.Add(30*time.Second)); err != nil {
+				t.Fatal(err)
+			}
+
+			sessions, err := store.ListSessions("alice", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 2 {
+				t.Fatalf("ListSessions returned %d sessions, want 2", len(sessions))
+			}
+			if sessions[0].RemoteAddr != "127.0.0.1:5001" || !sessions[0].EndedAt.IsZero() {
+				t.Errorf("newest session = %+v, want the open one first", sessions[0])
+			}
+			if sessions[1].ID != first || !sessions[1].StartedAt.Equal(start) || !sessions[1].EndedAt.Equal(start.Add(30*time.Second)) {
+				t.Errorf("oldest session = %+v", sessions[1])
+			}
+			if sessions, _ := store.ListSessions("alice", 1); len(sessions) != 1 {
+				t.Errorf("ListSessions ignored its limit, returned %d sessions", len(sessions))
+			}
+		})
+	}
+}
+
+func TestStoreRooms(t *testing.T) {
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for name, store := range stores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, room := range []string{"ops", "dev"} {
+				if err := store.CreateRoom(room, "alice", created); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := store.CreateRoom("ops", "bob", created); err == nil {
+				t.Error("CreateRoom accepted a duplicate room")
+			}
+			rooms, err := store.ListRooms()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(rooms) != 2 || rooms[0].Name != "dev" || rooms[1].Name != "ops" {
+				t.Fatalf("ListRooms = %+v, want dev and ops", rooms)
+			}
+			if rooms[1].CreatedBy != "alice" || !rooms[1].CreatedAt.Equal(created) {
+				t.Errorf("room = %+v", rooms[1])
+			}
+			if err := store.DeleteRoom("dev"); err != nil {
+				t.Fatal(err)
+			}
+			if rooms, _ := store.ListRooms(); len(rooms) != 1 || rooms[0].Name != "ops" {
+				t.Errorf("ListRooms after DeleteRoom = %+v, want ops", rooms)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"chat/internal/database"
+	"chat/internal/message"
+)
+
+// Supported export formats
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+	FormatMbox  = "mbox"
+)
+
+// CheckFormat returns an error unless format is a supported export format
+func CheckFormat(format string) error {
+	switch format {
+	case FormatJSONL, FormatCSV, FormatMbox:
+		return nil
+	}
+	return fmt.Errorf("unknown export format %q (available: jsonl, csv, mbox)", format)
+}
+
+// importBatchSize is the number of messages imported per transaction
+const importBatchSize = 500
+
+// record is the JSONL representation of a message
+type record struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	From      string    `json:"from,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Room      string    `json:"room,omitempty"`
+	ReplyTo   string    `json:"reply_to,omitempty"`
+	Content   string    `json:"content"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Export writes messages matching f to w and returns how many were written
+func Export(store database.Store, w io.Writer, format string, f database.MessageFilter) (int, error) {
+	bw := bufio.NewWriter(w)
+	var (
+		write func(database.Message) error
+		cw    *csv.Writer
+	)
+	switch format {
+	case FormatJSONL:
+		enc := json.NewEncoder(bw)
+		write = func(msg database.Message) error {
+			return enc.Encode(toRecord(msg))
+		}
+	case FormatCSV:
+		cw = csv.NewWriter(bw)
+		if err := cw.Write([]string{"id", "type", "from", "to", "room", "reply_to", "timestamp", "content"}); err != nil {
+			return 0, err
+		}
+		write = func(msg database.Message) error {
+			return cw.Write([]string{msg.UID, msg.Type.String(), msg.From, msg.To, msg.Room, msg.ReplyToUID,
+				msg.Timestamp.Format(time.RFC3339Nano), msg.Content})
+		}
+	case FormatMbox:
+		write = func(msg database.Message) error {
+			return writeMbox(bw, msg)
+		}
+	default:
+		return 0, CheckFormat(format)
+	}
+
+	count := 0
+	err := store.QueryMessages(f, func(msg database.Message) error {
+		count++
+		return write(msg)
+	})
+	if err != nil {
+		return count, err
+	}
+	if cw != nil {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return count, err
+		}
+	}
+	return count, bw.Flush()
+}
+
+// writeMbox writes a message as an mbox entry
+func writeMbox(w io.Writer, msg database.Message) error {
+	from := msg.From
+	if from == "" {
+		from = "system"
+	}
+	fmt.Fprintf(w, "From %s %s\n", from, msg.Timestamp.Format(time.ANSIC))
+	fmt.Fprintf(w, "From: %s\n", from)
+	if msg.To != "" {
+		fmt.Fprintf(w, "To: %s\n", msg.To)
+	}
+	fmt.Fprintf(w, "Date: %s\n", msg.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Message-ID: <%s@chat>\n", msg.UID)
+	if msg.ReplyToUID != "" {
+		fmt.Fprintf(w, "In-Reply-To: <%s@chat>\n", msg.ReplyToUID)
+	}
+	fmt.Fprintf(w, "X-Chat-Type: %s\n", msg.Type)
+	if msg.Room != "" {
+		fmt.Fprintf(w, "X-Chat-Room: %s\n", msg.Room)
+	}
+	fmt.Fprintln(w)
+	for _, line := range strings.Split(msg.Content, "\n") {
+		// Escape body lines that would start a new message (mboxrd)
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = ">" + line
+		}
+		fmt.Fprintln(w, line)
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// Import reads JSONL messages from r and stores those not seen before.
+// It returns the number of records read and the number imported.
+func Import(store database.Store, r io.Reader) (int, int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var (
+		batch          []database.Message
+		read, imported int
+	)
+	flush := func() error {
+		n, err := store.ImportMessages(batch)
+		imported += n
+		batch = batch[:0]
+		return err
+	}
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		read++
+		var rec record
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			return read, imported, fmt.Errorf("line %d: %v", read, err)
+		}
+		msg, err := fromRecord(rec)
+		if err != nil {
+			return read, imported, fmt.Errorf("line %d: %v", read, err)
+		}
+		batch = append(batch, msg)
+		if len(batch) >= importBatchSize {
+			if err := flush(); err != nil {
+				return read, imported, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return read, imported, err
+	}
+	if len(batch) > 0 {
+		if err := flush(); err != nil {
+			return read, imported, err
+		}
+	}
+	return read, imported, nil
+}
+
+// ParseTime parses a filter time as RFC 3339, "2006-01-02 15:04:05" or "2006-01-02" in UTC
+func ParseTime(s string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, database.TimeLayout, "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, use RFC 3339 or 2006-01-02", s)
+}
+
+// toRecord converts a stored message to its JSONL form
+func toRecord(msg database.Message) record {
+	return record{
+		ID:        msg.UID,
+		Type:      msg.Type.String(),
+		From:      msg.From,
+		To:        msg.To,
+		Room:      msg.Room,
+		ReplyTo:   msg.ReplyToUID,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+	}
+}
+
+// fromRecord converts a JSONL record to a message for import
+func fromRecord(rec record) (database.Message, error) {
+	if rec.ID == "" {
+		return database.Message{}, fmt.Errorf("missing id")
+	}
+	msgType, err := message.ParseType(rec.Type)
+	if err != nil {
+		return database.Message{}, err
+	}
+	return database.Message{
+		UID:        rec.ID,
+		Type:       msgType,
+		From:       rec.From,
+		To:         rec.To,
+		Room:       rec.Room,
+		ReplyToUID: rec.ReplyTo,
+		Content:    rec.Content,
+		Timestamp:  rec.Timestamp,
+	}, nil
+}
@@ -0,0 +1,448 @@
+package federation
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/message"
+	"chat/internal/presence"
+	"chat/pkg/logger"
+)
+
+// maxBackoff limits the delay between attempts to reach a peer
+const maxBackoff = time.Minute
+
+// Chat is the part of the chat server federation relays to and from
+type Chat interface {
+	Post(from, to, text string)
+	GetUsers() []string
+	GetStatuses() map[string]string
+	Presence() *presence.Bus
+}
+
+// origin is what is known about the users of another server
+type origin struct {
+	users   map[string]string // Status by user, empty if available
+	seq     int64
+	via     *link // Link the presence arrived on
+	expires time.Time
+}
+
+// Federation links the server to peer servers over authenticated TLS
+// connections. Messages of the default room and private messages to
+// user@server go to the peers directly. Frames are not passed on, since a
+// server could not tell whether a peer relays a frame or forges it, so
+// every pair of servers that talk to each other needs a link.
+type Federation struct {
+	cfg     config.Config
+	logger  *logger.Logger
+	chat    Chat
+	tlsConf *tls.Config
+	ln      net.Listener
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex
+	links  map[string]*link   // Links by peer name
+	remote map[string]*origin // Presence of other servers by name
+}
+
+// New creates a federation of chat with the peers in cfg. tlsConf is used
+// for the connections peers make to FEDERATION_PORT.
+func New(cfg config.Config, logger *logger.Logger, chat Chat, tlsConf *tls.Config) *Federation {
+	return &Federation{
+		cfg:     cfg,
+		logger:  logger,
+		chat:    chat,
+		tlsConf: tlsConf,
+		done:    make(chan struct{}),
+		links:   make(map[string]*link),
+		remote:  make(map[string]*origin),
+	}
+}
+
+// Start listens for peers on FEDERATION_PORT and dials FEDERATION_PEERS
+func (f *Federation) Start() error {
+	if f.cfg.FederationPort != "" {
+		ln, err := tls.Listen("tcp", f.cfg.FederationPort, f.tlsConf)
+		if err != nil {
+			return err
+		}
+		f.ln = ln
+		f.wg.Add(1)
+		go f.accept()
+	}
+	for _, peer := range f.cfg.FederationPeers {
+		name, addr, _ := strings.Cut(peer, "=")
+		f.wg.Add(1)
+		go f.dial(name, addr)
+	}
+	f.wg.Add(1)
+	go f.watchPresence()
+	f.logger.Info("Federation started as %s", f.cfg.FederationName)
+	return nil
+}
+
+// Shutdown closes the links to all peers
+func (f *Federation) Shutdown() {
+	close(f.done)
+	if f.ln != nil {
+		f.ln.Close()
+	}
+	f.mu.Lock()
+	for _, l := range f.links {
+		l.close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+// IsRemote reports whether username is a user@server address of another server
+func IsRemote(username string) bool {
+	return strings.Contains(username, "@")
+}
+
+// Owns reports whether username is a user of another server
+func (f *Federation) Owns(username string) bool {
+	return IsRemote(username)
+}
+
+// Relay passes a chat message on to the peers: messages of the default
+// room, and private messages to user@server. Messages from remote users
+// came from the federation and are not sent back. Rooms other than the
+// default one stay on their server.
+func (f *Federation) Relay(msg message.Message) {
+	if msg.From == "" || IsRemote(msg.From) {
+		return
+	}
+	fr := frame{Origin: f.cfg.FederationName, From: msg.From, Text: msg.Text(), Time: time.Now().UTC()}
+	switch {
+	case msg.Type == message.TypeUser && msg.Room == "":
+		fr.Type = frameMessage
+	case msg.Type == message.TypePrivate && IsRemote(msg.Target):
+		fr.Type = framePM
+		fr.To = msg.Target
+	default:
+		return
+	}
+	f.broadcast(fr)
+}
+
+// Users returns the users of other servers as user@server
+func (f *Federation) Users() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var users []string
+	for server, o := range f.remote {
+		for user := range o.users {
+			users = append(users, user+"@"+server)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Statuses returns the statuses set by users of other servers
+func (f *Federation) Statuses() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := make(map[string]string)
+	for server, o := range f.remote {
+		for user, status := range o.users {
+			if status != "" {
+				statuses[user+"@"+server] = status
+			}
+		}
+	}
+	return statuses
+}
+
+// accept serves peers connecting to FEDERATION_PORT
+func (f *Federation) accept() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			select {
+			case <-f.done:
+				return
+			default:
+			}
+			f.logger.Error("Failed to accept federation connection: %v", err)
+			continue
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			l, err := f.handshake(conn.(*tls.Conn), "", false)
+			if err != nil {
+				f.logger.Error("Rejected federation connection from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			f.run(l)
+		}()
+	}
+}
+
+// dial keeps a link to the peer at addr, reconnecting with backoff
+func (f *Federation) dial(name, addr string) {
+	defer f.wg.Done()
+	backoff := time.Second
+	for {
+		// The peer may have linked to us already
+		if !f.linked(name) {
+			l, err := f.dialPeer(name, addr)
+			if err != nil {
+				f.logger.Error("Failed to link to server %s at %s: %v", name, addr, err)
+			} else {
+				backoff = time.Second
+				f.run(l)
+			}
+		}
+		// Jitter keeps two servers dialing each other from retrying in step
+		jitter, _ := rand.Int(rand.Reader, big.NewInt(int64(backoff/2)))
+		select {
+		case <-time.After(backoff + time.Duration(jitter.Int64())):
+		case <-f.done:
+			return
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// linked reports whether there is a link to the peer named name
+func (f *Federation) linked(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, exists := f.links[name]
+	return exists
+}
+
+// run registers l and reads its frames until the link closes
+func (f *Federation) run(l *link) {
+	snapshot := f.snapshot()
+	f.mu.Lock()
+	select {
+	case <-f.done:
+		f.mu.Unlock()
+		l.close()
+		return
+	default:
+	}
+	if _, exists := f.links[l.peer]; exists {
+		f.mu.Unlock()
+		f.logger.Info("Already linked to server %s, closing the new link", l.peer)
+		l.close()
+		return
+	}
+	f.links[l.peer] = l
+	// A new peer learns who is online here
+	l.send(snapshot)
+	f.mu.Unlock()
+	f.logger.Info("Linked to server %s (%s)", l.peer, l.conn.RemoteAddr())
+
+	go f.write(l)
+	var err error
+	for {
+		var fr frame
+		fr, err = readFrame(l.conn, l.scanner, f.cfg.TCPTimeout)
+		if err != nil {
+			break
+		}
+		f.receive(l, fr)
+	}
+	l.close()
+	if !errors.Is(err, net.ErrClosed) {
+		f.logger.Info("Link to server %s closed: %v", l.peer, err)
+	}
+
+	f.mu.Lock()
+	delete(f.links, l.peer)
+	var lost []string
+	for server, o := range f.remote {
+		if o.via == l {
+			lost = append(lost, server)
+		}
+	}
+	f.mu.Unlock()
+	for _, server := range lost {
+		f.dropOrigin(server, l)
+	}
+}
+
+// receive handles a frame from the peer on l. The secret is shared by all
+// servers, so a peer is only trusted to speak for itself.
+func (f *Federation) receive(l *link, fr frame) {
+	switch fr.Type {
+	case framePing:
+		return
+	case frameMessage, framePM, framePresence:
+	default:
+		f.logger.Error("Ignored %q frame from server %s", fr.Type, l.peer)
+		return
+	}
+	if fr.Origin != l.peer {
+		f.logger.Error("Ignored %s frame of server %s from server %s", fr.Type, fr.Origin, l.peer)
+		return
+	}
+
+	switch fr.Type {
+	case frameMessage:
+		if validUser(fr.From) && strings.TrimSpace(fr.Text) != "" {
+			f.chat.Post(fr.From+"@"+fr.Origin, "", fr.Text)
+		}
+	case framePM:
+		user, server, _ := strings.Cut(fr.To, "@")
+		if server == f.cfg.FederationName && validUser(fr.From) && validUser(user) && strings.TrimSpace(fr.Text) != "" {
+			f.chat.Post(fr.From+"@"+fr.Origin, user, fr.Text)
+		}
+	case framePresence:
+		f.applyPresence(l, fr)
+	}
+}
+
+// applyPresence replaces the known users of fr.Origin unless fr is older
+// than what is known, publishing the differences on the presence bus
+func (f *Federation) applyPresence(l *link, fr frame) {
+	users := make(map[string]string, len(fr.Users))
+	for user, status := range fr.Users {
+		if validUser(user) {
+			users[user] = status
+		}
+	}
+	f.mu.Lock()
+	old := f.remote[fr.Origin]
+	if old != nil && fr.Seq <= old.seq {
+		f.mu.Unlock()
+		return
+	}
+	f.remote[fr.Origin] = &origin{
+		users:   users,
+		seq:     fr.Seq,
+		via:     l,
+		expires: time.Now().Add(3 * f.cfg.PresenceKeepalive),
+	}
+	f.mu.Unlock()
+
+	var before map[string]string
+	if old != nil {
+		before = old.users
+	}
+	f.publishChanges(fr.Origin, before, users)
+}
+
+// dropOrigin forgets the users of server if its presence arrived on l, or
+// if l is nil and the presence expired
+func (f *Federation) dropOrigin(server string, l *link) {
+	f.mu.Lock()
+	o := f.remote[server]
+	if o == nil || (l != nil && o.via != l) || (l == nil && time.Now().Before(o.expires)) {
+		f.mu.Unlock()
+		return
+	}
+	delete(f.remote, server)
+	f.mu.Unlock()
+	f.publishChanges(server, o.users, nil)
+}
+
+// publishChanges publishes joins, leaves and status changes of the users of server
+func (f *Federation) publishChanges(server string, before, after map[string]string) {
+	bus := f.chat.Presence()
+	for user, status := range after {
+		old, existed := before[user]
+		switch {
+		case !existed:
+			bus.Publish(presence.Event{Type: presence.Join, User: user + "@" + server})
+			if status != "" {
+				bus.Publish(presence.Event{Type: presence.Status, User: user + "@" + server, Status: status})
+			}
+		case old != status:
+			bus.Publish(presence.Event{Type: presence.Status, User: user + "@" + server, Status: status})
+		}
+	}
+	for user := range before {
+		if _, exists := after[user]; !exists {
+			bus.Publish(presence.Event{Type: presence.Leave, User: user + "@" + server})
+		}
+	}
+}
+
+// watchPresence sends the local users to the peers whenever they change
+// and every PRESENCE_KEEPALIVE, and expires the users of silent servers
+func (f *Federation) watchPresence() {
+	defer f.wg.Done()
+	events, unsubscribe := f.chat.Presence().Subscribe(64)
+	defer unsubscribe()
+	ticker := time.NewTicker(f.cfg.PresenceKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-events:
+			if e.Type == presence.Register || IsRemote(e.User) {
+				continue
+			}
+			f.broadcast(f.snapshot())
+		case <-ticker.C:
+			f.broadcast(f.snapshot())
+			f.mu.Lock()
+			servers := make([]string, 0, len(f.remote))
+			for server := range f.remote {
+				servers = append(servers, server)
+			}
+			f.mu.Unlock()
+			for _, server := range servers {
+				f.dropOrigin(server, nil)
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// snapshot returns a presence frame listing the local users
+func (f *Federation) snapshot() frame {
+	statuses := f.chat.GetStatuses()
+	users := make(map[string]string)
+	for _, user := range f.chat.GetUsers() {
+		if !IsRemote(user) {
+			users[user] = statuses[user]
+		}
+	}
+	return frame{
+		Type:   framePresence,
+		Origin: f.cfg.FederationName,
+		Time:   time.Now().UTC(),
+		Seq:    time.Now().UnixNano(), // Keeps increasing across restarts
+		Users:  users,
+	}
+}
+
+// broadcast queues fr for every link
+func (f *Federation) broadcast(fr frame) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, l := range f.links {
+		if !l.send(fr) {
+			f.logger.Error("Queue of server %s full, dropped a %s frame", l.peer, fr.Type)
+		}
+	}
+}
+
+// validServerName reports whether name can be the server part of user@server
+func validServerName(name string) bool {
+	return name != "" && len(name) <= 64 && !strings.ContainsAny(name, "@=, \t\r\n")
+}
+
+// validUser reports whether user can be the user part of user@server
+func validUser(user string) bool {
+	return user != "" && len(user) <= 64 && !strings.ContainsAny(user, "@[] \t\r\n")
+}
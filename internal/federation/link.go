@@ -0,0 +1,222 @@
+package federation
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Frame types exchanged between servers
+const (
+	frameHello    = "hello"    // First frame in each direction, Origin names the sender
+	frameMessage  = "message"  // From sent Text to the default room
+	framePM       = "pm"       // From sent Text privately to To, a user@server address
+	framePresence = "presence" // Users of Origin and their statuses
+	framePing     = "ping"     // Keeps an idle link from timing out
+)
+
+// exporterLabel derives the keying material handshakes are bound to
+const exporterLabel = "EXPORTER-chat-federation"
+
+// maxFrameSize limits a single frame, large enough for the presence of a busy server
+const maxFrameSize = 1024 * 1024
+
+// linkQueueSize is the number of frames waiting to be written to a peer
+const linkQueueSize = 256
+
+// frame is one JSON line on a federation link
+type frame struct {
+	Type   string            `json:"type"`
+	Origin string            `json:"origin,omitempty"` // Sending server, always the peer of the link
+	From   string            `json:"from,omitempty"`
+	To     string            `json:"to,omitempty"`
+	Text   string            `json:"text,omitempty"`
+	Time   time.Time         `json:"time,omitempty"`
+	Seq    int64             `json:"seq,omitempty"`   // Orders the presence frames of an origin
+	Users  map[string]string `json:"users,omitempty"` // Status by user, empty if available
+	MAC    string            `json:"mac,omitempty"`   // Proof of the shared secret in hello frames
+}
+
+// link is an authenticated connection to a peer server
+type link struct {
+	peer    string
+	conn    net.Conn
+	scanner *bufio.Scanner
+	out     chan frame
+	done    chan struct{}
+	once    sync.Once
+}
+
+// newLink wraps an authenticated connection to peer
+func newLink(peer string, conn net.Conn, scanner *bufio.Scanner) *link {
+	return &link{
+		peer:    peer,
+		conn:    conn,
+		scanner: scanner,
+		out:     make(chan frame, linkQueueSize),
+		done:    make(chan struct{}),
+	}
+}
+
+// send queues fr without blocking and reports whether it was queued
+func (l *link) send(fr frame) bool {
+	select {
+	case l.out <- fr:
+		return true
+	default:
+		return false
+	}
+}
+
+// close ends the link
+func (l *link) close() {
+	l.once.Do(func() {
+		close(l.done)
+		l.conn.Close()
+	})
+}
+
+// handshakeMAC proves knowledge of secret for one side of a TLS session.
+// Binding it to the session's keying material keeps a man in the middle
+// from relaying the proof over a session of its own.
+func handshakeMAC(secret, role, server string, conn *tls.Conn) (string, error) {
+	state := conn.ConnectionState()
+	ekm, err := state.ExportKeyingMaterial(exporterLabel, nil, 32)
+	if err != nil {
+		return "", fmt.Errorf("failed to export keying material: %v", err)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(role + "\x00" + server + "\x00"))
+	mac.Write(ekm)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// writeFrame writes fr as a JSON line
+func writeFrame(conn net.Conn, fr frame, timeout time.Duration) error {
+	data, err := json.Marshal(fr)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s frame: %v", fr.Type, err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+// readFrame reads the next JSON line
+func readFrame(conn net.Conn, scanner *bufio.Scanner, timeout time.Duration) (frame, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return frame{}, err
+		}
+		return frame{}, fmt.Errorf("link closed")
+	}
+	var fr frame
+	if err := json.Unmarshal(scanner.Bytes(), &fr); err != nil {
+		return frame{}, fmt.Errorf("invalid frame: %v", err)
+	}
+	return fr, nil
+}
+
+// newScanner returns a scanner for the frames on conn
+func newScanner(conn net.Conn) *bufio.Scanner {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxFrameSize)
+	return scanner
+}
+
+// dialPeer connects to the peer named peer at addr and authenticates both sides
+func (f *Federation) dialPeer(peer, addr string) (*link, error) {
+	dialer := &net.Dialer{Timeout: f.cfg.DialTimeout}
+	// The certificate is not verified: peers authenticate each other with
+	// the shared secret, bound to this session by handshakeMAC
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13})
+	if err != nil {
+		return nil, err
+	}
+	l, err := f.handshake(conn, peer, true)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// handshake exchanges hello frames. The dialing side speaks first and
+// knows which peer it expects; the accepting side learns it from the hello.
+func (f *Federation) handshake(conn *tls.Conn, peer string, dialing bool) (*link, error) {
+	conn.SetDeadline(time.Now().Add(f.cfg.TCPTimeout))
+	if err := conn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	scanner := newScanner(conn)
+	own, theirs := "accept", "dial"
+	if dialing {
+		own, theirs = "dial", "accept"
+	}
+
+	sendHello := func() error {
+		mac, err := handshakeMAC(f.cfg.FederationSecret, own, f.cfg.FederationName, conn)
+		if err != nil {
+			return err
+		}
+		return writeFrame(conn, frame{Type: frameHello, Origin: f.cfg.FederationName, MAC: mac}, f.cfg.TCPTimeout)
+	}
+	if dialing {
+		if err := sendHello(); err != nil {
+			return nil, err
+		}
+	}
+	hello, err := readFrame(conn, scanner, f.cfg.TCPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Type != frameHello || !validServerName(hello.Origin) || hello.Origin == f.cfg.FederationName {
+		return nil, fmt.Errorf("invalid hello")
+	}
+	if dialing && hello.Origin != peer {
+		return nil, fmt.Errorf("expected server %s, found %s", peer, hello.Origin)
+	}
+	want, err := handshakeMAC(f.cfg.FederationSecret, theirs, hello.Origin, conn)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(hello.MAC), []byte(want)) {
+		return nil, fmt.Errorf("server %s does not know the federation secret", hello.Origin)
+	}
+	if !dialing {
+		if err := sendHello(); err != nil {
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return newLink(hello.Origin, conn, scanner), nil
+}
+
+// write sends queued frames and pings to the peer until the link closes
+func (f *Federation) write(l *link) {
+	ticker := time.NewTicker(f.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var fr frame
+		select {
+		case fr = <-l.out:
+		case <-ticker.C:
+			fr = frame{Type: framePing}
+		case <-l.done:
+			return
+		}
+		if err := writeFrame(l.conn, fr, f.cfg.TCPTimeout); err != nil {
+			f.logger.Error("Failed to write to server %s: %v", l.peer, err)
+			l.close()
+			return
+		}
+	}
+}
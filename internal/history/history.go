@@ -3,38 +3,67 @@ package history
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	"chat/internal/database"
+	"chat/internal/message"
 )
 
+// Entry is a message kept in the history
+type Entry struct {
+	Line string // As replayed, starting with the time if loaded from the database
+	Type message.MessageType
+	From string
+	To   string // Recipient of a private message
+	Room string // Empty for the default room
+}
+
 // History manages message history
 type History struct {
-	messages []string
+	messages []Entry
 	capacity int
 	mu       sync.Mutex
-	db       *database.DB
+	db       database.Store
+	persist  *Persister
 }
 
-// New creates a new history instance with database integration
-func New(capacity int, db *database.DB) *History {
+// New creates a new history instance with database integration.
+// Messages are written through persist if set, otherwise synchronously.
+func New(capacity int, db database.Store, persist *Persister) *History {
 	h := &History{
-		messages: make([]string, 0, capacity),
+		messages: make([]Entry, 0, capacity),
 		capacity: capacity,
 		db:       db,
+		persist:  persist,
 	}
 	h.loadFromDB()
 	return h
 }
 
 // Add adds a message to history and database
-func (h *History) Add(msg, from, to, timestamp string) {
+func (h *History) Add(msg message.Message, at time.Time) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
 	if len(h.messages) >= h.capacity {
 		h.messages = h.messages[1:]
 	}
-	h.messages = append(h.messages, msg)
-	if err := h.db.SaveMessage(from, to, msg, timestamp); err != nil {
+	h.messages = append(h.messages, Entry{Line: msg.String(), Type: msg.Type, From: msg.From, To: msg.Target, Room: msg.Room})
+	h.mu.Unlock()
+
+	// Persist outside the lock so a slow database does not serialize handlers
+	stored := database.Message{
+		Type:      msg.Type,
+		From:      msg.From,
+		To:        msg.Target,
+		Room:      msg.Room,
+		ReplyTo:   msg.ReplyTo,
+		Content:   msg.String(),
+		Timestamp: at,
+	}
+	if h.persist != nil {
+		h.persist.Save(stored)
+		return
+	}
+	if _, err := h.db.SaveMessage(stored); err != nil {
 		// Log error if needed
 		fmt.Printf("Failed to save message to DB: %v\n", err)
 	}
@@ -45,13 +74,38 @@ func (h *History) GetAll() []string {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	result := make([]string, len(h.messages))
+	for i, e := range h.messages {
+		result[i] = e.Line
+	}
+	return result
+}
+
+// Entries returns all history messages with their sender, recipient and room
+func (h *History) Entries() []Entry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := make([]Entry, len(h.messages))
 	copy(result, h.messages)
 	return result
 }
 
 // loadFromDB loads recent messages from database
 func (h *History) loadFromDB() {
-	messages, err := h.db.LoadRecentMessages(h.capacity)
+	var messages []Entry
+	err := h.db.QueryMessages(database.MessageFilter{Newest: true, Limit: h.capacity}, func(msg database.Message) error {
+		messages = append(messages, Entry{
+			Line: fmt.Sprintf("[%s] %s", msg.Timestamp.Format(database.TimeLayout), msg.Content),
+			Type: msg.Type,
+			From: msg.From,
+			To:   msg.To,
+			Room: msg.Room,
+		})
+		return nil
+	})
+	// Newest first, reversed to chronological order
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
 	if err != nil {
 		// Log error if needed
 		fmt.Printf("Failed to load history from DB: %v\n", err)
@@ -60,4 +114,4 @@ func (h *History) loadFromDB() {
 	h.mu.Lock()
 	h.messages = messages
 	h.mu.Unlock()
-}
\ No newline at end of file
+}
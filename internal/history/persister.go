@@ -0,0 +1,115 @@
+package history
+
+import (
+	"sync"
+	"time"
+
+	"chat/internal/database"
+	"chat/pkg/logger"
+)
+
+// Persister writes messages to the database in batches off the hot path
+type Persister struct {
+	store     database.Store
+	logger    *logger.Logger
+	queue     chan database.Message
+	batchSize int
+	interval  time.Duration
+	closed    bool
+	mu        sync.RWMutex // Guards closed against concurrent Save calls
+	stopped   chan struct{}
+}
+
+// NewPersister creates a persister that flushes every interval or once batchSize
+// messages are queued. Save blocks when queueSize messages are waiting.
+func NewPersister(store database.Store, logger *logger.Logger, batchSize int, interval time.Duration, queueSize int) *Persister {
+	return &Persister{
+		store:     store,
+		logger:    logger,
+		queue:     make(chan database.Message, queueSize),
+		batchSize: batchSize,
+		interval:  interval,
+		stopped:   make(chan struct{}),
+	}
+}
+
+// Start runs the write loop until Shutdown is called
+func (p *Persister) Start() {
+	defer close(p.stopped)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	batch := make([]database.Message, 0, p.batchSize)
+	for {
+		select {
+		case msg, ok := <-p.queue:
+			if !ok {
+				p.flush(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= p.batchSize {
+				batch = p.flush(batch)
+			}
+		case <-ticker.C:
+			batch = p.flush(batch)
+		}
+	}
+}
+
+// Save queues a message for writing. After Shutdown it writes synchronously.
+func (p *Persister) Save(msg database.Message) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		if _, err := p.store.SaveMessage(msg); err != nil {
+			p.logger.Error("Failed to save message from %s: %v", msg.From, err)
+		}
+		return
+	}
+	p.queue <- msg
+}
+
+// Shutdown stops accepting messages and waits until the queue is flushed
+func (p *Persister) Shutdown() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.queue)
+	}
+	p.mu.Unlock()
+	<-p.stopped
+}
+
+// flush writes a batch in one transaction and returns the emptied batch.
+// If the transaction fails the messages are written one by one, so one bad
+// message or a transient error does not lose the whole batch.
+func (p *Persister) flush(batch []database.Message) []database.Message {
+	if len(batch) == 0 {
+		return batch
+	}
+	// Fix the IDs first so a batch that was written after all cannot be written twice
+	for i := range batch {
+		if batch[i].UID == "" {
+			if uid, err := database.NewUID(); err == nil {
+				batch[i].UID = uid
+			}
+		}
+	}
+	err := p.store.SaveMessages(batch)
+	if err == nil {
+		return batch[:0]
+	}
+	p.logger.Error("Failed to save %d messages, saving them one by one: %v", len(batch), err)
+	lost := 0
+	for _, msg := range batch {
+		if _, err := p.store.SaveMessage(msg); err != nil {
+			p.logger.Error("Failed to save message from %s: %v", msg.From, err)
+			lost++
+		}
+	}
+	if lost > 0 {
+		p.logger.Error("Lost %d of %d messages", lost, len(batch))
+	}
+	return batch[:0]
+}
@@ -0,0 +1,798 @@
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/command"
+	"chat/internal/config"
+	"chat/internal/tcp"
+	"chat/pkg/logger"
+)
+
+// serverName is the prefix of messages from the gateway itself
+const serverName = "chat"
+
+// Directory is the part of the chat server the gateway needs besides the
+// line protocol: the online users and rooms for NAMES and LIST, and the
+// commands IRC clients may run as commands of their own
+type Directory interface {
+	GetUsers() []string
+	RoomMembers(room string) []string
+	Rooms() ([]string, error)
+	Commands() *command.Registry
+}
+
+// Gateway accepts IRC clients and bridges each into the chat server as a
+// connection speaking the line protocol, so IRC users share the login,
+// history and commands of every other transport. Channels are rooms: the
+// channel in cfg.IRCChannel is the default room and #name is the room name.
+// It implements net.Listener.
+type Gateway struct {
+	cfg    config.Config
+	logger *logger.Logger
+	ln     net.Listener
+	dir    Directory
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Listen starts accepting IRC clients on cfg.IRCPort
+func Listen(cfg config.Config, logger *logger.Logger) (*Gateway, error) {
+	ln, err := net.Listen("tcp", cfg.IRCPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start IRC gateway: %v", err)
+	}
+	g := &Gateway{
+		cfg:    cfg,
+		logger: logger,
+		ln:     ln,
+		accept: make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	go g.serve()
+	return g, nil
+}
+
+// SetDirectory sets the chat server the gateway lists users and commands of.
+// It must be called before clients connect.
+func (g *Gateway) SetDirectory(d Directory) {
+	g.dir = d
+}
+
+// Accept waits for the next IRC user to log in
+func (g *Gateway) Accept() (net.Conn, error) {
+	select {
+	case conn := <-g.accept:
+		return conn, nil
+	case <-g.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting IRC clients. Open sessions end when the chat
+// server closes their connections.
+func (g *Gateway) Close() error {
+	var err error
+	g.once.Do(func() {
+		close(g.done)
+		err = g.ln.Close()
+	})
+	return err
+}
+
+// Addr returns the address IRC clients connect to
+func (g *Gateway) Addr() net.Addr {
+	return g.ln.Addr()
+}
+
+// serve accepts IRC clients until Close
+func (g *Gateway) serve() {
+	for {
+		conn, err := g.ln.Accept()
+		if err != nil {
+			select {
+			case <-g.done:
+				return
+			default:
+				g.logger.Error("IRC accept error: %v", err)
+				continue
+			}
+		}
+		go g.handleClient(conn)
+	}
+}
+
+// pipeConn is the server's end of a bridged IRC client. History replays
+// go through OpenHistory, which also tells the gateway the login succeeded.
+type pipeConn struct {
+	net.Conn
+	session *session
+}
+
+// RemoteAddr returns the address of the IRC client
+func (c pipeConn) RemoteAddr() net.Addr {
+	return c.session.client.RemoteAddr()
+}
+
+// OpenHistory welcomes the IRC client and returns a writer for history replays
+func (c pipeConn) OpenHistory() (io.WriteCloser, error) {
+	c.session.welcome()
+	r, w := io.Pipe()
+	go func() {
+		defer r.Close()
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			c.session.replay(scanner.Text())
+		}
+	}()
+	return w, nil
+}
+
+// session is the state of one IRC client
+type session struct {
+	g      *Gateway
+	client net.Conn
+	server net.Conn // Gateway end of the pipe to the chat server, nil until login, only used by the client loop
+	user   string   // Only used by the client loop
+
+	writeMu sync.Mutex // Serializes writes to client
+
+	mu           sync.Mutex // Guards the fields below
+	nick         string
+	pass         string
+	awaitingCode bool // The server asked for a second factor
+	welcomed     bool
+	channels     map[string]map[string]bool // Users the client was told are in each joined channel, by room
+}
+
+// handleClient reads commands from an IRC client until it quits or the
+// chat server ends the session
+func (g *Gateway) handleClient(conn net.Conn) {
+	defer conn.Close()
+	s := &session{g: g, client: conn, channels: make(map[string]map[string]bool)}
+	defer func() {
+		if s.server != nil {
+			s.server.Close()
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 512), maxLineSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(g.cfg.TCPTimeout))
+		if !scanner.Scan() {
+			return
+		}
+		m, ok := parseMessage(scanner.Text())
+		if !ok {
+			continue
+		}
+		if !s.handle(m) {
+			return
+		}
+	}
+}
+
+// send writes one line to the IRC client
+func (s *session) send(format string, args ...interface{}) {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.client.SetWriteDeadline(time.Now().Add(s.g.cfg.TCPTimeout))
+	fmt.Fprintf(s.client, format+"\r\n", args...)
+}
+
+// reply sends a numeric reply to the client
+func (s *session) reply(numeric, text string) {
+	s.mu.Lock()
+	nick := s.nick
+	s.mu.Unlock()
+	if nick == "" {
+		nick = "*"
+	}
+	s.send(":%s %s %s %s", serverName, numeric, nick, text)
+}
+
+// notice sends text from the gateway to the client
+func (s *session) notice(text string) {
+	s.reply("NOTICE", ":"+text)
+}
+
+// toServer writes a line of the chat protocol
+func (s *session) toServer(line string) bool {
+	s.server.SetWriteDeadline(time.Now().Add(s.g.cfg.TCPTimeout))
+	_, err := s.server.Write([]byte(line + "\n"))
+	return err == nil
+}
+
+// handle processes one command from the client and reports whether the
+// session goes on
+func (s *session) handle(m message) bool {
+	switch m.Command {
+	case "PING":
+		s.send(":%s PONG %s :%s", serverName, serverName, m.param(0))
+		return s.keepAlive()
+	case "PONG":
+		return s.keepAlive()
+	case "QUIT":
+		s.send("ERROR :Closing link (quit)")
+		return false
+	case "CAP":
+		// No capabilities are offered, but answering lets clients finish registration
+		switch strings.ToUpper(m.param(0)) {
+		case "LS", "LIST":
+			s.send(":%s CAP * %s :", serverName, strings.ToUpper(m.param(0)))
+		case "REQ":
+			s.send(":%s CAP * NAK :%s", serverName, m.param(1))
+		}
+		return true
+	}
+
+	s.mu.Lock()
+	welcomed := s.welcomed
+	s.mu.Unlock()
+	if !welcomed {
+		return s.register(m)
+	}
+
+	switch m.Command {
+	case "PASS", "USER":
+		s.reply(errAlreadyRegistred, ":You may not reregister")
+	case "NICK":
+		s.notice("Nick changes are not supported, reconnect with the nick of another account")
+	case "PRIVMSG", "NOTICE":
+		return s.privmsg(m)
+	case "JOIN":
+		return s.join(m.param(0))
+	case "PART":
+		return s.part(m.param(0))
+	case "NAMES":
+		if room, ok := s.roomOf(m.param(0)); ok || m.param(0) == "" {
+			s.names(room)
+		} else {
+			s.reply(rplEndOfNames, m.param(0)+" :End of /NAMES list")
+		}
+	case "TOPIC":
+		if room, ok := s.roomOf(m.param(0)); ok {
+			s.reply(rplNoTopic, s.channelOf(room)+" :No topic is set")
+		} else {
+			s.reply(errNoSuchChannel, m.param(0)+" :No such channel")
+		}
+	case "MODE":
+		if room, ok := s.roomOf(m.param(0)); ok {
+			s.reply(rplChannelModeIs, s.channelOf(room)+" +")
+		} else {
+			s.reply(rplUModeIs, "+")
+		}
+	case "WHO":
+		s.reply(rplEndOfWho, m.param(0)+" :End of /WHO list")
+	case "LIST":
+		s.list()
+	case "AWAY":
+		if m.param(0) == "" {
+			s.reply(rplUnaway, ":You are no longer marked as being away")
+		} else {
+			s.reply(rplNowAway, ":You have been marked as being away")
+		}
+		return s.toServer(strings.TrimSpace("/status " + m.param(0)))
+	case "KICK":
+		if len(m.Params) < 2 {
+			s.reply(errNeedMoreParams, "KICK :Not enough parameters")
+			return true
+		}
+		return s.toServer(strings.TrimSpace("/kick " + m.Params[1] + " " + m.param(2)))
+	default:
+		// Clients send commands they do not know, such as /users, as they are
+		name := strings.ToLower(m.Command)
+		if _, ok := s.g.dir.Commands().Lookup(name); !ok {
+			s.reply(errUnknownCommand, m.Command+" :Unknown command")
+			return true
+		}
+		return s.toServer(strings.TrimSpace("/" + name + " " + strings.Join(m.Params, " ")))
+	}
+	return true
+}
+
+// register processes the commands allowed before the chat server accepted
+// the login, and logs in once NICK, USER and PASS were received
+func (s *session) register(m message) bool {
+	switch m.Command {
+	case "PASS":
+		if len(m.Params) == 0 {
+			s.reply(errNeedMoreParams, "PASS :Not enough parameters")
+			return true
+		}
+		s.mu.Lock()
+		awaitingCode := s.awaitingCode
+		s.awaitingCode = false
+		if !awaitingCode {
+			s.pass = m.Params[0]
+		}
+		s.mu.Unlock()
+		if awaitingCode {
+			return s.toServer(m.Params[0])
+		}
+	case "NICK":
+		nick := m.param(0)
+		switch {
+		case nick == "":
+			s.reply(errNoNicknameGiven, ":No nickname given")
+			return true
+		case !validNick(nick):
+			s.reply(errErroneousNick, nick+" :Erroneous nickname")
+			return true
+		}
+		if s.server == nil {
+			s.mu.Lock()
+			s.nick = nick
+			s.mu.Unlock()
+		}
+	case "USER":
+		if len(m.Params) < 4 {
+			s.reply(errNeedMoreParams, "USER :Not enough parameters")
+			return true
+		}
+		s.user = m.Params[0]
+	default:
+		s.reply(errNotRegistered, ":You have not registered")
+		return true
+	}
+
+	s.mu.Lock()
+	ready := s.nick != "" && s.user != ""
+	pass := s.pass
+	s.mu.Unlock()
+	if s.server != nil || !ready {
+		return true
+	}
+	if pass == "" {
+		s.reply(errPasswdMismatch, ":Password required, set the server password to your chat password")
+		s.send("ERROR :Closing link (password required)")
+		return false
+	}
+	return s.login(pass)
+}
+
+// login hands a pipe to the chat server and sends the credentials
+func (s *session) login(pass string) bool {
+	serverEnd, gatewayEnd := net.Pipe()
+	select {
+	case s.g.accept <- pipeConn{Conn: serverEnd, session: s}:
+	case <-s.g.done:
+		return false
+	}
+	s.server = gatewayEnd
+	go s.readServer(gatewayEnd)
+	s.mu.Lock()
+	nick := s.nick
+	s.mu.Unlock()
+	return s.toServer(nick) && s.toServer(pass)
+}
+
+// keepAlive sends the chat server an empty line, which it ignores, so that
+// a quiet IRC client that answers pings is not timed out
+func (s *session) keepAlive() bool {
+	if s.server == nil {
+		return true
+	}
+	return s.toServer("")
+}
+
+// readServer translates lines from the chat server until it closes the
+// session, then disconnects the client
+func (s *session) readServer(server net.Conn) {
+	defer s.client.Close()
+	scanner := bufio.NewScanner(server)
+	for scanner.Scan() {
+		s.fromServer(scanner.Text())
+	}
+	s.send("ERROR :Closing link")
+}
+
+// welcome completes registration and joins the client to the channel of
+// the default room
+func (s *session) welcome() {
+	s.mu.Lock()
+	s.welcomed = true
+	nick := s.nick
+	s.mu.Unlock()
+	s.reply(rplWelcome, ":Welcome to the chat, "+nick)
+	s.reply(rplYourHost, ":Your host is "+serverName+", an IRC gateway to the chat server")
+	s.reply(rplISupport, "CHANTYPES=# NETWORK=chat :are supported by this server")
+	s.reply(errNoMOTD, ":MOTD File is missing")
+	s.enter("")
+}
+
+// fromServer translates a live line from the chat server
+func (s *session) fromServer(line string) {
+	s.mu.Lock()
+	nick, welcomed := s.nick, s.welcomed
+	s.mu.Unlock()
+	room, rest, inRoom := splitRoom(line)
+
+	switch {
+	case line == "":
+	case line == "PING":
+		// Answered with PONG, which the client loop turns into a keepalive
+		s.send("PING :%s", serverName)
+	case line == tcp.SecondFactorPrompt:
+		s.mu.Lock()
+		s.awaitingCode = true
+		s.mu.Unlock()
+		s.notice("Two-factor authentication is enabled, send your code with /quote PASS <code>")
+	case !welcomed && strings.HasPrefix(line, "ERR002"):
+		s.reply(errPasswdMismatch, ":Password incorrect")
+	case !welcomed && strings.HasPrefix(line, "ERR001"):
+		s.reply(errNicknameInUse, nick+" :Nickname is already in use")
+	case strings.HasPrefix(rest, "[SYSTEM] "):
+		s.system(room, strings.TrimPrefix(rest, "[SYSTEM] "))
+	case !inRoom && strings.HasPrefix(line, "[PRIVATE from "):
+		from, text, ok := strings.Cut(strings.TrimPrefix(line, "[PRIVATE from "), "] ")
+		switch {
+		case !ok:
+			s.notice(line)
+		case from != nick:
+			// The sender's own copy names no recipient, IRC clients echo their messages anyway
+			s.send(":%s!%s@%s PRIVMSG %s :%s", from, from, serverName, nick, text)
+		}
+	default:
+		from, text, ok := splitSender(rest)
+		if !ok {
+			s.notice(line)
+			return
+		}
+		if inRoom {
+			// Only members receive the messages of a room
+			s.enter(room)
+		}
+		if from != nick && s.joined(room) {
+			s.send(":%s!%s@%s PRIVMSG %s :%s", from, from, serverName, s.channelOf(room), text)
+		}
+	}
+}
+
+// system translates a live system message, turning joins and leaves of
+// users into JOIN, PART and QUIT so that IRC clients keep their nick lists
+func (s *session) system(room, text string) {
+	if room != "" {
+		s.roomSystem(room, text)
+		return
+	}
+	if user, ok := strings.CutSuffix(text, " joined the chat"); ok {
+		if s.track("", user, true) {
+			s.send(":%s!%s@%s JOIN %s", user, user, serverName, s.g.cfg.IRCChannel)
+		}
+		return
+	}
+	// Replies to the /join and /part the gateway sends for JOIN and PART
+	if strings.HasPrefix(text, "You are now talking in ") || strings.HasPrefix(text, "You left #") {
+		return
+	}
+	reason := "Left the chat"
+	user, ok := strings.CutSuffix(text, " left the chat")
+	if !ok {
+		reason = "Timed out"
+		user, ok = strings.CutSuffix(text, " left the chat (timeout)")
+	}
+	if !ok {
+		s.notice(text)
+		return
+	}
+	if s.quit(user) {
+		s.send(":%s!%s@%s QUIT :%s", user, user, serverName, reason)
+	}
+}
+
+// roomSystem translates a live system message of a room other than the
+// default one
+func (s *session) roomSystem(room, text string) {
+	s.mu.Lock()
+	nick := s.nick
+	s.mu.Unlock()
+	channel := s.channelOf(room)
+
+	if user, ok := strings.CutSuffix(text, " joined "+tcp.RoomName(room)); ok {
+		switch {
+		case user == nick:
+			s.enter(room)
+		case s.track(room, user, true):
+			s.send(":%s!%s@%s JOIN %s", user, user, serverName, channel)
+		}
+		return
+	}
+	if user, ok := strings.CutSuffix(text, " left "+tcp.RoomName(room)); ok {
+		if s.track(room, user, false) {
+			s.send(":%s!%s@%s PART %s", user, user, serverName, channel)
+		}
+		return
+	}
+	if s.joined(room) {
+		s.send(":%s NOTICE %s :%s", serverName, channel, text)
+	} else {
+		s.notice(tcp.RoomName(room) + " " + text)
+	}
+}
+
+// track records that user joined or left room if the client is in its
+// channel and the user's presence really changed, which /history replays
+// of old joins and leaves do not. It reports whether the client must be told.
+func (s *session) track(room, user string, online bool) bool {
+	present := false
+	for _, u := range s.g.dir.RoomMembers(room) {
+		present = present || u == user
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members, joined := s.channels[room]
+	if !joined || user == s.nick || present != online || members[user] == online {
+		return false
+	}
+	if online {
+		members[user] = true
+	} else {
+		delete(members, user)
+	}
+	return true
+}
+
+// quit records that user left the chat and so every channel. It reports
+// whether the client was told the user was in one of them.
+func (s *session) quit(user string) bool {
+	if s.online(user) {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := false
+	for _, members := range s.channels {
+		seen = seen || members[user]
+		delete(members, user)
+	}
+	return seen && user != s.nick
+}
+
+// replay translates a line of the history replay after login, which has
+// only messages of the default room as the user is in no other room yet
+func (s *session) replay(line string) {
+	s.mu.Lock()
+	nick := s.nick
+	s.mu.Unlock()
+	channel := s.g.cfg.IRCChannel
+	at, line, ok := splitTime(line)
+	if ok {
+		at = "[" + at + "] "
+	}
+
+	if text, ok := strings.CutPrefix(line, "[SYSTEM] "); ok {
+		s.send(":%s NOTICE %s :%s%s", serverName, channel, at, text)
+		return
+	}
+	if rest, ok := strings.CutPrefix(line, "[PRIVATE from "); ok {
+		if from, text, ok := strings.Cut(rest, "] "); ok && from != nick {
+			s.send(":%s!%s@%s PRIVMSG %s :%s%s", from, from, serverName, nick, at, text)
+			return
+		}
+	}
+	if from, text, ok := splitSender(line); ok {
+		s.send(":%s!%s@%s PRIVMSG %s :%s%s", from, from, serverName, channel, at, text)
+		return
+	}
+	s.send(":%s NOTICE %s :%s%s", serverName, channel, at, line)
+}
+
+// roomOf returns the room of a channel name. The channel in
+// cfg.IRCChannel, and #lobby, are the default room.
+func (s *session) roomOf(channel string) (string, bool) {
+	if strings.EqualFold(channel, s.g.cfg.IRCChannel) {
+		return "", true
+	}
+	if !strings.HasPrefix(channel, "#") {
+		return "", false
+	}
+	room, err := tcp.ParseRoom(channel)
+	return room, err == nil
+}
+
+// channelOf returns the channel name of a room
+func (s *session) channelOf(room string) string {
+	if room == "" {
+		return s.g.cfg.IRCChannel
+	}
+	return "#" + room
+}
+
+// joined reports whether the client is in the channel of room
+func (s *session) joined(room string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, joined := s.channels[room]
+	return joined
+}
+
+// privmsg sends a PRIVMSG to a channel as a message to its room and one to
+// a nick as /pm
+func (s *session) privmsg(m message) bool {
+	if len(m.Params) < 2 || m.Params[1] == "" {
+		s.reply(errNeedMoreParams, m.Command+" :Not enough parameters")
+		return true
+	}
+	text, ok := ctcpText(m.Params[1])
+	if !ok {
+		return true
+	}
+	// Several targets are separated by commas
+	for _, target := range strings.Split(m.Params[0], ",") {
+		room, isChannel := s.roomOf(target)
+		switch {
+		case isChannel && !s.joined(room):
+			s.reply(errCannotSendToChan, target+" :Cannot send to channel")
+		case isChannel:
+			name := room
+			if name == "" {
+				name = tcp.Lobby
+			}
+			// /say keeps text starting with a slash from running as a command
+			if !s.toServer("/say " + name + " " + text) {
+				return false
+			}
+		case strings.HasPrefix(target, "#"):
+			s.reply(errNoSuchChannel, target+" :No such channel")
+		case !s.online(target):
+			s.reply(errNoSuchNick, target+" :No such nick")
+		default:
+			if !s.toServer("/pm " + target + " " + text) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// online reports whether user is logged in to the chat
+func (s *session) online(user string) bool {
+	for _, u := range s.g.dir.GetUsers() {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// join adds the client to the channels named by target. The default room
+// is joined locally, as every chat user is in it. Other rooms are joined on
+// the chat server, and the client enters their channel once it confirms.
+func (s *session) join(target string) bool {
+	for _, channel := range strings.Split(target, ",") {
+		if channel == "" {
+			s.reply(errNeedMoreParams, "JOIN :Not enough parameters")
+			continue
+		}
+		if channel == "0" {
+			if !s.part(strings.Join(s.channelNames(), ",")) {
+				return false
+			}
+			continue
+		}
+		room, ok := s.roomOf(channel)
+		switch {
+		case !ok:
+			s.reply(errNoSuchChannel, channel+" :No such channel")
+		case room == "":
+			s.enter("")
+		case !s.joined(room):
+			if !s.toServer("/join " + room) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// enter shows the client in the channel of room unless it already is
+func (s *session) enter(room string) {
+	s.mu.Lock()
+	if _, joined := s.channels[room]; joined {
+		s.mu.Unlock()
+		return
+	}
+	s.channels[room] = make(map[string]bool)
+	nick := s.nick
+	s.mu.Unlock()
+	s.send(":%s!%s@%s JOIN %s", nick, nick, serverName, s.channelOf(room))
+	s.names(room)
+}
+
+// channelNames returns the channels the client is in
+func (s *session) channelNames() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.channels))
+	for room := range s.channels {
+		names = append(names, s.channelOf(room))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// part removes the client from channels. Leaving the default room's channel
+// only stops its messages, the client stays logged in and keeps receiving
+// private messages. Other rooms are left on the chat server too.
+func (s *session) part(target string) bool {
+	for _, channel := range strings.Split(target, ",") {
+		if channel == "" {
+			continue
+		}
+		room, ok := s.roomOf(channel)
+		s.mu.Lock()
+		_, joined := s.channels[room]
+		joined = ok && joined
+		if joined {
+			delete(s.channels, room)
+		}
+		nick := s.nick
+		s.mu.Unlock()
+		switch {
+		case !ok:
+			s.reply(errNoSuchChannel, channel+" :No such channel")
+		case !joined:
+			s.reply(errNotOnChannel, channel+" :You're not on that channel")
+		default:
+			s.send(":%s!%s@%s PART %s", nick, nick, serverName, s.channelOf(room))
+			if room != "" && !s.toServer("/part "+room) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// names lists the online members of room as the members of its channel
+func (s *session) names(room string) {
+	users := s.g.dir.RoomMembers(room)
+	s.mu.Lock()
+	if _, joined := s.channels[room]; joined {
+		members := make(map[string]bool)
+		for _, user := range users {
+			members[user] = true
+		}
+		s.channels[room] = members
+	}
+	s.mu.Unlock()
+
+	channel := s.channelOf(room)
+	// Keep replies well within the 512 byte line limit
+	var line []string
+	size := 0
+	for _, user := range users {
+		if size+len(user) > 400 {
+			s.reply(rplNamReply, "= "+channel+" :"+strings.Join(line, " "))
+			line, size = nil, 0
+		}
+		line = append(line, user)
+		size += len(user) + 1
+	}
+	if len(line) > 0 {
+		s.reply(rplNamReply, "= "+channel+" :"+strings.Join(line, " "))
+	}
+	s.reply(rplEndOfNames, channel+" :End of /NAMES list")
+}
+
+// list sends the channel of the default room and those of the stored rooms
+func (s *session) list() {
+	s.reply(rplList, fmt.Sprintf("%s %d :The default room", s.g.cfg.IRCChannel, len(s.g.dir.GetUsers())))
+	rooms, err := s.g.dir.Rooms()
+	if err != nil {
+		s.notice("Failed to list rooms")
+	}
+	for _, room := range rooms {
+		s.reply(rplList, fmt.Sprintf("%s %d :", s.channelOf(room), len(s.g.dir.RoomMembers(room))))
+	}
+	s.reply(rplListEnd, ":End of /LIST")
+}
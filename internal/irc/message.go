@@ -0,0 +1,146 @@
+package irc
+
+import (
+	"strings"
+	"time"
+
+	"chat/internal/database"
+	"chat/internal/tcp"
+)
+
+// Numeric replies sent to IRC clients (RFC 2812 section 5)
+const (
+	rplWelcome          = "001"
+	rplYourHost         = "002"
+	rplISupport         = "005"
+	rplUModeIs          = "221"
+	rplUnaway           = "305"
+	rplNowAway          = "306"
+	rplEndOfWho         = "315"
+	rplList             = "322"
+	rplListEnd          = "323"
+	rplChannelModeIs    = "324"
+	rplNoTopic          = "331"
+	rplNamReply         = "353"
+	rplEndOfNames       = "366"
+	errNoSuchNick       = "401"
+	errNoSuchChannel    = "403"
+	errCannotSendToChan = "404"
+	errUnknownCommand   = "421"
+	errNoMOTD           = "422"
+	errNoNicknameGiven  = "431"
+	errErroneousNick    = "432"
+	errNicknameInUse    = "433"
+	errNotOnChannel     = "442"
+	errNotRegistered    = "451"
+	errNeedMoreParams   = "461"
+	errAlreadyRegistred = "462"
+	errPasswdMismatch   = "464"
+)
+
+// maxLineSize limits the lines an IRC client can send, tags included
+const maxLineSize = 8192
+
+// message is a command received from an IRC client
+type message struct {
+	Command string   // Upper case
+	Params  []string // The trailing parameter, if any, is the last one
+}
+
+// parseMessage splits an IRC line into its command and parameters. Tags
+// and the prefix are ignored.
+func parseMessage(line string) (message, bool) {
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var m message
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		if m.Command != "" && line[0] == ':' {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		var field string
+		field, line, _ = strings.Cut(line, " ")
+		if m.Command == "" {
+			m.Command = strings.ToUpper(field)
+		} else {
+			m.Params = append(m.Params, field)
+		}
+	}
+	return m, m.Command != ""
+}
+
+// param returns the i-th parameter, or an empty string
+func (m message) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+// validNick reports whether nick can be used on both sides of the gateway
+func validNick(nick string) bool {
+	return nick != "" && len(nick) <= 32 && !strings.ContainsAny(nick, " ,*?!@:.\x01\a\t\r\n") &&
+		strings.IndexAny(nick[:1], "#&$+-0123456789") < 0
+}
+
+// splitTime removes the time prefix of a stored message replayed from
+// history, returning the time in the layout of the prefix
+func splitTime(line string) (string, string, bool) {
+	n := len(database.TimeLayout)
+	if len(line) > n+3 && line[0] == '[' && line[n+1] == ']' && line[n+2] == ' ' {
+		if _, err := time.ParseInLocation(database.TimeLayout, line[1:n+1], time.UTC); err == nil {
+			return line[1 : n+1], line[n+3:], true
+		}
+	}
+	return "", line, false
+}
+
+// splitSender parses a "[from] text" chat line
+func splitSender(line string) (string, string, bool) {
+	if !strings.HasPrefix(line, "[") {
+		return "", "", false
+	}
+	from, text, ok := strings.Cut(line[1:], "] ")
+	if !ok || from == "" || strings.ContainsAny(from, " []") {
+		return "", "", false
+	}
+	return from, text, true
+}
+
+// splitRoom removes the "[#room] " prefix of a message sent to a room other
+// than the default one, returning the stored room name
+func splitRoom(line string) (string, string, bool) {
+	name, rest, ok := strings.Cut(strings.TrimPrefix(line, "[#"), "] ")
+	if !ok || !strings.HasPrefix(line, "[#") {
+		return "", line, false
+	}
+	room, err := tcp.ParseRoom(name)
+	if err != nil || room == "" {
+		return "", line, false
+	}
+	return room, rest, true
+}
+
+// ctcpText returns the chat text for a PRIVMSG, turning a CTCP ACTION into
+// "* text" and reporting other CTCP requests as not text
+func ctcpText(text string) (string, bool) {
+	if !strings.HasPrefix(text, "\x01") {
+		return text, true
+	}
+	body := strings.Trim(text, "\x01")
+	if action, ok := strings.CutPrefix(body, "ACTION "); ok {
+		return "* " + action, true
+	}
+	return "", false
+}
@@ -1,6 +1,9 @@
 package message
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 // MessageType defines types of messages
 type MessageType int
@@ -11,11 +14,38 @@ const (
 	TypePrivate
 )
 
+// typeNames maps message types to their stored names
+var typeNames = map[MessageType]string{
+	TypeSystem:  "system",
+	TypeUser:    "user",
+	TypePrivate: "private",
+}
+
+// String returns the stored name of the message type
+func (t MessageType) String() string {
+	if name, ok := typeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("type(%d)", int(t))
+}
+
+// ParseType returns the message type for a stored name
+func ParseType(name string) (MessageType, error) {
+	for t, n := range typeNames {
+		if n == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown message type %q", name)
+}
+
 // Message represents a chat message
 type Message struct {
-	Type   MessageType
-	From   string
-	Target string // For private messages
+	Type    MessageType
+	From    string
+	Target  string // For private messages
+	Room    string // Empty for the default room
+	ReplyTo int64  // Stored ID of the message this one answers, zero if none
 	Content string
 }
 
@@ -46,7 +76,35 @@ func NewPrivateMessage(from, target, content string) Message {
 	}
 }
 
+// InRoom returns a copy of m posted to room, its content prefixed with the
+// room name. The default room has no name and no prefix.
+func (m Message) InRoom(room string) Message {
+	if room == "" {
+		return m
+	}
+	m.Room = room
+	m.Content = "[#" + room + "] " + m.Content
+	return m
+}
+
 // String returns the string representation of the message
 func (m Message) String() string {
 	return m.Content
-}
\ No newline at end of file
+}
+
+// Text returns the content without the prefix naming its type and sender
+func (m Message) Text() string {
+	content := m.Content
+	if m.Room != "" {
+		content = strings.TrimPrefix(content, "[#"+m.Room+"] ")
+	}
+	switch m.Type {
+	case TypeSystem:
+		return strings.TrimPrefix(content, "[SYSTEM] ")
+	case TypeUser:
+		return strings.TrimPrefix(content, "["+m.From+"] ")
+	case TypePrivate:
+		return strings.TrimPrefix(content, "[PRIVATE from "+m.From+"] ")
+	}
+	return content
+}
@@ -0,0 +1,78 @@
+package presence
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType is the kind of presence change
+type EventType string
+
+// Presence event types
+const (
+	Join     EventType = "join"
+	Leave    EventType = "leave"
+	Status   EventType = "status"
+	Register EventType = "register" // A client registered a UDP endpoint for updates
+)
+
+// MaxStatusLength limits the length of a status text
+const MaxStatusLength = 64
+
+// Event describes a user joining, leaving, changing status or registering an endpoint
+type Event struct {
+	Type   EventType
+	User   string
+	Status string // New status for Status events, empty means available
+	At     time.Time
+}
+
+// Bus fans out presence events to subscribers
+type Bus struct {
+	subs map[int]chan Event
+	next int
+	mu   sync.Mutex // Guards subs and next
+}
+
+// NewBus creates a new presence bus
+func NewBus() *Bus {
+	return &Bus{subs: make(map[int]chan Event)}
+}
+
+// Subscribe returns a channel receiving events and a function ending the
+// subscription. Publish never blocks, so a subscriber that falls more than
+// buffer events behind misses events; treat them as change notifications
+// and read the current state when one arrives.
+func (b *Bus) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = ch
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish sends e to every subscriber
+func (b *Bus) Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,371 @@
+package quic
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"chat/internal/config"
+	"chat/pkg/logger"
+
+	quicgo "github.com/quic-go/quic-go"
+)
+
+const (
+	alpn       = "chat/1" // Application protocol negotiated in the TLS handshake
+	closeGrace = 2 * time.Second
+
+	historyHeader = "HISTORY"
+	fileHeader    = "FILE"
+	maxHeader     = 1024
+)
+
+// Directory maps chat sessions to users so that files can be routed
+type Directory interface {
+	UserOf(conn net.Conn) (string, bool)
+	ConnOf(username string) (net.Conn, bool)
+}
+
+// Handler processes the streams a server opens towards a client
+type Handler interface {
+	History(r io.Reader)
+	File(from, name string, size int64, r io.Reader) error
+}
+
+// Conn is a chat session over QUIC. The chat protocol runs on the first
+// stream, which Conn exposes as a net.Conn; history replays and files use
+// streams of their own so they never hold up chat messages.
+type Conn struct {
+	*quicgo.Stream
+	conn *quicgo.Conn
+}
+
+// LocalAddr returns the local address of the connection
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address the peer is currently reached at
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close ends the chat stream and closes the connection once the peer had
+// time to read what is still in flight
+func (c *Conn) Close() error {
+	c.Stream.CancelRead(0)
+	err := c.Stream.Close()
+	time.AfterFunc(closeGrace, func() {
+		c.conn.CloseWithError(0, "closed")
+	})
+	return err
+}
+
+// OpenHistory opens a stream for replaying history to the peer
+func (c *Conn) OpenHistory() (io.WriteCloser, error) {
+	s, err := c.conn.OpenUniStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open history stream: %v", err)
+	}
+	if _, err := s.Write([]byte(historyHeader + "\n")); err != nil {
+		s.CancelWrite(0)
+		return nil, fmt.Errorf("failed to open history stream: %v", err)
+	}
+	return s, nil
+}
+
+// Serve dispatches the streams the server opens to h until the connection ends
+func (c *Conn) Serve(h Handler) {
+	for {
+		s, err := c.conn.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			reader := bufio.NewReader(io.LimitReader(s, maxHeader))
+			header, err := reader.ReadString('\n')
+			if err != nil {
+				s.CancelRead(0)
+				return
+			}
+			// The header was read through a limit, continue on the stream itself
+			body := io.MultiReader(reader, s)
+			fields := strings.Fields(header)
+			switch {
+			case len(fields) == 1 && fields[0] == historyHeader:
+				h.History(body)
+			case len(fields) >= 4 && fields[0] == fileHeader:
+				size, err := strconv.ParseInt(fields[2], 10, 64)
+				if err != nil || size < 0 {
+					s.CancelRead(0)
+					return
+				}
+				name := strings.Join(fields[3:], " ")
+				if err := h.File(fields[1], name, size, io.LimitReader(body, size)); err != nil {
+					s.CancelRead(0)
+				}
+			default:
+				s.CancelRead(0)
+			}
+		}()
+	}
+}
+
+// SendFile sends size bytes from r as name to the user to and waits for the
+// server to deliver it
+func (c *Conn) SendFile(to, name string, size int64, r io.Reader) error {
+	s, err := c.conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to open file stream: %v", err)
+	}
+	defer s.CancelRead(0)
+	header := fmt.Sprintf("%s %s %d %s\n", fileHeader, to, size, name)
+	if _, err := s.Write([]byte(header)); err != nil {
+		return fmt.Errorf("failed to send file: %v", err)
+	}
+	if _, err := io.CopyN(s, r, size); err != nil {
+		s.CancelWrite(0)
+		// The server stops reading when it refuses the file, report its reason
+		s.SetReadDeadline(time.Now().Add(closeGrace))
+		if reply, replyErr := readReply(s); replyErr == nil && reply != "OK" {
+			return fmt.Errorf("%s", reply)
+		}
+		return fmt.Errorf("failed to send file: %v", err)
+	}
+	s.Close()
+	reply, err := readReply(s)
+	if err != nil {
+		return fmt.Errorf("failed to read file transfer result: %v", err)
+	}
+	if reply != "OK" {
+		return fmt.Errorf("%s", reply)
+	}
+	return nil
+}
+
+// readReply reads the server's answer to a file transfer
+func readReply(s *quicgo.Stream) (string, error) {
+	reply, err := bufio.NewReader(io.LimitReader(s, maxHeader)).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(reply), nil
+}
+
+// Listener accepts chat sessions over QUIC. It implements net.Listener.
+type Listener struct {
+	cfg    config.Config
+	logger *logger.Logger
+	ln     *quicgo.Listener
+	dir    Directory
+	accept chan *Conn
+	done   chan struct{}
+}
+
+// Listen starts a QUIC listener on cfg.QUICPort with the server's TLS configuration
+func Listen(cfg config.Config, logger *logger.Logger, tlsConf *tls.Config) (*Listener, error) {
+	ln, err := quicgo.ListenAddr(cfg.QUICPort, withALPN(tlsConf), quicConfig(cfg))
+	if err != nil {
+		return nil, fmt.Errorf("failed to start QUIC listener: %v", err)
+	}
+	l := &Listener{
+		cfg:    cfg,
+		logger: logger,
+		ln:     ln,
+		accept: make(chan *Conn),
+		done:   make(chan struct{}),
+	}
+	go l.serve()
+	return l, nil
+}
+
+// SetDirectory sets the users files are routed between
+func (l *Listener) SetDirectory(d Directory) {
+	l.dir = d
+}
+
+// Accept waits for the next chat session
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener
+func (l *Listener) Close() error {
+	select {
+	case <-l.done:
+		return nil
+	default:
+	}
+	close(l.done)
+	return l.ln.Close()
+}
+
+// Addr returns the local address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// serve accepts connections and waits for their chat stream
+func (l *Listener) serve() {
+	for {
+		qc, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		go l.handle(qc)
+	}
+}
+
+// handle takes the first stream of qc as its chat stream and every later
+// stream as a file upload
+func (l *Listener) handle(qc *quicgo.Conn) {
+	ctx, cancel := context.WithTimeout(qc.Context(), l.cfg.TCPTimeout)
+	s, err := qc.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		qc.CloseWithError(0, "no chat stream")
+		return
+	}
+	c := &Conn{Stream: s, conn: qc}
+	select {
+	case l.accept <- c:
+	case <-l.done:
+		qc.CloseWithError(0, "server shutting down")
+		return
+	}
+
+	for {
+		s, err := qc.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go l.relayFile(c, s)
+	}
+}
+
+// relayFile forwards a file uploaded on s to its recipient and reports the
+// result to the sender
+func (l *Listener) relayFile(from *Conn, s *quicgo.Stream) {
+	defer s.Close()
+	reply := func(text string) {
+		s.SetWriteDeadline(time.Now().Add(l.cfg.TCPTimeout))
+		s.Write([]byte(text + "\n"))
+	}
+
+	s.SetReadDeadline(time.Now().Add(l.cfg.TCPTimeout))
+	reader := bufio.NewReader(io.LimitReader(s, maxHeader))
+	header, err := reader.ReadString('\n')
+	fields := strings.Fields(header)
+	if err != nil || len(fields) < 4 || fields[0] != fileHeader {
+		s.CancelRead(0)
+		reply("ERR020: malformed file transfer")
+		return
+	}
+	to, name := fields[1], strings.Join(fields[3:], " ")
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || size < 0 {
+		s.CancelRead(0)
+		reply("ERR020: malformed file transfer")
+		return
+	}
+	if size > l.cfg.FileMaxSize {
+		s.CancelRead(0)
+		reply(fmt.Sprintf("ERR020: files are limited to %d bytes", l.cfg.FileMaxSize))
+		return
+	}
+	if l.dir == nil {
+		s.CancelRead(0)
+		reply("ERR020: file transfer is not available")
+		return
+	}
+	sender, ok := l.dir.UserOf(from)
+	if !ok {
+		s.CancelRead(0)
+		reply("ERR002: authentication failed")
+		return
+	}
+	conn, ok := l.dir.ConnOf(to)
+	target, isQUIC := conn.(*Conn)
+	if !ok || !isQUIC {
+		s.CancelRead(0)
+		reply(fmt.Sprintf("ERR020: %s is not connected over QUIC", to))
+		return
+	}
+
+	out, err := target.conn.OpenUniStreamSync(s.Context())
+	if err != nil {
+		s.CancelRead(0)
+		reply(fmt.Sprintf("ERR020: failed to reach %s", to))
+		return
+	}
+	if _, err := fmt.Fprintf(out, "%s %s %d %s\n", fileHeader, sender, size, name); err != nil {
+		s.CancelRead(0)
+		reply(fmt.Sprintf("ERR020: failed to reach %s", to))
+		return
+	}
+	body := io.MultiReader(reader, &idleReader{s: s, timeout: l.cfg.TCPTimeout})
+	if _, err := io.CopyN(out, body, size); err != nil {
+		out.CancelWrite(0)
+		s.CancelRead(0)
+		reply(fmt.Sprintf("ERR020: file transfer failed: %v", err))
+		return
+	}
+	out.Close()
+	l.logger.Info("Relayed file %q (%d bytes) from %s to %s", name, size, sender, to)
+	reply("OK")
+}
+
+// idleReader reads from s, failing when no data arrives for timeout
+type idleReader struct {
+	s       *quicgo.Stream
+	timeout time.Duration
+}
+
+// Read extends the read deadline and reads from the stream
+func (r *idleReader) Read(p []byte) (int, error) {
+	r.s.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.s.Read(p)
+}
+
+// Dial opens a chat session with the QUIC server of cfg
+func Dial(cfg config.Config, tlsConf *tls.Config) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.DialTimeout)
+	defer cancel()
+	qc, err := quicgo.DialAddr(ctx, cfg.ChatQUICAddr(), withALPN(tlsConf), quicConfig(cfg))
+	if err != nil {
+		return nil, err
+	}
+	s, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		qc.CloseWithError(0, "")
+		return nil, err
+	}
+	return &Conn{Stream: s, conn: qc}, nil
+}
+
+// withALPN returns a copy of conf negotiating the chat protocol
+func withALPN(conf *tls.Config) *tls.Config {
+	conf = conf.Clone()
+	conf.NextProtos = []string{alpn}
+	return conf
+}
+
+// quicConfig returns the transport settings of both sides
+func quicConfig(cfg config.Config) *quicgo.Config {
+	return &quicgo.Config{
+		HandshakeIdleTimeout: cfg.DialTimeout,
+		MaxIdleTimeout:       2 * cfg.TCPTimeout,
+		KeepAlivePeriod:      cfg.HeartbeatInterval,
+	}
+}
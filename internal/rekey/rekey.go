@@ -0,0 +1,183 @@
+package rekey
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/database"
+	"chat/internal/secret"
+	"chat/pkg/logger"
+)
+
+// batchSize is the number of messages re-encrypted per transaction
+const batchSize = 500
+
+// Stats describes a re-encryption run
+type Stats struct {
+	StartedAt   time.Time
+	Duration    time.Duration
+	KeyID       string
+	Reencrypted int64
+	Err         error
+}
+
+// Rotator rotates the message key and re-encrypts stored messages in the background
+type Rotator struct {
+	store   database.Encrypter
+	keys    *secret.Keyring
+	logger  *logger.Logger
+	running bool
+	lastRun Stats
+	mu      sync.Mutex // Guards running and lastRun
+	done    chan struct{}
+}
+
+// New creates a rotator for store, whose content is sealed with keys
+func New(store database.Encrypter, keys *secret.Keyring, logger *logger.Logger) *Rotator {
+	return &Rotator{
+		store:  store,
+		keys:   keys,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+}
+
+// Rotate makes a new key current and starts re-encrypting existing messages
+// with it. The run is claimed before the key changes, so two rotations
+// cannot both start one.
+func (r *Rotator) Rotate() (string, error) {
+	if !r.claim() {
+		return "", fmt.Errorf("re-encryption is already running")
+	}
+	id, err := r.keys.Rotate()
+	if err != nil {
+		r.mu.Lock()
+		r.running = false
+		r.mu.Unlock()
+		return "", err
+	}
+	r.logger.Info("Rotated message key, new key %s", id)
+	go r.reencrypt()
+	return id, nil
+}
+
+// Run re-encrypts every message not sealed with the current key, in batches,
+// and returns the stats of the run. It does nothing if a run is in progress.
+func (r *Rotator) Run() Stats {
+	if !r.claim() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.lastRun
+	}
+	return r.reencrypt()
+}
+
+// claim marks a run as started and reports false if one already is
+func (r *Rotator) claim() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.running {
+		return false
+	}
+	r.running = true
+	return true
+}
+
+// reencrypt performs a run claimed with claim and records its stats
+func (r *Rotator) reencrypt() Stats {
+	stats := Stats{StartedAt: time.Now(), KeyID: r.keys.Current()}
+	for stats.Err == nil {
+		select {
+		case <-r.done:
+			stats.Err = fmt.Errorf("interrupted by shutdown")
+			continue
+		default:
+		}
+		n, err := r.store.ReencryptMessages(batchSize)
+		stats.Reencrypted += n
+		stats.Err = err
+		if n < batchSize {
+			break
+		}
+	}
+	stats.Duration = time.Since(stats.StartedAt)
+
+	if stats.Err != nil {
+		r.logger.Error("Re-encryption stopped after %d messages: %v", stats.Reencrypted, stats.Err)
+	} else if stats.Reencrypted > 0 {
+		r.logger.Info("Re-encrypted %d messages with key %s in %s", stats.Reencrypted, stats.KeyID, stats.Duration)
+	}
+
+	r.mu.Lock()
+	r.running = false
+	r.lastRun = stats
+	r.mu.Unlock()
+	return stats
+}
+
+// Shutdown stops a running re-encryption after the current batch
+func (r *Rotator) Shutdown() {
+	close(r.done)
+}
+
+// Report describes the keys, how many messages use each one and the last run
+func (r *Rotator) Report() string {
+	r.mu.Lock()
+	running, last := r.running, r.lastRun
+	r.mu.Unlock()
+
+	current := r.keys.Current()
+	lines := []string{fmt.Sprintf("Message encryption (current key %s):", current)}
+	usage, err := r.store.KeyUsage()
+	if err != nil {
+		lines = append(lines, err.Error())
+	}
+	// Keys still referenced by messages but gone from the keyring are listed last
+	known := r.keys.IDs()
+	var missing []string
+	for id := range usage {
+		if id != "" && !contains(known, id) {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	for _, id := range append(known, missing...) {
+		status := "retired"
+		if id == current {
+			status = "current"
+		} else if !contains(known, id) {
+			status = "missing"
+		}
+		lines = append(lines, fmt.Sprintf("  %s  %-7s  %d messages", id, status, usage[id]))
+	}
+	if usage[""] > 0 {
+		lines = append(lines, fmt.Sprintf("  plaintext          %d messages", usage[""]))
+	}
+
+	switch {
+	case running:
+		lines = append(lines, "Re-encryption: running")
+	case last.StartedAt.IsZero():
+		lines = append(lines, "Re-encryption: never run")
+	case last.Err != nil:
+		lines = append(lines, fmt.Sprintf("Re-encryption: %s, stopped after %d messages: %v",
+			last.StartedAt.UTC().Format(database.TimeLayout), last.Reencrypted, last.Err))
+	default:
+		lines = append(lines, fmt.Sprintf("Re-encryption: %s, %d messages moved to key %s in %s",
+			last.StartedAt.UTC().Format(database.TimeLayout), last.Reencrypted, last.KeyID, last.Duration))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// contains reports whether ids includes id
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package retention
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/database"
+	"chat/pkg/logger"
+)
+
+// Policy limits how long one class of messages is kept
+type Policy struct {
+	MaxAge  time.Duration // Zero keeps messages regardless of age
+	MaxRows int           // Zero keeps messages regardless of count
+}
+
+// Enabled reports whether the policy removes anything
+func (p Policy) Enabled() bool {
+	return p.MaxAge > 0 || p.MaxRows > 0
+}
+
+// String describes the policy
+func (p Policy) String() string {
+	if !p.Enabled() {
+		return "keep forever"
+	}
+	var parts []string
+	if p.MaxAge > 0 {
+		parts = append(parts, fmt.Sprintf("max age %s", p.MaxAge))
+	}
+	if p.MaxRows > 0 {
+		parts = append(parts, fmt.Sprintf("max %d messages", p.MaxRows))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Stats describes a janitor run
+type Stats struct {
+	StartedAt      time.Time
+	Duration       time.Duration
+	PublicRemoved  int64
+	PrivateRemoved int64
+	Err            error
+}
+
+// Janitor periodically removes messages that fall outside the retention policies
+type Janitor struct {
+	store     database.Store
+	logger    *logger.Logger
+	public    Policy
+	private   Policy
+	interval  time.Duration
+	batchSize int
+	archive   bool
+	lastRun   Stats
+	runMu     sync.Mutex // Serializes runs
+	mu        sync.Mutex // Guards lastRun
+	done      chan struct{}
+}
+
+// NewJanitor creates a janitor from the retention settings in cfg
+func NewJanitor(cfg config.Config, logger *logger.Logger, store database.Store) *Janitor {
+	return &Janitor{
+		store:     store,
+		logger:    logger,
+		public:    Policy{MaxAge: cfg.RetentionMaxAge, MaxRows: cfg.RetentionMaxRows},
+		private:   Policy{MaxAge: cfg.PrivateRetentionMaxAge, MaxRows: cfg.PrivateRetentionMaxRows},
+		interval:  cfg.RetentionInterval,
+		batchSize: cfg.RetentionBatchSize,
+		archive:   cfg.RetentionArchive,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs the janitor until Shutdown is called
+func (j *Janitor) Start() {
+	if !j.public.Enabled() && !j.private.Enabled() {
+		j.logger.Info("Message retention disabled, keeping all messages")
+		return
+	}
+	j.logger.Info("Retention janitor started (public: %s; private: %s; every %s)", j.public, j.private, j.interval)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		j.Run()
+		select {
+		case <-ticker.C:
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// Shutdown stops the janitor
+func (j *Janitor) Shutdown() {
+	close(j.done)
+}
+
+// Run applies both policies once and returns the stats of the run
+func (j *Janitor) Run() Stats {
+	j.runMu.Lock()
+	defer j.runMu.Unlock()
+
+	stats := Stats{StartedAt: time.Now()}
+	stats.PublicRemoved, stats.Err = j.purge(false, j.public, stats.StartedAt)
+	if stats.Err == nil {
+		stats.PrivateRemoved, stats.Err = j.purge(true, j.private, stats.StartedAt)
+	}
+	if stats.Err == nil && stats.PublicRemoved+stats.PrivateRemoved > 0 {
+		stats.Err = j.store.Vacuum()
+	}
+	stats.Duration = time.Since(stats.StartedAt)
+
+	if stats.Err != nil {
+		j.logger.Error("Retention run failed: %v", stats.Err)
+	} else if stats.PublicRemoved+stats.PrivateRemoved > 0 {
+		j.logger.Info("Retention removed %d public and %d private messages in %s",
+			stats.PublicRemoved, stats.PrivateRemoved, stats.Duration)
+	}
+
+	j.mu.Lock()
+	j.lastRun = stats
+	j.mu.Unlock()
+	return stats
+}
+
+// purge removes expired messages of one class in batches
+func (j *Janitor) purge(private bool, policy Policy, now time.Time) (int64, error) {
+	if !policy.Enabled() {
+		return 0, nil
+	}
+	p := database.Purge{
+		Private: private,
+		Keep:    policy.MaxRows,
+		Limit:   j.batchSize,
+		Archive: j.archive,
+	}
+	if policy.MaxAge > 0 {
+		p.Before = now.Add(-policy.MaxAge)
+	}
+	var total int64
+	for {
+		select {
+		case <-j.done:
+			return total, nil
+		default:
+		}
+		n, err := j.store.PurgeMessages(p)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		if n < int64(j.batchSize) {
+			return total, nil
+		}
+	}
+}
+
+// Report describes the policies and the last run
+func (j *Janitor) Report() string {
+	j.mu.Lock()
+	last := j.lastRun
+	j.mu.Unlock()
+
+	action := "delete"
+	if j.archive {
+		action = "archive"
+	}
+	lines := []string{
+		fmt.Sprintf("Retention policy (%s expired messages every %s, batches of %d):", action, j.interval, j.batchSize),
+		"  Public:  " + j.public.String(),
+		"  Private: " + j.private.String(),
+	}
+	switch {
+	case last.StartedAt.IsZero():
+		lines = append(lines, "Last run: never")
+	case last.Err != nil:
+		lines = append(lines, fmt.Sprintf("Last run: %s, failed after %s: %v",
+			last.StartedAt.UTC().Format(database.TimeLayout), last.Duration, last.Err))
+	default:
+		lines = append(lines, fmt.Sprintf("Last run: %s, removed %d public and %d private messages in %s",
+			last.StartedAt.UTC().Format(database.TimeLayout), last.PublicRemoved, last.PrivateRemoved, last.Duration))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,422 @@
+package rudp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	window     = 64 // Segments in flight and buffered out of order per direction
+	initialRTO = 200 * time.Millisecond
+	minRTO     = 50 * time.Millisecond
+	maxRTO     = 3 * time.Second
+	maxRetries = 10
+	tick       = 20 * time.Millisecond // Retransmission timer resolution
+	closeWait  = 5 * time.Second       // How long Close waits for unacknowledged data
+)
+
+// Errors returned by sessions
+var (
+	ErrClosed      = errors.New("connection closed")
+	ErrReset       = errors.New("connection reset by peer")
+	ErrUnreachable = errors.New("peer stopped acknowledging data")
+	errTimeout     = timeoutError{}
+)
+
+// timeoutError is returned when a deadline passes, like net.Conn implementations do
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// segment is a sent data or FIN segment waiting for its acknowledgement
+type segment struct {
+	typ     byte
+	data    []byte
+	sentAt  time.Time
+	rto     time.Duration
+	retries int
+}
+
+// Conn is a reliable, ordered byte stream over UDP. It implements net.Conn.
+// A session is identified by its connection ID rather than the peer
+// address, so it survives the peer's NAT mapping changing.
+type Conn struct {
+	id      uint64
+	sock    net.PacketConn
+	onClose func() // Releases the socket or the listener entry
+
+	mu      sync.Mutex
+	cond    *sync.Cond // Signalled on data, acks, close and deadlines
+	remote  net.Addr
+	nextSeq uint32 // Seq of the next segment sent
+	unacked map[uint32]*segment
+	srtt    time.Duration // Smoothed round trip time, zero until measured
+	rto     time.Duration
+	lastAck uint32 // Highest cumulative ack received
+	dupAcks int    // Repeats of lastAck, a sign of a lost segment
+
+	expected   uint32 // Seq of the next segment delivered
+	outOfOrder map[uint32][]byte
+	readBuf    []byte
+	eof        bool // The peer's FIN was delivered
+
+	closing bool  // Close was called, no more writes
+	err     error // Set when the session ended
+	once    sync.Once
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// newConn creates a session with peer remote on sock
+func newConn(id uint64, sock net.PacketConn, remote net.Addr, onClose func()) *Conn {
+	c := &Conn{
+		id:         id,
+		sock:       sock,
+		onClose:    onClose,
+		remote:     remote,
+		nextSeq:    1,
+		unacked:    make(map[uint32]*segment),
+		rto:        initialRTO,
+		expected:   1,
+		outOfOrder: make(map[uint32][]byte),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	go c.retransmit()
+	return c
+}
+
+// ID returns the connection ID of the session
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// handle processes a packet of this session received from addr
+func (c *Conn) handle(h header, payload []byte, from net.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || h.typ == typeSyn || h.typ == typeSynAck {
+		return
+	}
+	if h.typ == typeReset {
+		// The connection ID travels in cleartext, so a reset from elsewhere may be forged
+		if sameAddr(c.remote, from) {
+			c.fail(ErrReset)
+		}
+		return
+	}
+
+	expected, lastAck := c.expected, c.lastAck
+	segment := h.typ == typeData || h.typ == typeFin
+	if segment {
+		c.receive(h, payload)
+	}
+	c.acknowledge(h.ack, h.typ == typeAck)
+	// Follow the peer to its new address after a NAT rebinding, but only for
+	// packets that make progress: stale duplicates and replays move nothing
+	if !sameAddr(c.remote, from) && (c.expected != expected || seqAfter(c.lastAck, lastAck)) {
+		c.remote = from
+	}
+	// Duplicates are acknowledged again, since the earlier ACK may have been lost
+	if segment {
+		c.send(header{typ: typeAck, seq: c.nextSeq, ack: c.expected}, nil)
+	}
+}
+
+// receive delivers a data or FIN segment or buffers it until the segments
+// before it arrive. Duplicates are dropped.
+func (c *Conn) receive(h header, payload []byte) {
+	switch {
+	case h.seq == c.expected:
+		c.deliver(h.typ, payload)
+		for {
+			data, ok := c.outOfOrder[c.expected]
+			if !ok {
+				break
+			}
+			delete(c.outOfOrder, c.expected)
+			if data == nil {
+				c.deliver(typeFin, nil)
+			} else {
+				c.deliver(typeData, data)
+			}
+		}
+		c.cond.Broadcast()
+	case seqAfter(h.seq, c.expected) && h.seq-c.expected < window:
+		if _, ok := c.outOfOrder[h.seq]; !ok {
+			if h.typ == typeFin {
+				c.outOfOrder[h.seq] = nil
+			} else {
+				c.outOfOrder[h.seq] = append([]byte{}, payload...)
+			}
+		}
+	}
+}
+
+// deliver appends the next in-order segment to the read buffer
+func (c *Conn) deliver(typ byte, payload []byte) {
+	c.expected++
+	if typ == typeFin {
+		c.eof = true
+		return
+	}
+	c.readBuf = append(c.readBuf, payload...)
+}
+
+// acknowledge drops the segments before ack and updates the RTO. The third
+// repeat of an ACK retransmits the missing segment without waiting for the
+// RTO, since the peer is receiving the segments after it.
+func (c *Conn) acknowledge(ack uint32, pure bool) {
+	if seqAfter(ack, c.lastAck) {
+		c.lastAck, c.dupAcks = ack, 0
+	} else if pure && ack == c.lastAck {
+		c.dupAcks++
+		if s, ok := c.unacked[ack]; ok && c.dupAcks == 3 {
+			s.retries++
+			s.sentAt = time.Now()
+			c.send(header{typ: s.typ, seq: ack, ack: c.expected}, s.data)
+		}
+	}
+
+	now := time.Now()
+	acked := false
+	for seq, s := range c.unacked {
+		if !seqAfter(ack, seq) {
+			continue
+		}
+		// Karn's algorithm: only segments sent once give a usable sample
+		if s.retries == 0 {
+			c.sample(now.Sub(s.sentAt))
+		}
+		delete(c.unacked, seq)
+		acked = true
+	}
+	if acked {
+		c.cond.Broadcast()
+	}
+}
+
+// sample adds a round trip time measurement
+func (c *Conn) sample(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+	} else {
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	c.rto = 2 * c.srtt
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// retransmit resends segments whose acknowledgement is overdue
+func (c *Conn) retransmit() {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.mu.Lock()
+		if c.err != nil {
+			c.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		for seq, s := range c.unacked {
+			if now.Sub(s.sentAt) < s.rto {
+				continue
+			}
+			if s.retries >= maxRetries {
+				c.fail(ErrUnreachable)
+				break
+			}
+			s.retries++
+			s.sentAt = now
+			s.rto *= 2
+			if s.rto > maxRTO {
+				s.rto = maxRTO
+			}
+			c.send(header{typ: s.typ, seq: seq, ack: c.expected}, s.data)
+		}
+		// A closing session ends once the peer has everything, FIN included
+		if c.err == nil && c.closing && len(c.unacked) == 0 {
+			c.fail(ErrClosed)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// queue sends a new segment and keeps it until acknowledged
+func (c *Conn) queue(typ byte, data []byte) {
+	seq := c.nextSeq
+	c.nextSeq++
+	c.unacked[seq] = &segment{typ: typ, data: data, sentAt: time.Now(), rto: c.rto}
+	c.send(header{typ: typ, seq: seq, ack: c.expected}, data)
+}
+
+// send writes a packet of this session to the peer
+func (c *Conn) send(h header, payload []byte) {
+	h.connID = c.id
+	c.sock.WriteTo(h.marshal(payload), c.remote)
+}
+
+// fail ends the session with err and releases its resources
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.cond.Broadcast()
+	c.once.Do(func() {
+		if c.onClose != nil {
+			go c.onClose()
+		}
+	})
+}
+
+// Read reads in-order data from the stream
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.readBuf) == 0 {
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.closing || c.err != nil:
+			return 0, c.closedErr()
+		case expired(c.readDeadline):
+			return 0, errTimeout
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write sends b as one or more segments, blocking while the window is full
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		for len(c.unacked) >= window {
+			if c.closing || c.err != nil {
+				return n, c.closedErr()
+			}
+			if expired(c.writeDeadline) {
+				return n, errTimeout
+			}
+			c.cond.Wait()
+		}
+		if c.closing || c.err != nil {
+			return n, c.closedErr()
+		}
+		if expired(c.writeDeadline) {
+			return n, errTimeout
+		}
+		end := n + maxPayload
+		if end > len(b) {
+			end = len(b)
+		}
+		c.queue(typeData, append([]byte{}, b[n:end]...))
+		n = end
+	}
+	return n, nil
+}
+
+// closedErr returns the error reported for operations on an ended session
+func (c *Conn) closedErr() error {
+	if c.err != nil && c.err != ErrClosed {
+		return c.err
+	}
+	return ErrClosed
+}
+
+// Close sends a FIN after the pending data. Delivery continues in the
+// background until the peer acknowledges it or stops responding.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing || c.err != nil {
+		return nil
+	}
+	c.closing = true
+	c.queue(typeFin, nil)
+	c.cond.Broadcast()
+	time.AfterFunc(closeWait, func() {
+		c.mu.Lock()
+		c.fail(ErrClosed)
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr returns the local address of the socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.sock.LocalAddr()
+}
+
+// RemoteAddr returns the address the peer was last seen at
+func (c *Conn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for Read calls
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.wakeAt(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write calls
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.wakeAt(t)
+	return nil
+}
+
+// wakeAt wakes blocked calls at t so they can check their deadline
+func (c *Conn) wakeAt(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	time.AfterFunc(time.Until(t), func() {
+		c.mu.Lock()
+		c.cond.Broadcast()
+		c.mu.Unlock()
+	})
+}
+
+// expired reports whether deadline is set and has passed
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+// sameAddr reports whether a and b are the same address
+func sameAddr(a, b net.Addr) bool {
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// seqAfter reports whether sequence number a comes after b, allowing for
+// the numbers wrapping around
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,282 @@
+package rudp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyConn drops, duplicates and reorders the datagrams written to it
+type lossyConn struct {
+	net.PacketConn
+	mu       sync.Mutex // Guards rng
+	rng      *rand.Rand
+	drop     float64       // Share of datagrams dropped
+	dup      float64       // Share of datagrams sent twice
+	maxDelay time.Duration // Datagrams are delayed up to this, which reorders them
+}
+
+// newLossyConn opens a lossy UDP socket on the loopback interface
+func newLossyConn(t *testing.T, seed int64) *lossyConn {
+	t.Helper()
+	sock, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyConn{
+		PacketConn: sock,
+		rng:        rand.New(rand.NewSource(seed)),
+		drop:       0.1,
+		dup:        0.1,
+		maxDelay:   5 * time.Millisecond,
+	}
+}
+
+// WriteTo sends b to addr after a random delay, unless it is dropped
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	l.mu.Lock()
+	copies := 1
+	if l.rng.Float64() < l.drop {
+		copies = 0
+	} else if l.rng.Float64() < l.dup {
+		copies = 2
+	}
+	delays := make([]time.Duration, copies)
+	for i := range delays {
+		delays[i] = time.Duration(l.rng.Int63n(int64(l.maxDelay)))
+	}
+	l.mu.Unlock()
+
+	p := append([]byte{}, b...)
+	for _, d := range delays {
+		time.AfterFunc(d, func() { l.PacketConn.WriteTo(p, addr) })
+	}
+	return len(b), nil
+}
+
+// recorder is a socket that records the packets written to it
+type recorder struct {
+	net.PacketConn // Nil, sessions under test only write
+	mu             sync.Mutex
+	sent           []header
+}
+
+// WriteTo records the header of the packet in b
+func (r *recorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	h, _, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	r.mu.Lock()
+	r.sent = append(r.sent, h)
+	r.mu.Unlock()
+	return len(b), nil
+}
+
+// last returns the last packet written
+func (r *recorder) last() header {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.sent) == 0 {
+		return header{}
+	}
+	return r.sent[len(r.sent)-1]
+}
+
+// addr returns a loopback UDP address with the given port
+func addr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+// testConn creates a session with peer addr(1) that is ended when the test finishes
+func testConn(t *testing.T) (*Conn, *recorder) {
+	t.Helper()
+	rec := &recorder{}
+	c := newConn(1, rec, addr(1), nil)
+	t.Cleanup(func() {
+		c.mu.Lock()
+		c.fail(ErrClosed)
+		c.mu.Unlock()
+	})
+	return c, rec
+}
+
+// data returns the header of a data segment
+func data(seq uint32) header {
+	return header{typ: typeData, connID: 1, seq: seq, ack: 1}
+}
+
+func TestSeqAfter(t *testing.T) {
+	tests := []struct {
+		a, b uint32
+		want bool
+	}{
+		{2, 1, true},
+		{1, 2, false},
+		{1, 1, false},
+		{0, math.MaxUint32, true},
+		{math.MaxUint32, 0, false},
+		{5, math.MaxUint32 - 5, true},
+	}
+	for _, tt := range tests {
+		if got := seqAfter(tt.a, tt.b); got != tt.want {
+			t.Errorf("seqAfter(%d, %d) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestReceiveReorderedAndDuplicated(t *testing.T) {
+	c, rec := testConn(t)
+
+	c.handle(data(3), []byte("c"), addr(1))
+	c.handle(data(2), []byte("b"), addr(1))
+	c.handle(data(2), []byte("x"), addr(1))
+	if ack := rec.last().ack; ack != 1 {
+		t.Errorf("ack = %d before the first segment arrived, want 1", ack)
+	}
+	c.handle(data(1), []byte("a"), addr(1))
+	c.handle(data(1), []byte("x"), addr(1))
+	c.handle(header{typ: typeFin, connID: 1, seq: 4, ack: 1}, nil, addr(1))
+	if ack := rec.last().ack; ack != 5 {
+		t.Errorf("ack = %d after the FIN, want 5", ack)
+	}
+
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "abc" {
+		t.Errorf("read %q, %v, want \"abc\"", got, err)
+	}
+}
+
+func TestReceiveAcrossWraparound(t *testing.T) {
+	c, _ := testConn(t)
+	c.expected = math.MaxUint32 - 1
+
+	c.handle(data(math.MaxUint32), []byte("b"), addr(1))
+	c.handle(data(0), []byte("c"), addr(1))
+	c.handle(data(math.MaxUint32-1), []byte("a"), addr(1))
+	// Seqs before expected are duplicates, not segments far in the future
+	c.handle(data(math.MaxUint32-2), []byte("x"), addr(1))
+	c.handle(header{typ: typeFin, connID: 1, seq: 1}, nil, addr(1))
+
+	got, err := io.ReadAll(c)
+	if err != nil || string(got) != "abc" {
+		t.Errorf("read %q, %v, want \"abc\"", got, err)
+	}
+}
+
+func TestAckAcrossWraparound(t *testing.T) {
+	c, _ := testConn(t)
+	c.nextSeq, c.lastAck = math.MaxUint32-1, math.MaxUint32-1
+	for _, b := range []string{"a", "b", "c"} {
+		if _, err := c.Write([]byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.handle(header{typ: typeAck, connID: 1, ack: 0}, nil, addr(1))
+	c.mu.Lock()
+	_, pending := c.unacked[0]
+	left := len(c.unacked)
+	c.mu.Unlock()
+	if left != 1 || !pending {
+		t.Errorf("%d segments unacknowledged after ack 0, want only seq 0", left)
+	}
+
+	c.handle(header{typ: typeAck, connID: 1, ack: 1}, nil, addr(1))
+	// A stale ack from before the wraparound acknowledges nothing again
+	c.handle(header{typ: typeAck, connID: 1, ack: math.MaxUint32}, nil, addr(1))
+	c.mu.Lock()
+	left, lastAck := len(c.unacked), c.lastAck
+	c.mu.Unlock()
+	if left != 0 || lastAck != 1 {
+		t.Errorf("%d segments unacknowledged and lastAck %d after ack 1, want none and 1", left, lastAck)
+	}
+}
+
+func TestRemoteMovesOnlyOnProgress(t *testing.T) {
+	c, _ := testConn(t)
+
+	c.handle(data(1), []byte("a"), addr(2))
+	if got := c.RemoteAddr().String(); got != addr(2).String() {
+		t.Fatalf("remote = %s after new data, want %s", got, addr(2))
+	}
+
+	// Replays of old packets and forged resets come from anywhere
+	c.handle(data(1), []byte("a"), addr(3))
+	c.handle(header{typ: typeAck, connID: 1, ack: 1}, nil, addr(3))
+	c.handle(header{typ: typeReset, connID: 1}, nil, addr(3))
+	if got := c.RemoteAddr().String(); got != addr(2).String() {
+		t.Errorf("remote = %s after stale packets, want %s", got, addr(2))
+	}
+	c.mu.Lock()
+	err := c.err
+	c.mu.Unlock()
+	if err != nil {
+		t.Fatalf("a reset from another address ended the session: %v", err)
+	}
+
+	c.handle(header{typ: typeReset, connID: 1}, nil, addr(2))
+	c.mu.Lock()
+	err = c.err
+	c.mu.Unlock()
+	if !errors.Is(err, ErrReset) {
+		t.Errorf("session ended with %v after a reset from the peer, want %v", err, ErrReset)
+	}
+}
+
+func TestLossyTransfer(t *testing.T) {
+	ln := NewListener(newLossyConn(t, 1))
+	defer ln.Close()
+	c, err := DialPacket(newLossyConn(t, 2), ln.Addr(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	deadline := time.Now().Add(20 * time.Second)
+	c.SetDeadline(deadline)
+	s.SetDeadline(deadline)
+
+	payload := make([]byte, 100*1024)
+	rand.New(rand.NewSource(3)).Read(payload)
+	for _, dir := range []struct {
+		name     string
+		from, to net.Conn
+	}{
+		{"client to server", c, s},
+		{"server to client", s, c},
+	} {
+		errs := make(chan error, 1)
+		go func() {
+			_, err := dir.from.Write(payload)
+			errs <- err
+		}()
+		got := make([]byte, len(payload))
+		if _, err := io.ReadFull(dir.to, got); err != nil {
+			t.Fatalf("%s: read failed: %v", dir.name, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("%s: write failed: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, payload) {
+			t.Fatalf("%s: the stream arrived corrupted", dir.name)
+		}
+	}
+
+	// The FIN survives the same losses
+	c.Close()
+	if _, err := s.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read after the peer closed returned %v, want EOF", err)
+	}
+}
@@ -0,0 +1,238 @@
+package rudp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	backlog     = 128  // Sessions waiting for Accept
+	maxSessions = 4096 // Sessions per listener
+	synInterval = 250 * time.Millisecond
+)
+
+// Listener accepts sessions on one UDP socket. It implements net.Listener.
+type Listener struct {
+	sock     net.PacketConn
+	sessions map[uint64]*Conn
+	mu       sync.Mutex // Guards sessions
+	accept   chan *Conn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Listen opens a listener on the UDP address addr
+func Listen(addr string) (*Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", addr, err)
+	}
+	sock, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	return NewListener(sock), nil
+}
+
+// NewListener accepts sessions on sock, which it closes when closed
+func NewListener(sock net.PacketConn) *Listener {
+	l := &Listener{
+		sock:     sock,
+		sessions: make(map[uint64]*Conn),
+		accept:   make(chan *Conn, backlog),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+// Accept waits for the next session
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the listener and resets its sessions
+func (l *Listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.mu.Lock()
+		for _, c := range l.sessions {
+			c.send(header{typ: typeReset}, nil)
+			c.mu.Lock()
+			c.onClose = nil
+			c.fail(ErrClosed)
+			c.mu.Unlock()
+		}
+		l.sessions = make(map[uint64]*Conn)
+		l.mu.Unlock()
+		l.sock.Close()
+	})
+	return nil
+}
+
+// Addr returns the local address of the listener
+func (l *Listener) Addr() net.Addr {
+	return l.sock.LocalAddr()
+}
+
+// serve dispatches packets to sessions by connection ID
+func (l *Listener) serve() {
+	buf := make([]byte, MaxPacketSize)
+	for {
+		n, from, err := l.sock.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+		h, payload, err := parse(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		l.mu.Lock()
+		c, ok := l.sessions[h.connID]
+		if !ok && h.typ == typeSyn {
+			c = l.open(h.connID, from)
+		}
+		l.mu.Unlock()
+
+		switch {
+		case c == nil:
+			// The session ended or the server restarted; tell the peer
+			if h.typ != typeReset && h.typ != typeSyn {
+				l.sock.WriteTo(header{typ: typeReset, connID: h.connID}.marshal(nil), from)
+			}
+		case h.typ == typeSyn:
+			// The SYNACK may have been lost, so answer every SYN
+			c.send(header{typ: typeSynAck}, nil)
+		default:
+			c.handle(h, payload, from)
+		}
+	}
+}
+
+// open creates a session for a SYN and queues it for Accept. It returns
+// nil when the listener is full. l.mu must be held.
+func (l *Listener) open(id uint64, from net.Addr) *Conn {
+	if len(l.sessions) >= maxSessions {
+		return nil
+	}
+	c := newConn(id, l.sock, from, func() {
+		l.mu.Lock()
+		delete(l.sessions, id)
+		l.mu.Unlock()
+	})
+	select {
+	case l.accept <- c:
+	default:
+		c.mu.Lock()
+		c.onClose = nil
+		c.fail(ErrClosed)
+		c.mu.Unlock()
+		return nil
+	}
+	l.sessions[id] = c
+	return c
+}
+
+// Dial opens a session with the listener at addr
+func Dial(addr string, timeout time.Duration) (*Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", addr, err)
+	}
+	sock, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+	return DialPacket(sock, remote, timeout)
+}
+
+// DialPacket opens a session over sock with the listener at remote. The
+// session owns sock and closes it when it ends.
+func DialPacket(sock net.PacketConn, remote net.Addr, timeout time.Duration) (*Conn, error) {
+	addr := remote.String()
+	id, err := newConnID()
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	syn := header{typ: typeSyn, connID: id}.marshal(nil)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, MaxPacketSize)
+	for {
+		if !time.Now().Before(deadline) {
+			sock.Close()
+			return nil, fmt.Errorf("failed to connect to %s: no answer within %v", addr, timeout)
+		}
+		if _, err := sock.WriteTo(syn, remote); err != nil {
+			sock.Close()
+			return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+		}
+		wait := time.Now().Add(synInterval)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		sock.SetReadDeadline(wait)
+		if answered(sock, buf, id) {
+			break
+		}
+	}
+	sock.SetReadDeadline(time.Time{})
+
+	c := newConn(id, sock, remote, func() { sock.Close() })
+	go func() {
+		for {
+			n, from, err := sock.ReadFrom(buf)
+			if err != nil {
+				c.mu.Lock()
+				c.fail(ErrClosed)
+				c.mu.Unlock()
+				return
+			}
+			h, payload, err := parse(buf[:n])
+			if err != nil || h.connID != id || h.typ == typeSyn || h.typ == typeSynAck {
+				continue
+			}
+			c.handle(h, payload, from)
+		}
+	}()
+	return c, nil
+}
+
+// answered reads until the read deadline and reports whether the SYNACK for id arrived
+func answered(sock net.PacketConn, buf []byte, id uint64) bool {
+	for {
+		n, _, err := sock.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		h, _, err := parse(buf[:n])
+		if err == nil && h.connID == id && h.typ == typeSynAck {
+			return true
+		}
+	}
+}
+
+// newConnID returns a random connection ID, hard to guess for other hosts
+func newConnID() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("failed to generate connection ID: %v", err)
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
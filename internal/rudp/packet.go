@@ -0,0 +1,73 @@
+package rudp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Packet types
+const (
+	typeSyn    byte = 1 // Client opens a session
+	typeSynAck byte = 2 // Server accepts a session
+	typeData   byte = 3 // A segment of the byte stream
+	typeAck    byte = 4 // Cumulative acknowledgement
+	typeFin    byte = 5 // Sender has no more data, sequenced like a segment
+	typeReset  byte = 6 // Receiver does not know the connection ID
+)
+
+const (
+	magic      byte = 'R'
+	version    byte = 1
+	headerSize      = 19
+
+	// MaxPacketSize keeps datagrams under the path MTU
+	MaxPacketSize = 1200
+
+	// maxPayload is the largest segment of the byte stream
+	maxPayload = MaxPacketSize - headerSize
+)
+
+// errMalformed is returned for datagrams that are not session packets
+var errMalformed = errors.New("malformed packet")
+
+// header precedes every packet:
+//
+//	magic(1) version(1) type(1) connection ID(8) seq(4) ack(4)
+//
+// seq numbers data and FIN segments; ack is the next seq the sender expects.
+type header struct {
+	typ    byte
+	connID uint64
+	seq    uint32
+	ack    uint32
+}
+
+// marshal returns the packet carrying h and payload
+func (h header) marshal(payload []byte) []byte {
+	b := make([]byte, headerSize+len(payload))
+	b[0] = magic
+	b[1] = version
+	b[2] = h.typ
+	binary.BigEndian.PutUint64(b[3:], h.connID)
+	binary.BigEndian.PutUint32(b[11:], h.seq)
+	binary.BigEndian.PutUint32(b[15:], h.ack)
+	copy(b[headerSize:], payload)
+	return b
+}
+
+// parse splits a datagram into header and payload
+func parse(b []byte) (header, []byte, error) {
+	if len(b) < headerSize || b[0] != magic || b[1] != version {
+		return header{}, nil, errMalformed
+	}
+	h := header{
+		typ:    b[2],
+		connID: binary.BigEndian.Uint64(b[3:]),
+		seq:    binary.BigEndian.Uint32(b[11:]),
+		ack:    binary.BigEndian.Uint32(b[15:]),
+	}
+	if h.typ < typeSyn || h.typ > typeReset {
+		return header{}, nil, errMalformed
+	}
+	return h, b[headerSize:], nil
+}
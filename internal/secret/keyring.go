@@ -0,0 +1,243 @@
+package secret
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned when data was sealed with a key that is not in the keyring
+var ErrUnknownKey = errors.New("unknown key ID")
+
+// keyFileCheckInterval limits how often Seal looks for a newer key file
+const keyFileCheckInterval = time.Second
+
+// Keyring holds master keys by ID. New data is sealed with the current key,
+// older keys are kept so existing data can still be opened.
+type Keyring struct {
+	path    string // Key file, empty if the keys came from the environment
+	current string
+	ids     []string // Current key first
+	boxes   map[string]*Box
+	modTime time.Time // Of the key file when it was last read
+	size    int64
+	checked time.Time // Last time the key file was checked for changes
+	mu      sync.RWMutex
+}
+
+// LoadKeyring parses keys from encoded if set, otherwise reads them from path.
+// A key file with one new key is created if it does not exist.
+//
+// encoded is a comma separated list of id:base64key pairs. The key file has
+// one "id base64key" pair per line. In both the first key is the current one.
+func LoadKeyring(encoded, path string) (*Keyring, error) {
+	if encoded != "" {
+		return parseKeyring(strings.Split(encoded, ","), ":")
+	}
+
+	k := &Keyring{path: path}
+	if err := k.reload(); errors.Is(err, os.ErrNotExist) {
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// parseKeyring builds a keyring from id/key pairs split by sep
+func parseKeyring(entries []string, sep string) (*Keyring, error) {
+	k := &Keyring{boxes: make(map[string]*Box)}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, found := strings.Cut(entry, sep)
+		id = strings.TrimSpace(id)
+		if !found || id == "" {
+			return nil, fmt.Errorf("invalid message key entry, expected id%sbase64key", sep)
+		}
+		if _, exists := k.boxes[id]; exists {
+			return nil, fmt.Errorf("duplicate message key %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message key %q: %v", id, err)
+		}
+		box, err := New(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message key %q: %v", id, err)
+		}
+		k.ids = append(k.ids, id)
+		k.boxes[id] = box
+	}
+	if len(k.ids) == 0 {
+		return nil, fmt.Errorf("no message keys configured")
+	}
+	k.current = k.ids[0]
+	return k, nil
+}
+
+// reload reads the key file again
+func (k *Keyring) reload() error {
+	f, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to read message keys: %v", err)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read message keys: %v", err)
+	}
+	loaded, err := parseKeyring(lines, " ")
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	k.current, k.ids, k.boxes = loaded.current, loaded.ids, loaded.boxes
+	k.modTime, k.size = info.ModTime(), info.Size()
+	k.mu.Unlock()
+	return nil
+}
+
+// refresh reads the key file again if another process changed it, so a
+// `keys rotate` run beside the server takes effect for new data
+func (k *Keyring) refresh() {
+	if k.path == "" {
+		return
+	}
+	now := time.Now()
+	k.mu.Lock()
+	if now.Sub(k.checked) < keyFileCheckInterval {
+		k.mu.Unlock()
+		return
+	}
+	k.checked = now
+	modTime, size := k.modTime, k.size
+	k.mu.Unlock()
+
+	info, err := os.Stat(k.path)
+	if err != nil || (info.ModTime().Equal(modTime) && info.Size() == size) {
+		return
+	}
+	// A file that cannot be read leaves the loaded keys in use, the
+	// current key is still valid and Open reports the error if it matters
+	k.reload()
+}
+
+// Current returns the ID of the key used for new data
+func (k *Keyring) Current() string {
+	k.refresh()
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// IDs returns all key IDs, current first
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]string(nil), k.ids...)
+}
+
+// Seal encrypts plaintext bound to data with the current key and returns the key ID
+func (k *Keyring) Seal(plaintext string, data []byte) (string, string, error) {
+	k.refresh()
+	k.mu.RLock()
+	id, box := k.current, k.boxes[k.current]
+	k.mu.RUnlock()
+	sealed, err := box.SealWith(plaintext, data)
+	return id, sealed, err
+}
+
+// Open decrypts a value sealed with key id. An unknown key causes the key
+// file to be read again, in case another process rotated the keys.
+func (k *Keyring) Open(id, sealed string, data []byte) (string, error) {
+	k.mu.RLock()
+	box, ok := k.boxes[id]
+	k.mu.RUnlock()
+	if !ok && k.path != "" {
+		if err := k.reload(); err != nil {
+			return "", err
+		}
+		k.mu.RLock()
+		box, ok = k.boxes[id]
+		k.mu.RUnlock()
+	}
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	return box.OpenWith(sealed, data)
+}
+
+// Rotate generates a new current key, saves it to the key file and returns its ID.
+// Previous keys are kept for opening existing data.
+func (k *Keyring) Rotate() (string, error) {
+	if k.path == "" {
+		return "", fmt.Errorf("keys from the environment cannot be rotated, add a new key to MESSAGE_KEYS instead")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate message key: %v", err)
+	}
+	idBytes := make([]byte, 4)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", fmt.Errorf("failed to generate message key ID: %v", err)
+	}
+	id := hex.EncodeToString(idBytes)
+
+	// Keys added to the file by another process are kept. The new file is
+	// written beside the old one and renamed so a crash never loses keys.
+	lines := []string{"# Message keys, one \"id base64key\" per line. The first key encrypts new messages."}
+	lines = append(lines, id+" "+base64.StdEncoding.EncodeToString(key))
+	if existing, err := os.ReadFile(k.path); err == nil {
+		for _, line := range strings.Split(string(existing), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read message keys: %v", err)
+	}
+	loaded, err := parseKeyring(lines, " ")
+	if err != nil {
+		return "", err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write message keys: %v", err)
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write message keys: %v", err)
+	}
+
+	k.current, k.ids, k.boxes = loaded.current, loaded.ids, loaded.boxes
+	if info, err := os.Stat(k.path); err == nil {
+		k.modTime, k.size = info.ModTime(), info.Size()
+	}
+	return id, nil
+}
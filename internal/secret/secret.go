@@ -0,0 +1,112 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the size of the AES-256 key in bytes
+const KeySize = 32
+
+// ErrInvalidCiphertext is returned when sealed data cannot be opened
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// Box seals and opens small values with AES-GCM
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New creates a new box from a raw key
+func New(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return &Box{aead: aead}, nil
+}
+
+// LoadKey returns the base64 key from encoded if set, otherwise reads it from path.
+// A new key is generated and written to path if the file does not exist.
+func LoadKey(encoded, path string) ([]byte, error) {
+	if encoded == "" {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return generateKey(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret key: %v", err)
+		}
+		encoded = string(data)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode secret key: %v", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("secret key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
+
+// generateKey creates a random key and stores it at path
+func generateKey(path string) ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate secret key: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key) + "\n"
+	if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write secret key: %v", err)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext and returns it base64 encoded with the nonce prepended
+func (b *Box) Seal(plaintext string) (string, error) {
+	return b.SealWith(plaintext, nil)
+}
+
+// SealWith is like Seal but binds the result to data, which must be passed to OpenWith
+func (b *Box) SealWith(plaintext string, data []byte) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), data)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal
+func (b *Box) Open(sealed string) (string, error) {
+	return b.OpenWith(sealed, nil)
+}
+
+// OpenWith decrypts a value produced by SealWith with the same data
+func (b *Box) OpenWith(sealed string, data []byte) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	size := b.aead.NonceSize()
+	if len(raw) < size {
+		return "", ErrInvalidCiphertext
+	}
+	plaintext, err := b.aead.Open(nil, raw[:size], raw[size:], data)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plaintext), nil
+}
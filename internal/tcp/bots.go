@@ -0,0 +1,131 @@
+package tcp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"chat/internal/bot"
+	"chat/internal/command"
+	"chat/internal/message"
+	"chat/internal/presence"
+)
+
+// botQueueSize is how many messages wait for a busy bot before new ones
+// are dropped
+const botQueueSize = 64
+
+// runningBot is a bot with the queue of messages its goroutine handles in order
+type runningBot struct {
+	bot   bot.Bot
+	inbox chan bot.Message
+}
+
+// AddBot brings an in-process bot online. Its name must be listed in
+// BOT_USERS and not in use; commands of a bot.Commander are registered too.
+// Each bot handles its messages on a goroutine of its own, so a slow bot
+// delays neither the others nor the delivery to users.
+func (s *Server) AddBot(b bot.Bot) error {
+	name := b.Name()
+	if !s.cfg.IsBot(name) {
+		return fmt.Errorf("bot %s is not listed in BOT_USERS", name)
+	}
+
+	s.usersMu.Lock()
+	_, online := s.users[name]
+	_, running := s.bots[name]
+	if online || running {
+		s.usersMu.Unlock()
+		return fmt.Errorf("bot %s: %v", name, ErrUsernameTaken)
+	}
+	rb := &runningBot{bot: b, inbox: make(chan bot.Message, botQueueSize)}
+	s.bots[name] = rb
+	s.usersMu.Unlock()
+
+	var cmds []command.Command
+	if c, ok := b.(bot.Commander); ok {
+		cmds = c.Commands()
+	}
+	if err := s.commands.RegisterAll(cmds); err != nil {
+		s.usersMu.Lock()
+		delete(s.bots, name)
+		s.usersMu.Unlock()
+		return fmt.Errorf("bot %s: %v", name, err)
+	}
+	go s.runBot(rb)
+	s.presence.Publish(presence.Event{Type: presence.Join, User: name})
+	s.logger.Info("Bot %s started with %d commands", name, len(cmds))
+	return nil
+}
+
+// deliverToBots queues msg for the bots that subscribe to it. Messages from
+// bot accounts are not delivered so that bots cannot answer each other
+// forever. It never blocks; a message for a bot whose queue is full is dropped.
+func (s *Server) deliverToBots(msg message.Message) {
+	if msg.From == "" || s.cfg.IsBot(msg.From) {
+		return
+	}
+	s.usersMu.Lock()
+	var targets []*runningBot
+	switch msg.Type {
+	case message.TypeUser:
+		for _, rb := range s.bots {
+			targets = append(targets, rb)
+		}
+	case message.TypePrivate:
+		if rb, ok := s.bots[msg.Target]; ok {
+			targets = append(targets, rb)
+		}
+	}
+	s.usersMu.Unlock()
+
+	in := bot.Message{
+		From:    msg.From,
+		Room:    msg.Room,
+		Text:    msg.Text(),
+		Private: msg.Type == message.TypePrivate,
+		Time:    time.Now(),
+	}
+	for _, rb := range targets {
+		select {
+		case rb.inbox <- in:
+		default:
+			s.logger.Error("Bot %s is too busy, dropped a message from %s", rb.bot.Name(), msg.From)
+		}
+	}
+}
+
+// runBot passes queued messages to a bot until the server shuts down
+func (s *Server) runBot(rb *runningBot) {
+	for {
+		select {
+		case msg := <-rb.inbox:
+			s.handleBotMessage(rb.bot, msg)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// handleBotMessage calls a bot's handler, keeping the server up if it panics
+func (s *Server) handleBotMessage(b bot.Bot, msg bot.Message) {
+	name := b.Name()
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger.Error("Bot %s panicked handling a message from %s: %v", name, msg.From, r)
+		}
+	}()
+	b.HandleMessage(msg, func(text string) {
+		// The chat protocol is line based, so each line of an answer is a message of its own
+		for _, line := range strings.Split(text, "\n") {
+			line = strings.TrimSpace(line)
+			switch {
+			case line == "":
+			case msg.Private:
+				s.Post(name, msg.From, line)
+			default:
+				s.PostRoom(name, msg.Room, line)
+			}
+		}
+	})
+}
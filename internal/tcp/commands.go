@@ -0,0 +1,137 @@
+package tcp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"chat/internal/command"
+	"chat/internal/message"
+)
+
+// registerCommands adds the built-in commands to the registry
+func (s *Server) registerCommands() {
+	builtins := []command.Command{
+		{Name: "pm", Usage: "<username> <message>", Description: "Send a private message", Handler: s.handlePM},
+		{Name: "history", Description: "Show recent messages again", Handler: s.handleHistory},
+		{Name: "users", Description: "List online users and their statuses", Handler: s.handleUsers},
+		{Name: "status", Usage: "[text]", Description: "Set your status, or clear it", Handler: func(ctx *command.Context) error {
+			return s.handleStatus(ctx.Caller, ctx.Input)
+		}},
+		{Name: "udp", Usage: "<port>", Description: "Receive presence updates on a UDP port", Handler: func(ctx *command.Context) error {
+			if len(ctx.Args) != 1 {
+				return fmt.Errorf("ERR004: /udp requires a port")
+			}
+			return s.handleUDP(ctx.Caller, ctx.Args[0])
+		}},
+		{Name: "2fa", Usage: "enable|confirm <code>|disable <code>", Description: "Manage two-factor authentication", Handler: func(ctx *command.Context) error {
+			return s.handleTwoFactor(ctx.Caller, ctx.Args)
+		}},
+		{Name: "retention", Usage: "[run]", Description: "Show or run message retention", Permission: command.Admin, Handler: s.handleRetention},
+		{Name: "backup", Usage: "[run]", Description: "Show or take database backups", Permission: command.Admin, Handler: s.handleBackup},
+		{Name: "keys", Usage: "[rotate]", Description: "Show or rotate message encryption keys", Permission: command.Admin, Handler: s.handleKeys},
+		{Name: "kick", Usage: "<username> [reason]", Description: "End a user's session", Permission: command.Admin, Handler: func(ctx *command.Context) error {
+			if len(ctx.Args) < 1 {
+				return fmt.Errorf("ERR004: /kick requires a username")
+			}
+			return s.handleKick(ctx.Caller, ctx.Args[0], strings.Join(ctx.Args[1:], " "))
+		}},
+		{Name: "export", Usage: "[jsonl|csv|mbox] [user=name] [room=name] [since=time] [until=time]", Description: "Export history to the export directory", Permission: command.Admin, Handler: func(ctx *command.Context) error {
+			return s.handleExport(ctx.Caller, ctx.Args, ctx.Time)
+		}},
+		{Name: "import", Usage: "<file>", Description: "Import an export from the export directory", Permission: command.Admin, Handler: func(ctx *command.Context) error {
+			if len(ctx.Args) != 1 {
+				return fmt.Errorf("ERR004: /import requires a file name in the export directory")
+			}
+			return s.handleImport(ctx.Caller, ctx.Args[0])
+		}},
+	}
+	builtins = append(builtins, s.roomCommands()...)
+	for _, cmd := range builtins {
+		if err := s.commands.Register(cmd); err != nil {
+			s.logger.Error("Failed to register /%s: %v", cmd.Name, err)
+		}
+	}
+}
+
+// handlePM sends a private message
+func (s *Server) handlePM(ctx *command.Context) error {
+	if len(ctx.Args) < 2 {
+		return fmt.Errorf("ERR004: /pm requires username and message")
+	}
+	msg := message.NewPrivateMessage(ctx.Caller, ctx.Args[0], strings.Join(ctx.Args[1:], " "))
+	s.msgChan <- msg
+	s.history.Add(msg, ctx.Time)
+	return nil
+}
+
+// handleHistory replays the message history to the caller
+func (s *Server) handleHistory(ctx *command.Context) error {
+	lines := s.historyFor(ctx.Caller)
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if conn, exists := s.users[ctx.Caller]; exists {
+		for _, msg := range lines {
+			conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
+			conn.Write([]byte(msg + "\n"))
+		}
+	}
+	return nil
+}
+
+// handleUsers lists online users with their statuses
+func (s *Server) handleUsers(ctx *command.Context) error {
+	statuses := s.GetStatuses()
+	users := s.GetUsers()
+	sort.Strings(users)
+	for i, user := range users {
+		if status := statuses[user]; status != "" {
+			users[i] = fmt.Sprintf("%s (%s)", user, status)
+		}
+	}
+	ctx.Reply(fmt.Sprintf("Online users: %s", strings.Join(users, ", ")))
+	return nil
+}
+
+// handleRetention reports the retention janitor, running it first with /retention run
+func (s *Server) handleRetention(ctx *command.Context) error {
+	if s.janitor == nil {
+		return fmt.Errorf("ERR011: retention is not configured")
+	}
+	if len(ctx.Args) > 0 && ctx.Args[0] == "run" {
+		s.janitor.Run()
+	}
+	ctx.Reply(s.janitor.Report())
+	return nil
+}
+
+// handleBackup reports backups, taking one first with /backup run
+func (s *Server) handleBackup(ctx *command.Context) error {
+	if s.backups == nil {
+		return fmt.Errorf("ERR014: this database does not support online backups")
+	}
+	if len(ctx.Args) > 0 && ctx.Args[0] == "run" {
+		if stats := s.backups.Run(); stats.Err != nil {
+			return fmt.Errorf("ERR015: backup failed: %v", stats.Err)
+		}
+	}
+	ctx.Reply(s.backups.Report())
+	return nil
+}
+
+// handleKeys reports message keys, rotating first with /keys rotate
+func (s *Server) handleKeys(ctx *command.Context) error {
+	if s.rotator == nil {
+		return fmt.Errorf("ERR016: message encryption is not enabled")
+	}
+	if len(ctx.Args) > 0 && ctx.Args[0] == "rotate" {
+		id, err := s.rotator.Rotate()
+		if err != nil {
+			return fmt.Errorf("ERR017: key rotation failed: %v", err)
+		}
+		ctx.Reply(message.NewSystemMessage(fmt.Sprintf("New message key %s, re-encrypting stored messages in the background", id)).String())
+	}
+	ctx.Reply(s.rotator.Report())
+	return nil
+}
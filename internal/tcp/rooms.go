@@ -0,0 +1,309 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"chat/internal/command"
+	"chat/internal/message"
+)
+
+// Lobby is the name users give the default room, which is stored without one
+const Lobby = "lobby"
+
+// maxRoomName is the longest room name
+const maxRoomName = 32
+
+// Errors returned by room commands
+var (
+	ErrInvalidRoom = errors.New("ERR030: room names are 1 to 32 lowercase letters, digits, - or _")
+	ErrNotInRoom   = errors.New("ERR031: you are not in that room")
+	ErrLeaveLobby  = errors.New("ERR032: everyone stays in #lobby")
+	ErrNoRoom      = errors.New("ERR034: no such room")
+)
+
+// ParseRoom returns the stored name of a room given as name or #name.
+// The lobby is the default room and stored as the empty name.
+func ParseRoom(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(name, "#"))
+	if name == Lobby {
+		return "", nil
+	}
+	if name == "" || len(name) > maxRoomName {
+		return "", ErrInvalidRoom
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return "", ErrInvalidRoom
+		}
+	}
+	return name, nil
+}
+
+// RoomName returns the name users see for a stored room name
+func RoomName(room string) string {
+	if room == "" {
+		return "#" + Lobby
+	}
+	return "#" + room
+}
+
+// roomCommands returns the built-in commands for rooms
+func (s *Server) roomCommands() []command.Command {
+	return []command.Command{
+		{Name: "join", Usage: "<room>", Description: "Join a room, creating it if needed, and talk in it", Handler: s.handleJoin},
+		{Name: "part", Usage: "[room]", Description: "Leave a room, by default the one you talk in", Handler: s.handlePart},
+		{Name: "rooms", Description: "List rooms and their members", Handler: s.handleRooms},
+		{Name: "say", Usage: "<room> <message>", Description: "Send a message to a room you are in", Handler: s.handleSay},
+	}
+}
+
+// handleJoin adds the caller to a room and makes it the one plain text goes to
+func (s *Server) handleJoin(ctx *command.Context) error {
+	if len(ctx.Args) != 1 {
+		return fmt.Errorf("ERR004: /join requires a room")
+	}
+	room, err := ParseRoom(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+	if room != "" {
+		if err := s.ensureRoom(room, ctx.Caller, ctx.Time); err != nil {
+			return err
+		}
+	}
+
+	s.usersMu.Lock()
+	if _, online := s.users[ctx.Caller]; !online {
+		s.usersMu.Unlock()
+		return nil
+	}
+	joined := room != "" && !s.rooms[room][ctx.Caller]
+	if joined {
+		if s.rooms[room] == nil {
+			s.rooms[room] = make(map[string]bool)
+		}
+		s.rooms[room][ctx.Caller] = true
+	}
+	s.current[ctx.Caller] = room
+	s.usersMu.Unlock()
+
+	if joined {
+		s.post(message.NewSystemMessage(fmt.Sprintf("%s joined %s", ctx.Caller, RoomName(room))).InRoom(room), ctx.Time)
+	}
+	ctx.Reply(message.NewSystemMessage("You are now talking in " + RoomName(room)).String())
+	return nil
+}
+
+// ensureRoom creates room in the store unless it exists
+func (s *Server) ensureRoom(room, creator string, now time.Time) error {
+	rooms, err := s.store.ListRooms()
+	if err != nil {
+		return fmt.Errorf("ERR033: failed to look up rooms: %v", err)
+	}
+	for _, r := range rooms {
+		if r.Name == room {
+			return nil
+		}
+	}
+	if err := s.store.CreateRoom(room, creator, now); err != nil {
+		// Another user may have created it in the meantime
+		if rooms, lerr := s.store.ListRooms(); lerr == nil {
+			for _, r := range rooms {
+				if r.Name == room {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("ERR033: failed to create room: %v", err)
+	}
+	s.logger.Info("%s created room %s", creator, RoomName(room))
+	return nil
+}
+
+// handlePart removes the caller from a room. Leaving the room the caller
+// talks in moves them back to the lobby.
+func (s *Server) handlePart(ctx *command.Context) error {
+	s.usersMu.Lock()
+	room := s.current[ctx.Caller]
+	s.usersMu.Unlock()
+	if len(ctx.Args) > 0 {
+		var err error
+		if room, err = ParseRoom(ctx.Args[0]); err != nil {
+			return err
+		}
+	}
+	if room == "" {
+		return ErrLeaveLobby
+	}
+
+	s.usersMu.Lock()
+	if !s.rooms[room][ctx.Caller] {
+		s.usersMu.Unlock()
+		return ErrNotInRoom
+	}
+	delete(s.rooms[room], ctx.Caller)
+	if len(s.rooms[room]) == 0 {
+		delete(s.rooms, room)
+	}
+	if s.current[ctx.Caller] == room {
+		s.current[ctx.Caller] = ""
+	}
+	s.usersMu.Unlock()
+
+	ctx.Reply(message.NewSystemMessage(fmt.Sprintf("You left %s", RoomName(room))).String())
+	s.post(message.NewSystemMessage(fmt.Sprintf("%s left %s", ctx.Caller, RoomName(room))).InRoom(room), ctx.Time)
+	return nil
+}
+
+// handleRooms lists the lobby and the stored rooms with their members
+func (s *Server) handleRooms(ctx *command.Context) error {
+	rooms, err := s.store.ListRooms()
+	if err != nil {
+		return fmt.Errorf("ERR033: failed to look up rooms: %v", err)
+	}
+	s.usersMu.Lock()
+	current := s.current[ctx.Caller]
+	s.usersMu.Unlock()
+
+	lines := []string{"Rooms:"}
+	names := []string{""}
+	for _, r := range rooms {
+		names = append(names, r.Name)
+	}
+	for _, room := range names {
+		line := fmt.Sprintf("%s (%d online)", RoomName(room), len(s.RoomMembers(room)))
+		if room == current {
+			line += ", talking here"
+		}
+		lines = append(lines, line)
+	}
+	ctx.Reply(strings.Join(lines, "\n"))
+	return nil
+}
+
+// handleSay sends a message to a room the caller is in without switching to it
+func (s *Server) handleSay(ctx *command.Context) error {
+	if len(ctx.Args) < 2 {
+		return fmt.Errorf("ERR004: /say requires a room and a message")
+	}
+	room, err := ParseRoom(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+	if !s.InRoom(ctx.Caller, room) {
+		return ErrNotInRoom
+	}
+	s.post(message.NewUserMessage(ctx.Caller, strings.Join(ctx.Args[1:], " ")).InRoom(room), ctx.Time)
+	return nil
+}
+
+// post broadcasts msg and adds it to the history
+func (s *Server) post(msg message.Message, now time.Time) {
+	s.msgChan <- msg
+	s.history.Add(msg, now)
+}
+
+// currentRoom returns the room plain text from username goes to
+func (s *Server) currentRoom(username string) string {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	return s.current[username]
+}
+
+// InRoom reports whether username receives the messages of room. Everyone
+// online is in the lobby.
+func (s *Server) InRoom(username, room string) bool {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if room == "" {
+		_, online := s.users[username]
+		return online
+	}
+	return s.rooms[room][username]
+}
+
+// RoomMembers returns the online users in room, sorted. The members of the
+// lobby are all online users, including bots and remote users.
+func (s *Server) RoomMembers(room string) []string {
+	if room == "" {
+		users := s.GetUsers()
+		sort.Strings(users)
+		return users
+	}
+	s.usersMu.Lock()
+	members := make([]string, 0, len(s.rooms[room]))
+	for user := range s.rooms[room] {
+		members = append(members, user)
+	}
+	s.usersMu.Unlock()
+	sort.Strings(members)
+	return members
+}
+
+// RoomExists reports whether room is the lobby or a stored room
+func (s *Server) RoomExists(room string) (bool, error) {
+	if room == "" {
+		return true, nil
+	}
+	rooms, err := s.Rooms()
+	if err != nil {
+		return false, err
+	}
+	for _, r := range rooms {
+		if r == room {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Rooms returns the names of the stored rooms, without the lobby
+func (s *Server) Rooms() ([]string, error) {
+	rooms, err := s.store.ListRooms()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(rooms))
+	for _, r := range rooms {
+		names = append(names, r.Name)
+	}
+	return names, nil
+}
+
+// leaveRooms removes username from every room, with usersMu held
+func (s *Server) leaveRooms(username string) {
+	for room, members := range s.rooms {
+		delete(members, username)
+		if len(members) == 0 {
+			delete(s.rooms, room)
+		}
+	}
+	delete(s.current, username)
+}
+
+// historyFor returns the history lines username may see: messages of the
+// rooms the user is in and private messages the user sent or received
+func (s *Server) historyFor(username string) []string {
+	s.usersMu.Lock()
+	rooms := make(map[string]bool)
+	for room, members := range s.rooms {
+		rooms[room] = members[username]
+	}
+	s.usersMu.Unlock()
+
+	var lines []string
+	for _, e := range s.history.Entries() {
+		if e.Room != "" && !rooms[e.Room] {
+			continue
+		}
+		if e.Type == message.TypePrivate && e.From != username && e.To != username {
+			continue
+		}
+		lines = append(lines, e.Line)
+	}
+	return lines
+}
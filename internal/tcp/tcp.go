@@ -4,57 +4,170 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"chat/internal/auth"
+	"chat/internal/backup"
+	"chat/internal/certs"
+	"chat/internal/command"
 	"chat/internal/config"
+	"chat/internal/database"
+	"chat/internal/export"
 	"chat/internal/history"
 	"chat/internal/message"
 	"chat/internal/pool"
+	"chat/internal/presence"
+	"chat/internal/quic"
+	"chat/internal/rekey"
+	"chat/internal/retention"
+	"chat/internal/rudp"
+	"chat/internal/webhook"
 	"chat/pkg/logger"
 )
 
 // Errors define custom error types
 var (
-	ErrUsernameTaken = errors.New("ERR001: username already taken")
-	ErrAuthFailed    = errors.New("ERR002: authentication failed")
-	ErrInvalidCommand = errors.New("ERR003: invalid command")
+	ErrUsernameTaken  = errors.New("ERR001: username already taken")
+	ErrAuthFailed     = errors.New("ERR002: authentication failed")
+	ErrInvalidCommand = command.ErrInvalidCommand
+	ErrNotAdmin       = command.ErrNotAdmin
 )
 
+// SecondFactorPrompt is sent during login when the user has two-factor authentication enabled
+const SecondFactorPrompt = "2FA_REQUIRED"
+
 // Server manages TCP connections
 type Server struct {
-	cfg      config.Config
-	logger   *logger.Logger
-	history  *history.History
-	auth     *auth.AuthManager
-	listener net.Listener
-	users    map[string]net.Conn
-	usersMu  sync.Mutex
-	msgChan  chan message.Message
-	done     chan struct{}
-	pool     *pool.Pool
+	cfg       config.Config
+	logger    *logger.Logger
+	store     database.Store
+	history   *history.History
+	auth      *auth.AuthManager
+	listeners []net.Listener // Guarded by usersMu
+	users     map[string]net.Conn
+	statuses  map[string]string          // Status set with /status, guarded by usersMu
+	endpoints map[string]*net.UDPAddr    // Presence endpoints set with /udp, guarded by usersMu
+	rooms     map[string]map[string]bool // Members of the rooms joined with /join, guarded by usersMu
+	current   map[string]string          // Room each user's plain text goes to, guarded by usersMu
+	usersMu   sync.Mutex
+	presence  *presence.Bus
+	msgChan   chan message.Message
+	done      chan struct{}
+	pool      *pool.Pool
+	janitor   *retention.Janitor
+	backups   *backup.Manager
+	rotator   *rekey.Rotator
+	webhooks  *webhook.Dispatcher
+	commands  *command.Registry
+	bots      map[string]*runningBot // In-process bots by name, guarded by usersMu
+	relays    []Relay                // Guarded by usersMu
+	rosters   []Roster               // Relays that bring in users of their own, guarded by usersMu
+}
+
+// Relay receives every message the server broadcasts, to pass it on to
+// another system such as a bridged chat or peer servers
+type Relay interface {
+	Relay(msg message.Message)
+}
+
+// Roster is implemented by relays whose system has users of its own. They
+// are listed as online, and nobody can log in with their names.
+type Roster interface {
+	Users() []string
+	Statuses() map[string]string
+	Owns(username string) bool
 }
 
 // NewServer creates a new TCP server
-func NewServer(cfg config.Config, logger *logger.Logger, hist *history.History, auth *auth.AuthManager, pool *pool.Pool) *Server {
-	return &Server{
-		cfg:     cfg,
-		logger:  logger,
-		history: hist,
-		auth:    auth,
-		users:   make(map[string]net.Conn),
-		msgChan: make(chan message.Message, 100),
-		done:    make(chan struct{}),
-		pool:    pool,
+func NewServer(cfg config.Config, logger *logger.Logger, store database.Store, hist *history.History, auth *auth.AuthManager, pool *pool.Pool) *Server {
+	s := &Server{
+		cfg:       cfg,
+		logger:    logger,
+		store:     store,
+		history:   hist,
+		auth:      auth,
+		users:     make(map[string]net.Conn),
+		statuses:  make(map[string]string),
+		endpoints: make(map[string]*net.UDPAddr),
+		rooms:     make(map[string]map[string]bool),
+		current:   make(map[string]string),
+		presence:  presence.NewBus(),
+		msgChan:   make(chan message.Message, 100),
+		done:      make(chan struct{}),
+		pool:      pool,
+		commands:  command.NewRegistry(cfg),
+		bots:      make(map[string]*runningBot),
+	}
+	s.registerCommands()
+	return s
+}
+
+// SetJanitor sets the retention janitor reported by /retention
+func (s *Server) SetJanitor(j *retention.Janitor) {
+	s.janitor = j
+}
+
+// SetBackups sets the backup manager used by /backup
+func (s *Server) SetBackups(m *backup.Manager) {
+	s.backups = m
+}
+
+// SetRotator sets the message key rotator used by /keys
+func (s *Server) SetRotator(r *rekey.Rotator) {
+	s.rotator = r
+}
+
+// SetWebhooks sets the dispatcher notified of joins, leaves and moderation.
+// It sees messages once added with AddRelay.
+func (s *Server) SetWebhooks(d *webhook.Dispatcher) {
+	s.webhooks = d
+}
+
+// AddRelay registers r to receive the messages broadcast from now on. If r
+// is a Roster, its users are listed as online too.
+func (s *Server) AddRelay(r Relay) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	s.relays = append(s.relays, r)
+	if roster, ok := r.(Roster); ok {
+		s.rosters = append(s.rosters, roster)
 	}
 }
 
+// relaysAndRosters returns the registered relays and rosters
+func (s *Server) relaysAndRosters() ([]Relay, []Roster) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	return s.relays, s.rosters
+}
+
+// Notify publishes e to the webhooks registered for its type
+func (s *Server) Notify(e webhook.Event) {
+	if s.webhooks != nil {
+		s.webhooks.Publish(e)
+	}
+}
+
+// Commands returns the registry of chat commands, which other packages can add to
+func (s *Server) Commands() *command.Registry {
+	return s.commands
+}
+
+// Presence returns the bus publishing joins, leaves and status changes
+func (s *Server) Presence() *presence.Bus {
+	return s.presence
+}
+
 // Start runs the TCP server
 func (s *Server) Start() error {
-	var err error
-	s.listener, err = net.Listen("tcp", s.cfg.TCPPort)
+	listener, err := net.Listen("tcp", s.cfg.TCPPort)
 	if err != nil {
 		return fmt.Errorf("failed to start TCP server: %v", err)
 	}
@@ -63,8 +176,25 @@ func (s *Server) Start() error {
 	// Start message broadcasting
 	go s.broadcastMessages()
 
+	return s.Serve(listener)
+}
+
+// Serve accepts connections from l until Shutdown. Connections of other
+// transports go through the same login, commands and broadcasts.
+func (s *Server) Serve(l net.Listener) error {
+	s.usersMu.Lock()
+	select {
+	case <-s.done:
+		s.usersMu.Unlock()
+		l.Close()
+		return nil
+	default:
+	}
+	s.listeners = append(s.listeners, l)
+	s.usersMu.Unlock()
+
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			select {
 			case <-s.done:
@@ -80,11 +210,11 @@ func (s *Server) Start() error {
 
 // Shutdown closes the TCP server
 func (s *Server) Shutdown() {
+	s.usersMu.Lock()
 	close(s.done)
-	if s.listener != nil {
-		s.listener.Close()
+	for _, l := range s.listeners {
+		l.Close()
 	}
-	s.usersMu.Lock()
 	for _, conn := range s.users {
 		conn.Close()
 	}
@@ -120,27 +250,79 @@ func (s *Server) handleConnection(conn net.Conn) {
 		return
 	}
 
+	// Ask for a second factor if enrolled
+	if s.auth.TwoFactorEnabled(username) {
+		conn.Write([]byte(SecondFactorPrompt + "\n"))
+		code, err := reader.ReadString('\n')
+		if err != nil {
+			s.logger.Error("Failed to read second factor: %v", err)
+			return
+		}
+		if err := s.auth.VerifySecondFactor(username, strings.TrimSpace(code)); err != nil {
+			if errors.Is(err, auth.ErrTooManyAttempts) {
+				s.logger.Error("Refused second factor for %s from %s: %v", username, conn.RemoteAddr(), err)
+			}
+			conn.Write([]byte(ErrAuthFailed.Error() + "\n"))
+			return
+		}
+	}
+
 	// Register user
 	s.usersMu.Lock()
-	if _, exists := s.users[username]; exists {
+	_, isBot := s.bots[username]
+	owned := false
+	for _, roster := range s.rosters {
+		owned = owned || roster.Owns(username)
+	}
+	if _, exists := s.users[username]; exists || isBot || owned {
 		conn.Write([]byte(ErrUsernameTaken.Error() + "\n"))
 		s.usersMu.Unlock()
 		return
 	}
 	s.users[username] = conn
 	s.usersMu.Unlock()
+	s.presence.Publish(presence.Event{Type: presence.Join, User: username})
 
-	// Send history messages
-	for _, msg := range s.history.GetAll() {
-		conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
-		conn.Write([]byte(msg + "\n"))
+	// Record the session until the connection handler exits
+	sessionID, err := s.store.StartSession(username, conn.RemoteAddr().String(), time.Now())
+	if err != nil {
+		s.logger.Error("Failed to start session for %s: %v", username, err)
+	} else {
+		defer func() {
+			if err := s.store.EndSession(sessionID, time.Now()); err != nil {
+				s.logger.Error("Failed to end session for %s: %v", username, err)
+			}
+		}()
+	}
+
+	// Send history messages, on a stream of their own if the transport has
+	// them so that a long replay does not hold up live messages
+	if opener, ok := conn.(historyOpener); ok {
+		w, err := opener.OpenHistory()
+		if err != nil {
+			s.logger.Error("Failed to replay history to %s: %v", username, err)
+		} else {
+			go func() {
+				defer w.Close()
+				for _, msg := range s.historyFor(username) {
+					if _, err := w.Write([]byte(msg + "\n")); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	} else {
+		for _, msg := range s.historyFor(username) {
+			conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
+			conn.Write([]byte(msg + "\n"))
+		}
 	}
 
 	// Broadcast user joined
 	joinedMsg := message.NewSystemMessage(fmt.Sprintf("%s joined the chat", username))
 	s.msgChan <- joinedMsg
-	timestamp := time.Now().UTC().Format("2006-01-02 15:04:05")
-	s.history.Add(joinedMsg.String(), "", "", timestamp)  // System message, from and to empty
+	s.history.Add(joinedMsg, time.Now())
+	s.Notify(webhook.Event{Type: webhook.Join, User: username})
 
 	// Start heartbeat
 	go s.heartbeat(conn, username)
@@ -150,13 +332,12 @@ func (s *Server) handleConnection(conn net.Conn) {
 		conn.SetReadDeadline(time.Now().Add(s.cfg.TCPTimeout))
 		input, err := reader.ReadString('\n')
 		if err != nil {
-			s.usersMu.Lock()
-			delete(s.users, username)
-			s.usersMu.Unlock()
-			leftMsg := message.NewSystemMessage(fmt.Sprintf("%s left the chat", username))
-			s.msgChan <- leftMsg
-			timestamp := time.Now().UTC().Format("2006-01-02 15:04:05")
-			s.history.Add(leftMsg.String(), "", "", timestamp)  // System message
+			if s.removeUser(username, conn) {
+				leftMsg := message.NewSystemMessage(fmt.Sprintf("%s left the chat", username))
+				s.msgChan <- leftMsg
+				s.history.Add(leftMsg, time.Now())
+				s.Notify(webhook.Event{Type: webhook.Leave, User: username})
+			}
 			s.logger.Info("User %s disconnected: %v", username, err)
 			return
 		}
@@ -169,63 +350,269 @@ func (s *Server) handleConnection(conn net.Conn) {
 	}
 }
 
+// historyOpener is implemented by transports that replay history on a separate stream
+type historyOpener interface {
+	OpenHistory() (io.WriteCloser, error)
+}
+
 // processInput handles user input (commands or messages)
 func (s *Server) processInput(username, input string) error {
-	timestamp := time.Now().UTC().Format("2006-01-02 15:04:05")
+	now := time.Now()
 	if strings.HasPrefix(input, "/") {
-		return s.handleCommand(username, input, timestamp)
+		return s.handleCommand(username, input, now)
 	}
-	msg := message.NewUserMessage(username, input)
-	s.msgChan <- msg
-	s.history.Add(msg.String(), username, "", timestamp)  // Broadcast, to empty
+	s.post(message.NewUserMessage(username, input).InRoom(s.currentRoom(username)), now)
+	return nil
+}
+
+// handleCommand runs a command from the registry
+func (s *Server) handleCommand(username, input string, now time.Time) error {
+	ctx := &command.Context{
+		Caller: username,
+		Room:   s.currentRoom(username),
+		Time:   now,
+		Reply:  func(text string) { s.sendTo(username, text) },
+	}
+	return s.commands.Run(ctx, input)
+}
+
+// handleStatus sets the status shown to other users, or clears it if status is empty
+func (s *Server) handleStatus(username, status string) error {
+	if len(status) > presence.MaxStatusLength {
+		return fmt.Errorf("ERR018: status must be at most %d characters", presence.MaxStatusLength)
+	}
+	s.usersMu.Lock()
+	if status == "" {
+		delete(s.statuses, username)
+	} else {
+		s.statuses[username] = status
+	}
+	s.usersMu.Unlock()
+	s.presence.Publish(presence.Event{Type: presence.Status, User: username, Status: status})
+
+	if status == "" {
+		status = "available"
+	}
+	s.sendTo(username, message.NewSystemMessage(fmt.Sprintf("Your status is now %s", status)).String())
+	return nil
+}
+
+// handleUDP registers the UDP port a client receives presence updates on.
+// Updates go to the address of the chat connection only, so a client cannot
+// direct them at another host.
+func (s *Server) handleUDP(username, portStr string) error {
+	if !s.cfg.PresenceUnicast {
+		return fmt.Errorf("ERR019: unicast presence updates are disabled")
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("ERR004: invalid UDP port %s", portStr)
+	}
+	s.usersMu.Lock()
+	conn, exists := s.users[username]
+	if !exists {
+		s.usersMu.Unlock()
+		return nil
+	}
+	var endpoint *net.UDPAddr
+	switch remote := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		endpoint = &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone}
+	case *net.UDPAddr:
+		endpoint = &net.UDPAddr{IP: remote.IP, Port: port, Zone: remote.Zone}
+	default:
+		s.usersMu.Unlock()
+		return fmt.Errorf("ERR004: unicast presence needs an IP connection")
+	}
+	s.endpoints[username] = endpoint
+	s.usersMu.Unlock()
+	s.presence.Publish(presence.Event{Type: presence.Register, User: username})
 	return nil
 }
 
-// handleCommand processes user commands
-func (s *Server) handleCommand(username, input, timestamp string) error {
-	parts := strings.Fields(input)
-	if len(parts) == 0 {
-		return ErrInvalidCommand
+// handleKick ends the session of target on behalf of the admin username
+func (s *Server) handleKick(username, target, reason string) error {
+	if !s.Disconnect(target) {
+		return fmt.Errorf("ERR028: %s is not online", target)
 	}
+	text := fmt.Sprintf("%s was kicked by %s", target, username)
+	if reason != "" {
+		text += ": " + reason
+	}
+	kickMsg := message.NewSystemMessage(text)
+	s.msgChan <- kickMsg
+	s.history.Add(kickMsg, time.Now())
+	s.Notify(webhook.Event{Type: webhook.Moderation, Action: "kick", Actor: username, User: target, Reason: reason})
+	s.logger.Info("%s kicked %s", username, target)
+	return nil
+}
 
-	switch parts[0] {
-	case "/pm":
-		if len(parts) < 3 {
-			return fmt.Errorf("ERR004: /pm requires username and message")
+// handleTwoFactor processes the /2fa enable|confirm|disable subcommands
+func (s *Server) handleTwoFactor(username string, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("ERR004: /2fa requires enable, confirm <code> or disable <code>")
+	}
+	switch args[0] {
+	case "enable":
+		enrollment, err := s.auth.BeginEnrollment(username)
+		if err != nil {
+			return err
 		}
-		target := parts[1]
-		content := strings.Join(parts[2:], " ")
-		msg := message.NewPrivateMessage(username, target, content)
-		s.msgChan <- msg
-		s.history.Add(msg.String(), username, target, timestamp)
-	case "/history":
-		s.usersMu.Lock()
-		if conn, exists := s.users[username]; exists {
-			for _, msg := range s.history.GetAll() {
-				conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
-				conn.Write([]byte(msg + "\n"))
-			}
+		lines := []string{
+			"Scan this code with your authenticator app:",
+			enrollment.QR,
+			"Or enter it manually: " + enrollment.URI,
+			"Recovery codes (each works once, store them safely):",
 		}
-		s.usersMu.Unlock()
-	case "/users":
-		s.usersMu.Lock()
-		userList := strings.Join(s.GetUsers(), ", ")
-		if conn, exists := s.users[username]; exists {
-			conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
-			conn.Write([]byte(fmt.Sprintf("Online users: %s\n", userList)))
+		lines = append(lines, enrollment.RecoveryCodes...)
+		lines = append(lines, "Run /2fa confirm <code> to finish enabling two-factor authentication")
+		s.sendTo(username, strings.Join(lines, "\n"))
+	case "confirm":
+		if len(args) < 2 {
+			return fmt.Errorf("ERR004: /2fa confirm requires a code")
 		}
-		s.usersMu.Unlock()
+		if err := s.auth.ConfirmEnrollment(username, args[1]); err != nil {
+			return err
+		}
+		s.sendTo(username, message.NewSystemMessage("Two-factor authentication enabled").String())
+	case "disable":
+		if len(args) < 2 {
+			return fmt.Errorf("ERR004: /2fa disable requires a code")
+		}
+		if err := s.auth.DisableTwoFactor(username, args[1]); err != nil {
+			return err
+		}
+		s.sendTo(username, message.NewSystemMessage("Two-factor authentication disabled").String())
 	default:
-		return fmt.Errorf("ERR005: unknown command %s", parts[0])
+		return fmt.Errorf("ERR005: unknown /2fa subcommand %s", args[0])
+	}
+	return nil
+}
+
+// handleExport writes history matching the key=value filters in args to the export directory.
+// Usage: /export [jsonl|csv|mbox] [user=name] [room=name] [since=time] [until=time]
+func (s *Server) handleExport(username string, args []string, now time.Time) error {
+	format := export.FormatJSONL
+	var filter database.MessageFilter
+	for _, arg := range args {
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			format = arg
+			continue
+		}
+		var err error
+		switch key {
+		case "user":
+			filter.User = value
+		case "room":
+			filter.Room = value
+		case "since":
+			filter.Since, err = export.ParseTime(value)
+		case "until":
+			filter.Until, err = export.ParseTime(value)
+		default:
+			err = fmt.Errorf("unknown filter %s (available: user, room, since, until)", key)
+		}
+		if err != nil {
+			return fmt.Errorf("ERR012: %v", err)
+		}
+	}
+	// The format becomes the file extension, so it must be checked before the name is built
+	if err := export.CheckFormat(format); err != nil {
+		return fmt.Errorf("ERR012: %v", err)
+	}
+
+	if err := os.MkdirAll(s.cfg.ExportDir, 0o700); err != nil {
+		return fmt.Errorf("ERR013: failed to create export directory: %v", err)
+	}
+	// Sub-second precision keeps two exports in the same second from colliding
+	name := fmt.Sprintf("chat-%s.%s", now.UTC().Format("20060102-150405.000000"), format)
+	path := filepath.Join(s.cfg.ExportDir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("ERR013: failed to create export file: %v", err)
+	}
+	n, err := export.Export(s.store, f, format, filter)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("ERR013: export failed: %v", err)
+	}
+	s.logger.Info("%s exported %d messages to %s", username, n, path)
+	s.sendTo(username, message.NewSystemMessage(fmt.Sprintf("Exported %d messages to %s", n, path)).String())
 	return nil
 }
 
+// handleImport loads a JSONL export from the export directory, skipping known messages
+func (s *Server) handleImport(username, name string) error {
+	// Only files directly inside the export directory may be imported
+	path := filepath.Join(s.cfg.ExportDir, filepath.Base(name))
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("ERR013: failed to open import file: %v", err)
+	}
+	defer f.Close()
+
+	read, imported, err := export.Import(s.store, f)
+	if err != nil {
+		return fmt.Errorf("ERR013: import failed after %d records: %v", read, err)
+	}
+	s.logger.Info("%s imported %d of %d messages from %s", username, imported, read, path)
+	s.sendTo(username, message.NewSystemMessage(fmt.Sprintf("Read %d messages from %s, imported %d, skipped %d duplicates",
+		read, path, imported, read-imported)).String())
+	return nil
+}
+
+// Post sends text from a user without a chat session, to everyone or
+// privately to the user to if it is not empty
+func (s *Server) Post(from, to, text string) {
+	msg := message.NewUserMessage(from, text)
+	if to != "" {
+		msg = message.NewPrivateMessage(from, to, text)
+	}
+	s.msgChan <- msg
+	s.history.Add(msg, time.Now())
+}
+
+// PostRoom sends text from a user without a chat session to the members of
+// a stored room, or to everyone if room is empty
+func (s *Server) PostRoom(from, room, text string) {
+	s.post(message.NewUserMessage(from, text).InRoom(room), time.Now())
+}
+
+// Disconnect closes the session of an online user and reports whether there was one
+func (s *Server) Disconnect(username string) bool {
+	s.usersMu.Lock()
+	conn, exists := s.users[username]
+	s.usersMu.Unlock()
+	if exists {
+		conn.Close()
+	}
+	return exists
+}
+
+// sendTo writes text directly to a single connected user
+func (s *Server) sendTo(username, text string) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	if conn, exists := s.users[username]; exists {
+		conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
+		conn.Write([]byte(text + "\n"))
+	}
+}
+
 // broadcastMessages broadcasts messages to users
 func (s *Server) broadcastMessages() {
 	for {
 		select {
 		case msg := <-s.msgChan:
+			relays, _ := s.relaysAndRosters()
+			for _, r := range relays {
+				r.Relay(msg)
+			}
+			s.deliverToBots(msg)
 			s.pool.Submit(func() {
 				s.usersMu.Lock()
 				defer s.usersMu.Unlock()
@@ -233,6 +620,9 @@ func (s *Server) broadcastMessages() {
 					if msg.Type == message.TypePrivate && msg.Target != username && msg.From != username {
 						continue
 					}
+					if msg.Room != "" && !s.rooms[msg.Room][username] {
+						continue
+					}
 					conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
 					_, err := conn.Write([]byte(msg.String() + "\n"))
 					if err != nil {
@@ -255,14 +645,13 @@ func (s *Server) heartbeat(conn net.Conn, username string) {
 		case <-ticker.C:
 			conn.SetWriteDeadline(time.Now().Add(s.cfg.TCPTimeout))
 			if _, err := conn.Write([]byte("PING\n")); err != nil {
-				s.usersMu.Lock()
-				delete(s.users, username)
-				s.usersMu.Unlock()
-				leftMsg := message.NewSystemMessage(fmt.Sprintf("%s left the chat (timeout)", username))
-				s.msgChan <- leftMsg
-				timestamp := time.Now().UTC().Format("2006-01-02 15:04:05")
-				s.history.Add(leftMsg.String(), "", "", timestamp)
-				s.logger.Info("User %s timed out", username)
+				if s.removeUser(username, conn) {
+					leftMsg := message.NewSystemMessage(fmt.Sprintf("%s left the chat (timeout)", username))
+					s.msgChan <- leftMsg
+					s.history.Add(leftMsg, time.Now())
+					s.Notify(webhook.Event{Type: webhook.Leave, User: username, Reason: "timeout"})
+					s.logger.Info("User %s timed out", username)
+				}
 				return
 			}
 		case <-s.done:
@@ -271,14 +660,88 @@ func (s *Server) heartbeat(conn net.Conn, username string) {
 	}
 }
 
-// GetUsers returns the list of online users
-func (s *Server) GetUsers() []string {
+// removeUser unregisters username if conn is still its connection and
+// reports whether it did, so that a leave is handled only once
+func (s *Server) removeUser(username string, conn net.Conn) bool {
+	s.usersMu.Lock()
+	if s.users[username] != conn {
+		s.usersMu.Unlock()
+		return false
+	}
+	delete(s.users, username)
+	delete(s.statuses, username)
+	delete(s.endpoints, username)
+	s.leaveRooms(username)
+	s.usersMu.Unlock()
+	s.presence.Publish(presence.Event{Type: presence.Leave, User: username})
+	return true
+}
+
+// GetStatuses returns the status of online users who set one, including
+// the users of rosters such as federated servers
+func (s *Server) GetStatuses() map[string]string {
+	s.usersMu.Lock()
+	statuses := make(map[string]string, len(s.statuses))
+	for username, status := range s.statuses {
+		statuses[username] = status
+	}
+	s.usersMu.Unlock()
+	_, rosters := s.relaysAndRosters()
+	for _, roster := range rosters {
+		for username, status := range roster.Statuses() {
+			statuses[username] = status
+		}
+	}
+	return statuses
+}
+
+// GetEndpoints returns the UDP endpoints registered by connected clients
+func (s *Server) GetEndpoints() []*net.UDPAddr {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	endpoints := make([]*net.UDPAddr, 0, len(s.endpoints))
+	for _, addr := range s.endpoints {
+		endpoints = append(endpoints, addr)
+	}
+	return endpoints
+}
+
+// UserOf returns the user logged in on conn
+func (s *Server) UserOf(conn net.Conn) (string, bool) {
+	s.usersMu.Lock()
+	defer s.usersMu.Unlock()
+	for username, c := range s.users {
+		if c == conn {
+			return username, true
+		}
+	}
+	return "", false
+}
+
+// ConnOf returns the connection of an online user
+func (s *Server) ConnOf(username string) (net.Conn, bool) {
 	s.usersMu.Lock()
 	defer s.usersMu.Unlock()
+	conn, ok := s.users[username]
+	return conn, ok
+}
+
+// GetUsers returns the list of online users, including in-process bots and
+// the users of rosters, such as a bridged system or federated servers
+func (s *Server) GetUsers() []string {
+	s.usersMu.Lock()
 	var userList []string
 	for username := range s.users {
 		userList = append(userList, username)
 	}
+	for name := range s.bots {
+		userList = append(userList, name)
+	}
+	rosters := s.rosters
+	s.usersMu.Unlock()
+	for _, roster := range rosters {
+		userList = append(userList, roster.Users()...)
+	}
 	return userList
 }
 
@@ -287,26 +750,29 @@ type Client struct {
 	cfg      config.Config
 	logger   *logger.Logger
 	conn     net.Conn
+	reader   *bufio.Reader
 	username string
 }
 
-// NewClient creates a new TCP client
-func NewClient(cfg config.Config, logger *logger.Logger, username, password string) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", cfg.TCPAddr(), cfg.DialTimeout)
+// NewClient creates a new TCP client and returns it with the first line the
+// server sent after logging in. promptCode is called for a second factor when
+// the account requires one.
+func NewClient(cfg config.Config, logger *logger.Logger, username, password string, promptCode func() string) (*Client, string, error) {
+	conn, err := dial(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %v", err)
+		return nil, "", fmt.Errorf("failed to connect to server: %v", err)
 	}
 
 	// Send username and password
 	_, err = conn.Write([]byte(username + "\n"))
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to send username: %v", err)
+		return nil, "", fmt.Errorf("failed to send username: %v", err)
 	}
 	_, err = conn.Write([]byte(password + "\n"))
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to send password: %v", err)
+		return nil, "", fmt.Errorf("failed to send password: %v", err)
 	}
 
 	// Check authentication response
@@ -314,19 +780,81 @@ func NewClient(cfg config.Config, logger *logger.Logger, username, password stri
 	response, err := reader.ReadString('\n')
 	if err != nil {
 		conn.Close()
-		return nil, fmt.Errorf("failed to read auth response: %v", err)
+		return nil, "", fmt.Errorf("failed to read auth response: %v", err)
 	}
-	if strings.Contains(response, "ERR002") {
+	if strings.TrimSpace(response) == SecondFactorPrompt {
+		if promptCode == nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("server requires a second factor")
+		}
+		if _, err := conn.Write([]byte(promptCode() + "\n")); err != nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("failed to send second factor: %v", err)
+		}
+		response, err = reader.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, "", fmt.Errorf("failed to read auth response: %v", err)
+		}
+	}
+	if err := replyError(response); err != nil {
 		conn.Close()
-		return nil, ErrAuthFailed
+		return nil, "", err
 	}
 
-	return &Client{
+	c := &Client{
 		cfg:      cfg,
 		logger:   logger,
 		conn:     conn,
+		reader:   reader,
 		username: username,
-	}, nil
+	}
+	if qc, ok := conn.(*quic.Conn); ok {
+		go qc.Serve(clientStreams{c})
+	}
+	return c, response, nil
+}
+
+// replyError returns the error for an ERR reply to a login, or nil
+func replyError(response string) error {
+	response = strings.TrimSpace(response)
+	switch {
+	case !strings.HasPrefix(response, "ERR"):
+		return nil
+	case response == ErrAuthFailed.Error():
+		return ErrAuthFailed
+	case response == ErrUsernameTaken.Error():
+		return ErrUsernameTaken
+	}
+	return errors.New(response)
+}
+
+// dial connects to the server with the configured transport
+func dial(cfg config.Config) (net.Conn, error) {
+	switch cfg.Transport {
+	case "udp":
+		conn, err := rudp.Dial(cfg.ChatUDPAddr(), cfg.DialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case "quic":
+		tlsConf, err := certs.ClientConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := quic.Dial(cfg, tlsConf)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return net.DialTimeout("tcp", cfg.TCPAddr(), cfg.DialTimeout)
+}
+
+// RegisterUDP asks the server to also send presence updates to port on this host
+func (c *Client) RegisterUDP(port int) error {
+	return c.Send(fmt.Sprintf("/udp %d", port))
 }
 
 // Send sends a message to the server
@@ -341,10 +869,9 @@ func (c *Client) Send(msg string) error {
 
 // Receive handles incoming messages
 func (c *Client) Receive() error {
-	reader := bufio.NewReader(c.conn)
 	for {
 		c.conn.SetReadDeadline(time.Now().Add(c.cfg.TCPTimeout))
-		msg, err := reader.ReadString('\n')
+		msg, err := c.reader.ReadString('\n')
 		if err != nil {
 			return fmt.Errorf("server connection lost: %v", err)
 		}
@@ -358,9 +885,92 @@ func (c *Client) Receive() error {
 	}
 }
 
+// SendFile sends the file at path to a user, which needs the QUIC transport
+func (c *Client) SendFile(to, path string) error {
+	qc, ok := c.conn.(*quic.Conn)
+	if !ok {
+		return fmt.Errorf("file transfer needs the QUIC transport")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Size() > c.cfg.FileMaxSize {
+		return fmt.Errorf("files are limited to %d bytes", c.cfg.FileMaxSize)
+	}
+	return qc.SendFile(to, filepath.Base(path), info.Size(), f)
+}
+
+// clientStreams handles the streams the server opens next to the chat stream
+type clientStreams struct {
+	c *Client
+}
+
+// History prints replayed messages
+func (h clientStreams) History(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fmt.Printf("\n%s\n", scanner.Text())
+		fmt.Print("Message: ")
+	}
+}
+
+// File saves a received file in the download directory under a name not taken yet
+func (h clientStreams) File(from, name string, size int64, r io.Reader) error {
+	if err := os.MkdirAll(h.c.cfg.DownloadDir, 0755); err != nil {
+		return fmt.Errorf("failed to create download directory: %v", err)
+	}
+	name = filepath.Base(name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		name = "file"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	var (
+		f    *os.File
+		path string
+		err  error
+	)
+	for i := 0; ; i++ {
+		path = filepath.Join(h.c.cfg.DownloadDir, name)
+		if i > 0 {
+			path = filepath.Join(h.c.cfg.DownloadDir, fmt.Sprintf("%s-%d%s", base, i, ext))
+		}
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !errors.Is(err, os.ErrExist) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create file: %v", err)
+	}
+	n, err := io.Copy(f, r)
+	f.Close()
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		os.Remove(path)
+		fmt.Printf("\nFailed to receive %s from %s: %v\n", name, from, err)
+		fmt.Print("Message: ")
+		return err
+	}
+	fmt.Printf("\nReceived %s from %s (%d bytes), saved to %s\n", name, from, size, path)
+	fmt.Print("Message: ")
+	return nil
+}
+
 // Close closes the client connection
 func (c *Client) Close() {
 	if c.conn != nil {
 		c.conn.Close()
 	}
-}
\ No newline at end of file
+}
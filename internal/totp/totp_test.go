@@ -0,0 +1,57 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA-1 key of the RFC 6238 test vectors, "12345678901234567890"
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestRFC6238Vectors(t *testing.T) {
+	// The RFC lists 8 digit codes; 6 digit codes are their last 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		got, err := Code(rfcSecret, Step(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+		if step, ok := Validate(rfcSecret, tt.want, at); !ok || step != Step(at) {
+			t.Errorf("Validate at %d = %d, %v, want %d, true", tt.unix, step, ok, Step(at))
+		}
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	at := time.Unix(1234567890, 0)
+	for offset := -Skew - 1; offset <= Skew+1; offset++ {
+		code, err := Code(rfcSecret, Step(at)+int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, ok := Validate(rfcSecret, code, at)
+		if want := offset >= -Skew && offset <= Skew; ok != want {
+			t.Errorf("code %d steps away accepted = %v, want %v", offset, ok, want)
+		}
+	}
+	if _, ok := Validate(rfcSecret, "00592", at); ok {
+		t.Error("accepted a code with too few digits")
+	}
+	if _, ok := Validate("not base32!", "005924", at); ok {
+		t.Error("accepted a code for an invalid secret")
+	}
+}
@@ -0,0 +1,201 @@
+package udp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"chat/internal/config"
+)
+
+// DiscoveryVersion is the version of the discovery packet format. Newer
+// versions only add fields, so clients accept packets of any version.
+const DiscoveryVersion = 1
+
+// ProtocolVersion is the version of the TCP chat protocol announced to clients
+const ProtocolVersion = 1
+
+// announceType marks chat discovery packets among other UDP traffic
+const announceType = "chat.announce"
+
+// Kinds of user list updates
+const (
+	KindSnapshot = "snapshot" // The full list, split across Parts datagrams
+	KindDelta    = "delta"    // Users who joined, left or changed status since Prev
+	KindBeacon   = "beacon"   // Server details and Seq only, sent while nothing changes
+)
+
+// ErrNotAnnouncement is returned for UDP packets that are not discovery packets
+var ErrNotAnnouncement = errors.New("not a discovery packet")
+
+// Announcement is the discovery packet broadcast by a server
+type Announcement struct {
+	Type       string            `json:"type"`
+	Version    int               `json:"v"`
+	InstanceID string            `json:"instance"` // Random per server process
+	Name       string            `json:"name"`
+	TCPAddr    string            `json:"tcp"`            // An empty host means the sender's address
+	TLS        bool              `json:"tls"`            // Whether QUICAddr offers a TLS transport
+	QUICAddr   string            `json:"quic,omitempty"` // An empty host means the sender's address
+	Protocol   int               `json:"protocol"`
+	UserCount  int               `json:"user_count"`
+	Users      []string          `json:"users,omitempty"`    // Users in this part of a snapshot
+	Statuses   map[string]string `json:"statuses,omitempty"` // Status of listed users, empty means available
+	Kind       string            `json:"kind,omitempty"`     // KindSnapshot, KindDelta or KindBeacon, empty from older servers
+	Seq        uint64            `json:"seq,omitempty"`      // Increases with every snapshot and delta
+	Prev       uint64            `json:"prev,omitempty"`     // Seq a delta applies to
+	Part       int               `json:"part,omitempty"`     // 1-based part of a snapshot
+	Parts      int               `json:"parts,omitempty"`
+	Joined     []string          `json:"joined,omitempty"`
+	Left       []string          `json:"left,omitempty"`
+	Timestamp  int64             `json:"ts,omitempty"`    // Unix time the packet was signed
+	Nonce      string            `json:"nonce,omitempty"` // Random per packet, blocks replays
+}
+
+// NewAnnouncement creates the announcement for this server from cfg
+func NewAnnouncement(cfg config.Config, instanceID string) Announcement {
+	return Announcement{
+		Type:       announceType,
+		Version:    DiscoveryVersion,
+		InstanceID: instanceID,
+		Name:       cfg.ServerName,
+		TCPAddr:    cfg.AnnounceAddr(),
+		TLS:        cfg.QUICPort != "",
+		QUICAddr:   cfg.AnnounceQUICAddr(),
+		Protocol:   ProtocolVersion,
+	}
+}
+
+// NewInstanceID returns a random ID identifying one server process
+func NewInstanceID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate instance ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Marshal encodes the announcement as a packet
+func (a Announcement) Marshal() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+// ParseAnnouncement decodes a discovery packet
+func ParseAnnouncement(data []byte) (Announcement, error) {
+	var a Announcement
+	if err := json.Unmarshal(data, &a); err != nil || a.Type != announceType {
+		return Announcement{}, ErrNotAnnouncement
+	}
+	if a.Version < 1 || a.InstanceID == "" || a.TCPAddr == "" {
+		return Announcement{}, fmt.Errorf("invalid discovery packet from %q", a.Name)
+	}
+	if a.Kind == KindSnapshot && (a.Parts < 1 || a.Parts > maxParts || a.Part < 1 || a.Part > a.Parts) {
+		return Announcement{}, fmt.Errorf("invalid snapshot part %d/%d from %q", a.Part, a.Parts, a.Name)
+	}
+	return a, nil
+}
+
+// DialAddr returns the TCP address to connect to, using the sender's IP
+// when the announced address has no host
+func (a Announcement) DialAddr(from *net.UDPAddr) string {
+	return dialAddr(a.TCPAddr, from)
+}
+
+// DialQUICAddr returns the QUIC address to connect to like DialAddr,
+// empty if the server has no QUIC transport
+func (a Announcement) DialQUICAddr(from *net.UDPAddr) string {
+	if a.QUICAddr == "" {
+		return ""
+	}
+	return dialAddr(a.QUICAddr, from)
+}
+
+// dialAddr fills in the host of addr from the sender if it has none
+func dialAddr(addr string, from *net.UDPAddr) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = from.IP.String()
+		if from.Zone != "" {
+			host += "%" + from.Zone // Link-local addresses need the interface
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Server is a chat server found by Discover
+type Server struct {
+	Announcement
+	Addr     string // TCP address to connect to
+	QUIC     string // QUIC address to connect to, empty without QUIC
+	LastSeen time.Time
+}
+
+// Discover listens for announcements for the given duration and returns
+// the servers found, sorted by name. Packets failing v are dropped.
+func Discover(cfg config.Config, wait time.Duration, v *Verifier) ([]Server, error) {
+	l, err := listen(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	found := make(map[string]Server)
+	rosters := make(map[string]*roster)
+	timeout := time.After(wait)
+	for waiting := true; waiting; {
+		select {
+		case p := <-l.packets:
+			a, err := v.Open(p.data)
+			if err != nil {
+				v.reject(p.from.IP.String(), err)
+				continue
+			}
+			ros, ok := rosters[a.InstanceID]
+			if !ok {
+				ros = newRoster()
+				rosters[a.InstanceID] = ros
+			}
+			ros.apply(a)
+			a.Users, a.Statuses = ros.list(), nil
+			found[a.InstanceID] = Server{Announcement: a, Addr: a.DialAddr(p.from), QUIC: a.DialQUICAddr(p.from), LastSeen: time.Now()}
+		case <-timeout:
+			waiting = false
+		}
+	}
+
+	servers := make([]Server, 0, len(found))
+	for _, s := range found {
+		servers = append(servers, s)
+	}
+	return Merge(servers), nil
+}
+
+// Merge combines server lists, keeping the first entry for each instance,
+// and sorts the result by name
+func Merge(lists ...[]Server) []Server {
+	seen := make(map[string]bool)
+	var servers []Server
+	for _, list := range lists {
+		for _, s := range list {
+			if !seen[s.InstanceID] {
+				seen[s.InstanceID] = true
+				servers = append(servers, s)
+			}
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Name != servers[j].Name {
+			return servers[i].Name < servers[j].Name
+		}
+		return servers[i].Addr < servers[j].Addr
+	})
+	return servers
+}
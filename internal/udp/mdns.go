@@ -0,0 +1,601 @@
+package udp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+
+	"chat/internal/config"
+	"chat/pkg/logger"
+)
+
+// DNS-SD names advertised by the server
+const (
+	mdnsService  = "_chat._tcp.local."
+	mdnsServices = "_services._dns-sd._udp.local."
+)
+
+// mdnsTTL is the TTL of advertised records in seconds
+const mdnsTTL = 120
+
+// mdnsLegacyTTL caps TTLs in replies to one-shot queries (RFC 6762 section 6.7)
+const mdnsLegacyTTL = 10
+
+// mdnsMaxBackoff limits the wait after failed reads, which repeat for as
+// long as the cause, such as a vanished interface, persists
+const mdnsMaxBackoff = 5 * time.Second
+
+// cacheFlush marks records this responder owns exclusively
+const cacheFlush = 1 << 15
+
+// mdnsGroup is the IPv4 mDNS multicast group
+var mdnsGroup = net.IPv4(224, 0, 0, 251)
+
+// Advertiser answers mDNS queries for _chat._tcp.local
+type Advertiser struct {
+	cfg        config.Config
+	logger     *logger.Logger
+	conn       *net.UDPConn
+	group      *net.UDPAddr
+	instance   dnsmessage.Name // <name>._chat._tcp.local.
+	host       dnsmessage.Name // <hostname>.local.
+	port       uint16
+	quicPort   string // Empty without the QUIC transport
+	instanceID string
+	getUsers   func() []string
+	roomCount  func() int
+	signer     *Signer
+	mu         sync.Mutex // Guards conn once started, instanceID, getUsers, roomCount and signer
+	done       chan struct{}
+}
+
+// NewAdvertiser creates a new mDNS advertiser
+func NewAdvertiser(cfg config.Config, logger *logger.Logger) *Advertiser {
+	return &Advertiser{
+		cfg:    cfg,
+		logger: logger,
+		group:  &net.UDPAddr{IP: mdnsGroup, Port: cfg.MDNSPort},
+		done:   make(chan struct{}),
+	}
+}
+
+// SetInstanceID sets the server instance ID published in the TXT record
+func (a *Advertiser) SetInstanceID(id string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.instanceID = id
+}
+
+// SetGetUsers sets the function to get the user list
+func (a *Advertiser) SetGetUsers(f func() []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.getUsers = f
+}
+
+// SetRoomCount sets the function to count rooms for the TXT record
+func (a *Advertiser) SetRoomCount(f func() int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.roomCount = f
+}
+
+// SetSigner sets the signer of the TXT record, which is published unsigned without one
+func (a *Advertiser) SetSigner(s *Signer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.signer = s
+}
+
+// Start announces the service and answers queries until Shutdown is called
+func (a *Advertiser) Start() error {
+	_, portStr, err := net.SplitHostPort(a.cfg.AnnounceAddr())
+	if err != nil {
+		return fmt.Errorf("invalid TCP address %q: %v", a.cfg.AnnounceAddr(), err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid TCP port %q", portStr)
+	}
+	a.port = uint16(port)
+	if a.cfg.QUICPort != "" {
+		if _, a.quicPort, err = net.SplitHostPort(a.cfg.QUICPort); err != nil {
+			return fmt.Errorf("invalid QUIC port %q: %v", a.cfg.QUICPort, err)
+		}
+	}
+	if a.instance, err = dnsmessage.NewName(dnsLabel(a.cfg.ServerName) + "." + mdnsService); err != nil {
+		return fmt.Errorf("invalid mDNS instance name: %v", err)
+	}
+	if a.host, err = dnsmessage.NewName(dnsLabel(hostLabel()) + ".local."); err != nil {
+		return fmt.Errorf("invalid mDNS host name: %v", err)
+	}
+
+	ifaces, err := multicastInterfaces(a.cfg, mdnsGroup)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", ifaces[0], a.group)
+	if err != nil {
+		return fmt.Errorf("failed to listen for mDNS: %v", err)
+	}
+	p := ipv4.NewPacketConn(conn)
+	for _, ifi := range ifaces[1:] {
+		if err := p.JoinGroup(ifi, &net.UDPAddr{IP: mdnsGroup}); err != nil {
+			conn.Close()
+			return fmt.Errorf("failed to join mDNS group on %s: %v", ifi.Name, err)
+		}
+	}
+	if err := p.SetMulticastTTL(255); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to configure mDNS socket: %v", err)
+	}
+	if err := p.SetMulticastLoopback(a.cfg.MulticastLoopback); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to configure mDNS socket: %v", err)
+	}
+	a.mu.Lock()
+	a.conn = conn
+	a.mu.Unlock()
+	a.logger.Info("mDNS advertiser started for %s on port %d", a.instance, a.cfg.MDNSPort)
+
+	// Unsolicited announcements let browsers that are already running see us
+	go func() {
+		for i := 0; i < 2; i++ {
+			a.send(a.announcement(mdnsTTL), a.group)
+			select {
+			case <-time.After(time.Second):
+			case <-a.done:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, maxPacketSize)
+	backoff := 50 * time.Millisecond
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+				return nil
+			default:
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("mDNS socket closed: %v", err)
+			}
+			a.logger.Error("mDNS read failed, retrying in %v: %v", backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-a.done:
+				return nil
+			}
+			backoff = min(backoff*2, mdnsMaxBackoff)
+			continue
+		}
+		backoff = 50 * time.Millisecond
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+		a.answer(query, from)
+	}
+}
+
+// Shutdown withdraws the advertisement and stops answering queries
+func (a *Advertiser) Shutdown() {
+	close(a.done)
+	a.mu.Lock()
+	conn := a.conn
+	a.mu.Unlock()
+	if conn != nil {
+		a.send(a.announcement(0), a.group) // TTL 0 tells browsers the service is gone
+		conn.Close()
+	}
+}
+
+// answer replies to the questions in query that concern this service
+func (a *Advertiser) answer(query dnsmessage.Message, from *net.UDPAddr) {
+	// Queries not sent from the mDNS port come from one-shot resolvers,
+	// which expect a unicast DNS reply (RFC 6762 section 6.7)
+	legacy := from.Port != a.cfg.MDNSPort
+	ttl := uint32(mdnsTTL)
+	if legacy {
+		ttl = mdnsLegacyTTL
+	}
+
+	var answers, extra []dnsmessage.Resource
+	unicast := legacy
+	for _, q := range query.Questions {
+		if q.Class&cacheFlush != 0 {
+			unicast = true // The QU bit asks for a unicast reply
+		}
+		name := strings.ToLower(q.Name.String())
+		switch {
+		case name == mdnsService && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, a.ptr(ttl))
+			extra = append(extra, a.srv(ttl), a.txt(ttl))
+			extra = append(extra, a.addresses(ttl)...)
+		case name == mdnsServices && (q.Type == dnsmessage.TypePTR || q.Type == dnsmessage.TypeALL):
+			answers = append(answers, a.serviceType(ttl))
+		case name == strings.ToLower(a.instance.String()):
+			if q.Type == dnsmessage.TypeSRV || q.Type == dnsmessage.TypeALL {
+				answers = append(answers, a.srv(ttl))
+				extra = append(extra, a.addresses(ttl)...)
+			}
+			if q.Type == dnsmessage.TypeTXT || q.Type == dnsmessage.TypeALL {
+				answers = append(answers, a.txt(ttl))
+			}
+		case name == strings.ToLower(a.host.String()):
+			for _, r := range a.addresses(ttl) {
+				if q.Type == r.Header.Type || q.Type == dnsmessage.TypeALL {
+					answers = append(answers, r)
+				}
+			}
+		}
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	reply := dnsmessage.Message{
+		Header:      dnsmessage.Header{Response: true, Authoritative: true},
+		Answers:     answers,
+		Additionals: extra,
+	}
+	if legacy {
+		// One-shot resolvers match the ID and question and do not know the cache flush bit
+		reply.Header.ID = query.Header.ID
+		reply.Questions = query.Questions
+		for _, rs := range [][]dnsmessage.Resource{reply.Answers, reply.Additionals} {
+			for i := range rs {
+				rs[i].Header.Class &^= cacheFlush
+			}
+		}
+	}
+	to := a.group
+	if unicast {
+		to = from
+	}
+	a.send(reply, to)
+}
+
+// announcement returns an unsolicited response with every record
+func (a *Advertiser) announcement(ttl uint32) dnsmessage.Message {
+	answers := []dnsmessage.Resource{a.ptr(ttl), a.serviceType(ttl), a.srv(ttl), a.txt(ttl)}
+	return dnsmessage.Message{
+		Header:  dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: append(answers, a.addresses(ttl)...),
+	}
+}
+
+// send packs and sends msg
+func (a *Advertiser) send(msg dnsmessage.Message, to *net.UDPAddr) {
+	packet, err := msg.Pack()
+	if err != nil {
+		a.logger.Error("Failed to encode mDNS response: %v", err)
+		return
+	}
+	if _, err := a.conn.WriteToUDP(packet, to); err != nil {
+		a.logger.Error("mDNS response to %s failed: %v", to, err)
+	}
+}
+
+// ptr points the service type at this instance
+func (a *Advertiser) ptr(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: a.instance},
+	}
+}
+
+// serviceType lists _chat._tcp for service type enumeration
+func (a *Advertiser) serviceType(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsServices), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsService)},
+	}
+}
+
+// srv gives the host and TCP port of this instance
+func (a *Advertiser) srv(ttl uint32) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | cacheFlush, TTL: ttl},
+		Body:   &dnsmessage.SRVResource{Target: a.host, Port: a.port},
+	}
+}
+
+// txt describes the server with DNS-SD key=value pairs
+func (a *Advertiser) txt(ttl uint32) dnsmessage.Resource {
+	a.mu.Lock()
+	instanceID, getUsers, roomCount, signer := a.instanceID, a.getUsers, a.roomCount, a.signer
+	a.mu.Unlock()
+
+	users, rooms := 0, 0
+	if getUsers != nil {
+		users = len(getUsers())
+	}
+	if roomCount != nil {
+		rooms = roomCount()
+	}
+	txt := []string{
+		"txtvers=1",
+		"version=" + strconv.Itoa(ProtocolVersion),
+		"tls=" + strconv.FormatBool(a.quicPort != ""),
+		"rooms=" + strconv.Itoa(rooms),
+		"users=" + strconv.Itoa(users),
+		"name=" + a.cfg.ServerName,
+		"port=" + strconv.Itoa(int(a.port)), // Signed, unlike the SRV record
+	}
+	if a.quicPort != "" {
+		txt = append(txt, "quic="+a.quicPort) // The TLS secured transport, on the same host
+	}
+	if instanceID != "" {
+		txt = append(txt, "id="+instanceID)
+	}
+	if signer != nil {
+		signed, err := signer.SignTXT(txt)
+		if err != nil {
+			a.logger.Error("Failed to sign mDNS TXT record: %v", err)
+		} else {
+			txt = signed
+		}
+	}
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: a.instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | cacheFlush, TTL: ttl},
+		Body:   &dnsmessage.TXTResource{TXT: txt},
+	}
+}
+
+// addresses returns A and AAAA records for the host
+func (a *Advertiser) addresses(ttl uint32) []dnsmessage.Resource {
+	var records []dnsmessage.Resource
+	for _, ip := range a.hostIPs() {
+		header := dnsmessage.ResourceHeader{Name: a.host, Class: dnsmessage.ClassINET | cacheFlush, TTL: ttl}
+		if ip4 := ip.To4(); ip4 != nil {
+			header.Type = dnsmessage.TypeA
+			var body dnsmessage.AResource
+			copy(body.A[:], ip4)
+			records = append(records, dnsmessage.Resource{Header: header, Body: &body})
+		} else {
+			header.Type = dnsmessage.TypeAAAA
+			var body dnsmessage.AAAAResource
+			copy(body.AAAA[:], ip.To16())
+			records = append(records, dnsmessage.Resource{Header: header, Body: &body})
+		}
+	}
+	return records
+}
+
+// hostIPs returns the addresses of the advertised interfaces, skipping
+// IPv6 link-local addresses which are useless without a zone
+func (a *Advertiser) hostIPs() []net.IP {
+	var ifaces []net.Interface
+	if len(a.cfg.MulticastInterfaces) > 0 {
+		for _, name := range a.cfg.MulticastInterfaces {
+			if ifi, err := net.InterfaceByName(name); err == nil {
+				ifaces = append(ifaces, *ifi)
+			}
+		}
+	} else {
+		ifaces, _ = net.Interfaces()
+	}
+
+	var ips, loopback []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipnet.IP.IsLoopback() {
+				loopback = append(loopback, ipnet.IP)
+			} else {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return loopback
+	}
+	return ips
+}
+
+// Browse sends a one-shot mDNS query for _chat._tcp.local, collects replies
+// for the given duration and returns the servers found. TXT records failing
+// v are dropped.
+func Browse(cfg config.Config, wait time.Duration, v *Verifier) ([]Server, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %v", err)
+	}
+	defer conn.Close()
+	p := ipv4.NewPacketConn(conn)
+	p.SetMulticastLoopback(true)
+	if len(cfg.MulticastInterfaces) > 0 {
+		if ifi, err := net.InterfaceByName(cfg.MulticastInterfaces[0]); err == nil {
+			p.SetMulticastInterface(ifi)
+		}
+	}
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(time.Now().UnixNano())},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(mdnsService),
+			Type:  dnsmessage.TypePTR,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode mDNS query: %v", err)
+	}
+	group := &net.UDPAddr{IP: mdnsGroup, Port: cfg.MDNSPort}
+	if _, err := conn.WriteToUDP(packet, group); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %v", err)
+	}
+
+	records := newRecordSet(v)
+	conn.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			return nil, fmt.Errorf("mDNS read failed: %v", err)
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Response {
+			continue
+		}
+		records.add(msg, from)
+	}
+	return records.servers(), nil
+}
+
+// recordSet collects DNS-SD records from mDNS responses
+type recordSet struct {
+	verifier  *Verifier
+	instances []string
+	srv       map[string]dnsmessage.SRVResource
+	txt       map[string]map[string]string // Verified TXT pairs
+	addrs     map[string][]net.IP
+	from      map[string]net.IP // Sender of each SRV record
+}
+
+// newRecordSet creates an empty record set verifying TXT records with v
+func newRecordSet(v *Verifier) *recordSet {
+	return &recordSet{
+		verifier: v,
+		srv:      make(map[string]dnsmessage.SRVResource),
+		txt:      make(map[string]map[string]string),
+		addrs:    make(map[string][]net.IP),
+		from:     make(map[string]net.IP),
+	}
+}
+
+// add records every resource of msg
+func (s *recordSet) add(msg dnsmessage.Message, from *net.UDPAddr) {
+	resources := append(append([]dnsmessage.Resource{}, msg.Answers...), msg.Additionals...)
+	for _, r := range resources {
+		name := strings.ToLower(r.Header.Name.String())
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == mdnsService {
+				instance := strings.ToLower(body.PTR.String())
+				if !containsName(s.instances, instance) {
+					s.instances = append(s.instances, instance)
+				}
+			}
+		case *dnsmessage.SRVResource:
+			s.srv[name] = *body
+			s.from[name] = from.IP
+		case *dnsmessage.TXTResource:
+			pairs, err := s.verifier.OpenTXT(body.TXT)
+			if err != nil {
+				s.verifier.reject(from.IP.String(), err)
+				continue
+			}
+			s.txt[name] = pairs
+		case *dnsmessage.AResource:
+			s.addrs[name] = append(s.addrs[name], net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			s.addrs[name] = append(s.addrs[name], net.IP(body.AAAA[:]))
+		}
+	}
+}
+
+// servers returns a server for every instance with an SRV record
+func (s *recordSet) servers() []Server {
+	var servers []Server
+	for _, instance := range s.instances {
+		srv, ok := s.srv[instance]
+		if !ok {
+			continue
+		}
+		txt, ok := s.txt[instance]
+		if !ok && s.verifier.require {
+			continue
+		}
+		if port := txt["port"]; port != "" && port != strconv.Itoa(int(srv.Port)) {
+			s.verifier.reject(s.from[instance].String(), fmt.Errorf("SRV port %d of %s differs from the signed port %s", srv.Port, instance, port))
+			continue
+		}
+		ip := s.from[instance]
+		if addrs := s.addrs[strings.ToLower(srv.Target.String())]; len(addrs) > 0 {
+			ip = addrs[0]
+		}
+
+		label := strings.TrimSuffix(instance, "."+mdnsService)
+		a := Announcement{
+			Type:       announceType,
+			Version:    DiscoveryVersion,
+			InstanceID: txt["id"],
+			Name:       txt["name"],
+			TLS:        txt["tls"] == "true",
+			TCPAddr:    net.JoinHostPort(ip.String(), strconv.Itoa(int(srv.Port))),
+		}
+		if a.InstanceID == "" {
+			a.InstanceID = instance
+		}
+		if a.Name == "" {
+			a.Name = label
+		}
+		if txt["quic"] != "" {
+			a.QUICAddr = net.JoinHostPort(ip.String(), txt["quic"])
+		}
+		a.Protocol, _ = strconv.Atoi(txt["version"])
+		a.UserCount, _ = strconv.Atoi(txt["users"])
+		servers = append(servers, Server{Announcement: a, Addr: a.TCPAddr, QUIC: a.QUICAddr, LastSeen: time.Now()})
+	}
+	return Merge(servers)
+}
+
+// containsName reports whether names includes name
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsLabel turns s into a single DNS label
+func dnsLabel(s string) string {
+	s = strings.NewReplacer(".", "-", " ", "-").Replace(strings.TrimSpace(s))
+	if len(s) > 63 {
+		s = s[:63]
+	}
+	if s == "" {
+		s = "chat"
+	}
+	return s
+}
+
+// hostLabel returns the first label of the host name
+func hostLabel() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "chat"
+	}
+	label, _, _ := strings.Cut(name, ".")
+	return label
+}
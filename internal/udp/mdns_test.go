@@ -0,0 +1,146 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"chat/internal/config"
+	"chat/pkg/logger"
+)
+
+// mdnsConfig returns a config advertising on a free mDNS port, so the test
+// does not clash with a system responder on 5353
+func mdnsConfig(t *testing.T) config.Config {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	conn.Close()
+	return config.Config{
+		ServerName:             "test server",
+		TCPPort:                ":7001",
+		QUICPort:               ":7002",
+		MDNSPort:               port,
+		MulticastLoopback:      true,
+		DiscoverySecret:        "secret",
+		DiscoveryMaxAge:        30 * time.Second,
+		DiscoveryRequireSigned: true,
+	}
+}
+
+// startAdvertiser runs an advertiser for cfg until the test ends
+func startAdvertiser(t *testing.T, cfg config.Config) {
+	t.Helper()
+	signer, err := NewSigner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adv := NewAdvertiser(cfg, logger.New("mdns"))
+	adv.SetInstanceID("0123456789abcdef")
+	adv.SetGetUsers(func() []string { return []string{"alice", "bob"} })
+	adv.SetSigner(signer)
+	errs := make(chan error, 1)
+	go func() { errs <- adv.Start() }()
+	t.Cleanup(adv.Shutdown)
+
+	// Start returns at once only if it failed, for example without multicast
+	select {
+	case err := <-errs:
+		t.Skipf("mDNS advertiser unavailable: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestBrowseSignedTXT(t *testing.T) {
+	cfg := mdnsConfig(t)
+	startAdvertiser(t, cfg)
+
+	verifier, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, err := Browse(cfg, time.Second, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 1 {
+		t.Fatalf("Browse found %d servers, want 1", len(servers))
+	}
+	s := servers[0]
+	if s.Name != "test server" || s.InstanceID != "0123456789abcdef" || s.UserCount != 2 || s.Protocol != ProtocolVersion {
+		t.Errorf("server = %+v", s.Announcement)
+	}
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil || port != "7001" {
+		t.Errorf("Addr = %q, want port 7001", s.Addr)
+	}
+	if !s.TLS || s.QUIC != net.JoinHostPort(host, "7002") {
+		t.Errorf("TLS = %v, QUIC = %q, want QUIC on port 7002 of %s", s.TLS, s.QUIC, host)
+	}
+}
+
+func TestBrowseRejectsWrongSecret(t *testing.T) {
+	cfg := mdnsConfig(t)
+	startAdvertiser(t, cfg)
+
+	cfg.DiscoverySecret = "other secret"
+	verifier, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rejected []error
+	verifier.SetOnReject(func(from string, err error) { rejected = append(rejected, err) })
+	servers, err := Browse(cfg, time.Second, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(servers) != 0 {
+		t.Errorf("Browse found %d servers signed with another secret", len(servers))
+	}
+	if len(rejected) == 0 {
+		t.Error("no TXT record was rejected")
+	}
+}
+
+func TestOpenTXT(t *testing.T) {
+	cfg := mdnsConfig(t)
+	signer, err := NewSigner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	txt, err := signer.SignTXT([]string{"name=test server", "tls=true", "quic=7002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := verifier.OpenTXT(txt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pairs["name"] != "test server" || pairs["tls"] != "true" || pairs["quic"] != "7002" {
+		t.Errorf("OpenTXT = %v", pairs)
+	}
+	if _, err := verifier.OpenTXT(txt); !errors.Is(err, ErrReplayed) {
+		t.Errorf("second OpenTXT = %v, want %v", err, ErrReplayed)
+	}
+
+	tampered, err := signer.SignTXT([]string{"name=test server", "tls=true", "quic=7002"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered[2] = "quic=7003"
+	if _, err := verifier.OpenTXT(tampered); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("OpenTXT of a tampered record = %v, want %v", err, ErrBadSignature)
+	}
+	if _, err := verifier.OpenTXT([]string{"name=test server", "tls=true"}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("OpenTXT of an unsigned record = %v, want %v", err, ErrUnsigned)
+	}
+}
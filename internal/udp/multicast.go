@@ -0,0 +1,288 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+
+	"chat/internal/config"
+)
+
+// maxPacketSize is the largest UDP payload
+const maxPacketSize = 64 * 1024
+
+// target is one destination of discovery packets
+type target struct {
+	conn *net.UDPConn
+	dst  *net.UDPAddr // Nil if conn is connected
+	name string
+}
+
+// write sends a packet to the target
+func (t target) write(packet []byte) error {
+	if t.dst == nil {
+		_, err := t.conn.Write(packet)
+		return err
+	}
+	_, err := t.conn.WriteToUDP(packet, t.dst)
+	return err
+}
+
+// openTargets opens a socket for the broadcast address and for every
+// multicast group on every configured interface
+func openTargets(cfg config.Config) ([]target, error) {
+	var targets []target
+	fail := func(err error) ([]target, error) {
+		closeTargets(targets)
+		return nil, err
+	}
+
+	if cfg.BroadcastAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", cfg.BroadcastAddr)
+		if err != nil {
+			return fail(fmt.Errorf("failed to resolve UDP address: %v", err))
+		}
+		conn, err := net.DialUDP("udp", nil, addr)
+		if err != nil {
+			return fail(fmt.Errorf("failed to dial UDP: %v", err))
+		}
+		targets = append(targets, target{conn: conn, name: "broadcast " + cfg.BroadcastAddr})
+	}
+
+	for _, group := range cfg.MulticastGroups {
+		addr, err := net.ResolveUDPAddr("udp", group)
+		if err != nil {
+			return fail(fmt.Errorf("failed to resolve multicast group: %v", err))
+		}
+		ifaces, err := multicastInterfaces(cfg, addr.IP)
+		if err != nil {
+			return fail(err)
+		}
+		for _, ifi := range ifaces {
+			t, err := openMulticastTarget(cfg, addr, ifi)
+			if err != nil {
+				return fail(err)
+			}
+			targets = append(targets, t)
+		}
+	}
+	return targets, nil
+}
+
+// openMulticastTarget opens a socket sending to group through ifi, or the default interface if ifi is nil
+func openMulticastTarget(cfg config.Config, group *net.UDPAddr, ifi *net.Interface) (target, error) {
+	dst := *group
+	name := "multicast " + group.String()
+	if ifi != nil {
+		name += " on " + ifi.Name
+		if group.IP.IsLinkLocalMulticast() && group.IP.To4() == nil {
+			dst.Zone = ifi.Name
+		}
+	}
+
+	if group.IP.To4() != nil {
+		conn, err := net.ListenUDP("udp4", nil)
+		if err != nil {
+			return target{}, fmt.Errorf("failed to open %s: %v", name, err)
+		}
+		p := ipv4.NewPacketConn(conn)
+		err = p.SetMulticastTTL(cfg.MulticastTTL)
+		if err == nil {
+			err = p.SetMulticastLoopback(cfg.MulticastLoopback)
+		}
+		if err == nil && ifi != nil {
+			err = p.SetMulticastInterface(ifi)
+		}
+		if err != nil {
+			conn.Close()
+			return target{}, fmt.Errorf("failed to configure %s: %v", name, err)
+		}
+		return target{conn: conn, dst: &dst, name: name}, nil
+	}
+
+	conn, err := net.ListenUDP("udp6", nil)
+	if err != nil {
+		return target{}, fmt.Errorf("failed to open %s: %v", name, err)
+	}
+	p := ipv6.NewPacketConn(conn)
+	err = p.SetMulticastHopLimit(cfg.MulticastTTL)
+	if err == nil {
+		err = p.SetMulticastLoopback(cfg.MulticastLoopback)
+	}
+	if err == nil && ifi != nil {
+		err = p.SetMulticastInterface(ifi)
+	}
+	if err != nil {
+		conn.Close()
+		return target{}, fmt.Errorf("failed to configure %s: %v", name, err)
+	}
+	return target{conn: conn, dst: &dst, name: name}, nil
+}
+
+// closeTargets closes every target socket
+func closeTargets(targets []target) {
+	for _, t := range targets {
+		t.conn.Close()
+	}
+}
+
+// multicastInterfaces returns the interfaces to use for group. A nil entry
+// means the system default. IPv6 link-local groups need an explicit
+// interface, so every multicast capable interface is used if none is set.
+func multicastInterfaces(cfg config.Config, group net.IP) ([]*net.Interface, error) {
+	if len(cfg.MulticastInterfaces) > 0 {
+		var ifaces []*net.Interface
+		for _, name := range cfg.MulticastInterfaces {
+			ifi, err := net.InterfaceByName(name)
+			if err != nil {
+				return nil, fmt.Errorf("unknown multicast interface %q: %v", name, err)
+			}
+			ifaces = append(ifaces, ifi)
+		}
+		return ifaces, nil
+	}
+	if group.To4() != nil || !group.IsLinkLocalMulticast() {
+		return []*net.Interface{nil}, nil
+	}
+
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	var ifaces []*net.Interface
+	for i := range all {
+		if all[i].Flags&net.FlagUp != 0 && all[i].Flags&net.FlagMulticast != 0 {
+			ifaces = append(ifaces, &all[i])
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no multicast interface for %s", group)
+	}
+	return ifaces, nil
+}
+
+// packet is a datagram read by a listener
+type packet struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+// listener receives discovery packets on UDPPort and every multicast group
+type listener struct {
+	conns   []*net.UDPConn
+	packets chan packet
+	done    chan struct{}
+}
+
+// newListener creates a listener without sockets
+func newListener() *listener {
+	return &listener{packets: make(chan packet, 16), done: make(chan struct{})}
+}
+
+// listen opens the broadcast socket on UDPPort and joins every multicast
+// group on every configured interface. Groups share a socket per port and
+// address family.
+func listen(cfg config.Config) (*listener, error) {
+	l := newListener()
+	sockets := make(map[string]*net.UDPConn)
+	open := func(network string, port int) (*net.UDPConn, error) {
+		key := network + "/" + strconv.Itoa(port)
+		if conn, ok := sockets[key]; ok {
+			return conn, nil
+		}
+		conn, err := net.ListenUDP(network, &net.UDPAddr{Port: port})
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen UDP: %v", err)
+		}
+		sockets[key] = conn
+		l.conns = append(l.conns, conn)
+		return conn, nil
+	}
+
+	if cfg.BroadcastAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", cfg.UDPPort)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve UDP address: %v", err)
+		}
+		if _, err := open("udp4", addr.Port); err != nil {
+			return nil, err
+		}
+	}
+	for _, group := range cfg.MulticastGroups {
+		addr, err := net.ResolveUDPAddr("udp", group)
+		if err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to resolve multicast group: %v", err)
+		}
+		ifaces, err := multicastInterfaces(cfg, addr.IP)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		network := "udp6"
+		if addr.IP.To4() != nil {
+			network = "udp4"
+		}
+		conn, err := open(network, addr.Port)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		for _, ifi := range ifaces {
+			if network == "udp4" {
+				err = ipv4.NewPacketConn(conn).JoinGroup(ifi, &net.UDPAddr{IP: addr.IP})
+			} else {
+				err = ipv6.NewPacketConn(conn).JoinGroup(ifi, &net.UDPAddr{IP: addr.IP})
+			}
+			if err != nil {
+				l.Close()
+				return nil, fmt.Errorf("failed to join multicast group %s: %v", group, err)
+			}
+		}
+	}
+
+	for _, conn := range l.conns {
+		go l.read(conn)
+	}
+	return l, nil
+}
+
+// addUnicast opens a socket on an ephemeral port and returns the port
+func (l *listener) addUnicast() (int, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to listen UDP: %v", err)
+	}
+	l.conns = append(l.conns, conn)
+	go l.read(conn)
+	return conn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// read forwards packets from conn until it is closed
+func (l *listener) read(conn *net.UDPConn) {
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		data := make([]byte, n)
+		copy(data, buf[:n])
+		select {
+		case l.packets <- packet{data: data, from: from}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Close closes every socket of the listener
+func (l *listener) Close() {
+	close(l.done)
+	for _, conn := range l.conns {
+		conn.Close()
+	}
+}
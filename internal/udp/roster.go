@@ -0,0 +1,203 @@
+package udp
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// maxParts limits the datagrams of one snapshot a receiver reassembles
+const maxParts = 1024
+
+// sealOverhead is the room left in a datagram for the signed envelope,
+// whose payload is base64 encoded
+const sealOverhead = 256
+
+// chunkUsers splits users into parts whose announcements, based on a and
+// carrying the statuses of their users, fit in datagrams of size bytes. A
+// user too long for a datagram of its own still gets one and relies on IP
+// fragmentation.
+func chunkUsers(a Announcement, users []string, statuses map[string]string, size int) ([][]string, error) {
+	// Part and Parts are not known yet, so measure with the widest values
+	a.Users, a.Statuses, a.Joined, a.Left = nil, nil, nil, nil
+	a.Part, a.Parts = maxParts, maxParts
+	base, err := a.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	limit := payloadLimit(size) - len(base) - len(`,"users":[],"statuses":{}`)
+
+	var (
+		parts [][]string
+		part  []string
+		used  int
+	)
+	for _, user := range users {
+		encoded, err := json.Marshal(user)
+		if err != nil {
+			return nil, err
+		}
+		cost := len(encoded) + 1
+		if status := statuses[user]; status != "" {
+			encodedStatus, err := json.Marshal(status)
+			if err != nil {
+				return nil, err
+			}
+			cost += len(encoded) + len(encodedStatus) + 2
+		}
+		if len(part) > 0 && used+cost > limit {
+			parts = append(parts, part)
+			part, used = nil, 0
+		}
+		part = append(part, user)
+		used += cost
+	}
+	if len(part) > 0 || len(parts) == 0 {
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// payloadLimit returns the largest announcement that fits a signed datagram of size bytes
+func payloadLimit(size int) int {
+	return (size - sealOverhead) / 4 * 3
+}
+
+// change is the difference between two states of a roster
+type change struct {
+	joined   []string
+	left     []string
+	statuses []string // Users already online whose status changed
+}
+
+// empty reports whether nothing changed
+func (c change) empty() bool {
+	return len(c.joined) == 0 && len(c.left) == 0 && len(c.statuses) == 0
+}
+
+// roster is the presence table of one server, built from snapshots and deltas
+type roster struct {
+	seq     uint64
+	users   map[string]string // Status by user, empty means available
+	known   bool              // Whether a complete snapshot was applied
+	pending [][]string        // Parts of the snapshot being reassembled
+	pendSt  map[string]string // Statuses of the pending snapshot
+	pendSeq uint64            // Seq of the pending snapshot
+}
+
+// newRoster creates an empty roster
+func newRoster() *roster {
+	return &roster{users: make(map[string]string)}
+}
+
+// apply updates the roster with a and returns what changed. Deltas that do
+// not follow the current state are ignored until the next snapshot.
+func (r *roster) apply(a Announcement) change {
+	switch a.Kind {
+	case KindSnapshot:
+		if r.known && a.Seq <= r.seq {
+			return change{}
+		}
+		// A newer snapshot replaces one whose parts were lost
+		if r.pending == nil || a.Seq > r.pendSeq {
+			r.pending = make([][]string, a.Parts)
+			r.pendSt = make(map[string]string)
+			r.pendSeq = a.Seq
+		}
+		if a.Seq < r.pendSeq || len(r.pending) != a.Parts {
+			return change{}
+		}
+		r.pending[a.Part-1] = append([]string{}, a.Users...)
+		for _, user := range a.Users {
+			if status := a.Statuses[user]; status != "" {
+				r.pendSt[user] = status
+			}
+		}
+		var users []string
+		for _, p := range r.pending {
+			if p == nil {
+				return change{}
+			}
+			users = append(users, p...)
+		}
+		statuses := r.pendSt
+		r.pending, r.pendSt = nil, nil
+		r.seq = a.Seq
+		return r.replace(users, statuses)
+	case KindDelta:
+		if !r.known || a.Prev != r.seq {
+			return change{}
+		}
+		r.seq = a.Seq
+		var c change
+		for _, user := range a.Left {
+			if _, ok := r.users[user]; ok {
+				delete(r.users, user)
+				c.left = append(c.left, user)
+			}
+		}
+		for _, user := range a.Joined {
+			if _, ok := r.users[user]; !ok {
+				r.users[user] = a.Statuses[user]
+				c.joined = append(c.joined, user)
+			}
+		}
+		for user, status := range a.Statuses {
+			if old, ok := r.users[user]; ok && old != status {
+				r.users[user] = status
+				c.statuses = append(c.statuses, user)
+			}
+		}
+		sort.Strings(c.statuses)
+		return c
+	case KindBeacon:
+		return change{}
+	default:
+		// Older servers send the whole list in every packet
+		return r.replace(a.Users, nil)
+	}
+}
+
+// replace sets the presence table and returns the difference to the old one
+func (r *roster) replace(users []string, statuses map[string]string) change {
+	next := make(map[string]string, len(users))
+	var c change
+	for _, user := range users {
+		status := statuses[user]
+		next[user] = status
+		old, ok := r.users[user]
+		if !ok {
+			c.joined = append(c.joined, user)
+		} else if old != status {
+			c.statuses = append(c.statuses, user)
+		}
+	}
+	for user := range r.users {
+		if _, ok := next[user]; !ok {
+			c.left = append(c.left, user)
+		}
+	}
+	sort.Strings(c.joined)
+	sort.Strings(c.left)
+	sort.Strings(c.statuses)
+	r.users = next
+	r.known = true
+	return c
+}
+
+// list returns the users in sorted order
+func (r *roster) list() []string {
+	users := make([]string, 0, len(r.users))
+	for user := range r.users {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// describe returns user with its status, if any
+func (r *roster) describe(user string) string {
+	if status := r.users[user]; status != "" {
+		return user + " (" + status + ")"
+	}
+	return user
+}
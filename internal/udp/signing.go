@@ -0,0 +1,424 @@
+package udp
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+)
+
+// signedType marks signed discovery packets
+const signedType = "chat.signed"
+
+// Signature algorithms of discovery packets
+const (
+	AlgEd25519 = "ed25519"
+	AlgHMAC    = "hmac-sha256"
+)
+
+// Errors returned for discovery packets that fail verification
+var (
+	ErrUnsigned     = errors.New("unsigned discovery packet")
+	ErrBadSignature = errors.New("invalid discovery packet signature")
+	ErrStale        = errors.New("stale discovery packet")
+	ErrReplayed     = errors.New("replayed discovery packet")
+	ErrKeyMismatch  = errors.New("server key does not match the pinned key")
+)
+
+// envelope carries a signed announcement. The signature covers Payload as sent.
+type envelope struct {
+	Type    string `json:"type"`
+	Alg     string `json:"alg"`
+	Key     []byte `json:"key,omitempty"` // Ed25519 public key of the server
+	Payload []byte `json:"payload"`
+	Sig     []byte `json:"sig"`
+}
+
+// Signer signs discovery packets with the server's Ed25519 key or a shared secret
+type Signer struct {
+	alg    string
+	key    ed25519.PrivateKey
+	secret []byte
+}
+
+// NewSigner creates a signer using DiscoverySecret if set, otherwise the
+// Ed25519 key in DiscoveryKeyFile
+func NewSigner(cfg config.Config) (*Signer, error) {
+	if cfg.DiscoverySecret != "" {
+		return &Signer{alg: AlgHMAC, secret: []byte(cfg.DiscoverySecret)}, nil
+	}
+	key, err := LoadSigningKey(cfg.DiscoveryKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{alg: AlgEd25519, key: key}, nil
+}
+
+// LoadSigningKey reads the base64 Ed25519 seed from path. A new key is
+// generated and written to path if the file does not exist.
+func LoadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, fmt.Errorf("failed to generate discovery key: %v", err)
+		}
+		encoded := base64.StdEncoding.EncodeToString(seed) + "\n"
+		if err := os.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write discovery key: %v", err)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read discovery key: %v", err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode discovery key: %v", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("discovery key must be %d bytes, got %d", ed25519.SeedSize, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Fingerprint describes the key clients pin for this server
+func (s *Signer) Fingerprint() string {
+	if s.alg == AlgHMAC {
+		return "shared secret"
+	}
+	return AlgEd25519 + " " + base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey))
+}
+
+// sign returns the signature of msg
+func (s *Signer) sign(msg []byte) []byte {
+	if s.alg == AlgHMAC {
+		mac := hmac.New(sha256.New, s.secret)
+		mac.Write(msg)
+		return mac.Sum(nil)
+	}
+	return ed25519.Sign(s.key, msg)
+}
+
+// publicKey returns the Ed25519 public key, or nil for HMAC
+func (s *Signer) publicKey() []byte {
+	if s.alg == AlgHMAC {
+		return nil
+	}
+	return s.key.Public().(ed25519.PublicKey)
+}
+
+// Seal stamps a with the current time and a fresh nonce and returns the signed packet
+func (s *Signer) Seal(a Announcement) ([]byte, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	a.Timestamp = time.Now().Unix()
+	a.Nonce = nonce
+	payload, err := a.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{
+		Type:    signedType,
+		Alg:     s.alg,
+		Key:     s.publicKey(),
+		Payload: payload,
+		Sig:     s.sign(payload),
+	})
+}
+
+// SignTXT appends a timestamp, nonce, key and signature to DNS-SD TXT entries.
+// The signature covers every preceding entry joined by newlines.
+func (s *Signer) SignTXT(txt []string) ([]string, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	txt = append(txt,
+		"ts="+strconv.FormatInt(time.Now().Unix(), 10),
+		"nonce="+nonce,
+		"alg="+s.alg,
+	)
+	if key := s.publicKey(); key != nil {
+		txt = append(txt, "key="+base64.StdEncoding.EncodeToString(key))
+	}
+	sig := s.sign([]byte(strings.Join(txt, "\n")))
+	return append(txt, "sig="+base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// newNonce returns a random hex nonce
+func newNonce() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Verifier checks signatures, freshness and pinned keys of discovery packets
+type Verifier struct {
+	secret    []byte
+	maxAge    time.Duration
+	require   bool
+	pins      *Pins
+	seen      map[string]time.Time // Nonces accepted within maxAge
+	lastPrune time.Time
+	onReject  func(from string, err error)
+	mu        sync.Mutex // Guards seen, lastPrune and onReject
+}
+
+// NewVerifier creates a verifier from cfg. Ed25519 keys are pinned in
+// DiscoveryKnownServers, or only in memory if it is empty.
+func NewVerifier(cfg config.Config) (*Verifier, error) {
+	v := &Verifier{
+		maxAge:  cfg.DiscoveryMaxAge,
+		require: cfg.DiscoveryRequireSigned,
+		seen:    make(map[string]time.Time),
+	}
+	if cfg.DiscoverySecret != "" {
+		v.secret = []byte(cfg.DiscoverySecret)
+		return v, nil
+	}
+	pins, err := LoadPins(cfg.DiscoveryKnownServers)
+	if err != nil {
+		return nil, err
+	}
+	v.pins = pins
+	return v, nil
+}
+
+// SetOnReject sets a function called for packets dropped by Discover,
+// Browse or a Receiver
+func (v *Verifier) SetOnReject(f func(from string, err error)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.onReject = f
+}
+
+// reject reports a dropped packet. Other UDP traffic and packets seen twice,
+// such as on several interfaces, are expected and not reported.
+func (v *Verifier) reject(from string, err error) {
+	if errors.Is(err, ErrNotAnnouncement) || errors.Is(err, ErrReplayed) {
+		return
+	}
+	v.mu.Lock()
+	f := v.onReject
+	v.mu.Unlock()
+	if f != nil {
+		f(from, err)
+	}
+}
+
+// Open verifies a discovery packet and returns its announcement. Unsigned
+// packets are accepted only if signatures are not required.
+func (v *Verifier) Open(data []byte) (Announcement, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return Announcement{}, ErrNotAnnouncement
+	}
+	if env.Type != signedType {
+		a, err := ParseAnnouncement(data)
+		if err == nil && v.require {
+			return Announcement{}, ErrUnsigned
+		}
+		return a, err
+	}
+
+	a, err := ParseAnnouncement(env.Payload)
+	if err != nil {
+		return Announcement{}, err
+	}
+	if err := v.verify(env.Alg, env.Key, env.Payload, env.Sig); err != nil {
+		return Announcement{}, err
+	}
+	if err := v.checkKey(a.Name, env.Key); err != nil {
+		return Announcement{}, err
+	}
+	if err := v.checkFresh(a.Timestamp, a.Nonce); err != nil {
+		return Announcement{}, err
+	}
+	return a, nil
+}
+
+// OpenTXT verifies DNS-SD TXT entries signed by SignTXT and returns them as key=value pairs
+func (v *Verifier) OpenTXT(txt []string) (map[string]string, error) {
+	pairs := make(map[string]string)
+	for _, entry := range txt {
+		key, value, _ := strings.Cut(entry, "=")
+		pairs[strings.ToLower(key)] = value
+	}
+	if len(txt) == 0 || !strings.HasPrefix(txt[len(txt)-1], "sig=") {
+		if v.require {
+			return nil, ErrUnsigned
+		}
+		return pairs, nil
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(pairs["sig"])
+	if err != nil {
+		return nil, ErrBadSignature
+	}
+	var key []byte
+	if pairs["key"] != "" {
+		if key, err = base64.StdEncoding.DecodeString(pairs["key"]); err != nil {
+			return nil, ErrBadSignature
+		}
+	}
+	signed := []byte(strings.Join(txt[:len(txt)-1], "\n"))
+	if err := v.verify(pairs["alg"], key, signed, sig); err != nil {
+		return nil, err
+	}
+	if err := v.checkKey(pairs["name"], key); err != nil {
+		return nil, err
+	}
+	ts, _ := strconv.ParseInt(pairs["ts"], 10, 64)
+	if err := v.checkFresh(ts, pairs["nonce"]); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
+// verify checks sig over msg. The algorithm must match the configuration,
+// so an attacker cannot downgrade a shared secret setup to self-signed keys.
+func (v *Verifier) verify(alg string, key, msg, sig []byte) error {
+	if v.secret != nil {
+		if alg != AlgHMAC {
+			return fmt.Errorf("%w: expected %s, got %q", ErrBadSignature, AlgHMAC, alg)
+		}
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(msg)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+	if alg != AlgEd25519 {
+		return fmt.Errorf("%w: expected %s, got %q", ErrBadSignature, AlgEd25519, alg)
+	}
+	if len(key) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(key), msg, sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// checkKey pins the Ed25519 key of a server on first use
+func (v *Verifier) checkKey(name string, key []byte) error {
+	if v.pins == nil {
+		return nil
+	}
+	return v.pins.Check(name, key)
+}
+
+// checkFresh rejects packets signed more than maxAge ago or in the future,
+// and nonces already seen within that window
+func (v *Verifier) checkFresh(ts int64, nonce string) error {
+	now := time.Now()
+	signed := time.Unix(ts, 0)
+	if ts == 0 || nonce == "" || now.Sub(signed) > v.maxAge || signed.Sub(now) > v.maxAge {
+		return ErrStale
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.Sub(v.lastPrune) > v.maxAge {
+		for n, t := range v.seen {
+			if now.Sub(t) > 2*v.maxAge {
+				delete(v.seen, n)
+			}
+		}
+		v.lastPrune = now
+	}
+	if _, ok := v.seen[nonce]; ok {
+		return ErrReplayed
+	}
+	v.seen[nonce] = now
+	return nil
+}
+
+// Pins maps server names to their Ed25519 public keys, trusting the first
+// key seen for a name
+type Pins struct {
+	path string
+	keys map[string]string
+	mu   sync.Mutex // Guards keys and appends to path
+}
+
+// LoadPins reads pinned keys from path, one "name base64-key" line per
+// server. A missing file is created when the first key is pinned; an empty
+// path keeps pins in memory only.
+func LoadPins(path string) (*Pins, error) {
+	p := &Pins{path: path, keys: make(map[string]string)}
+	if path == "" {
+		return p, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known servers: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		i := strings.LastIndexAny(text, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid known servers entry on line %d", line)
+		}
+		p.keys[strings.TrimSpace(text[:i])] = text[i+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read known servers: %v", err)
+	}
+	return p, nil
+}
+
+// Check accepts key if it is the one pinned for name, pinning it if name is new
+func (p *Pins) Check(name string, key []byte) error {
+	if name == "" || strings.ContainsAny(name, "\r\n#") {
+		return fmt.Errorf("invalid server name %q", name)
+	}
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pinned, ok := p.keys[name]; ok {
+		if pinned != encoded {
+			return fmt.Errorf("%w for %q", ErrKeyMismatch, name)
+		}
+		return nil
+	}
+	p.keys[name] = encoded
+	if p.path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(p.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to pin server key: %v", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "%s %s\n", name, encoded); err != nil {
+		return fmt.Errorf("failed to pin server key: %v", err)
+	}
+	return nil
+}
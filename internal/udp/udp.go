@@ -3,22 +3,36 @@ package udp
 import (
 	"fmt"
 	"net"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 
 	"chat/internal/config"
+	"chat/internal/presence"
 	"chat/pkg/logger"
 )
 
+// coalesce is how long the broadcaster waits after a presence event for
+// more events, so that a burst of changes goes out as one delta
+const coalesce = 100 * time.Millisecond
+
 // Broadcaster manages UDP broadcasts
 type Broadcaster struct {
-	cfg       config.Config
-	logger    *logger.Logger
-	conn      *net.UDPConn
-	getUsers  func() []string
-	done      chan struct{}
-	pool      *sync.Pool
+	cfg          config.Config
+	logger       *logger.Logger
+	targets      []target
+	getUsers     func() []string
+	getStatuses  func() map[string]string
+	getEndpoints func() []*net.UDPAddr
+	presence     *presence.Bus
+	unicast      *net.UDPConn    // Sends updates to registered client endpoints
+	welcomed     map[string]bool // Endpoints that were sent a snapshot
+	instanceID   string
+	signer       *Signer
+	announce     Announcement
+	seq          uint64            // Seq of the last snapshot or delta sent
+	sent         map[string]string // Users and statuses as of seq
+	done         chan struct{}
 }
 
 // NewBroadcaster creates a new UDP broadcaster
@@ -27,7 +41,6 @@ func NewBroadcaster(cfg config.Config, logger *logger.Logger) *Broadcaster {
 		cfg:    cfg,
 		logger: logger,
 		done:   make(chan struct{}),
-		pool:   &sync.Pool{New: func() interface{} { return make([]byte, 1024) }},
 	}
 }
 
@@ -36,39 +49,306 @@ func (b *Broadcaster) SetGetUsers(f func() []string) {
 	b.getUsers = f
 }
 
-// Start runs the UDP broadcaster
+// SetGetStatuses sets the function to get the status of users who set one
+func (b *Broadcaster) SetGetStatuses(f func() map[string]string) {
+	b.getStatuses = f
+}
+
+// SetGetEndpoints sets the function to get the UDP endpoints registered by
+// clients, which receive every update by unicast as well
+func (b *Broadcaster) SetGetEndpoints(f func() []*net.UDPAddr) {
+	b.getEndpoints = f
+}
+
+// SetPresence sets the bus whose events trigger presence updates
+func (b *Broadcaster) SetPresence(bus *presence.Bus) {
+	b.presence = bus
+}
+
+// SetInstanceID sets the instance ID announced by the server, so that other
+// advertisers of the same process share it
+func (b *Broadcaster) SetInstanceID(id string) {
+	b.instanceID = id
+}
+
+// SetSigner sets the signer of discovery packets, which are sent unsigned without one
+func (b *Broadcaster) SetSigner(s *Signer) {
+	b.signer = s
+}
+
+// Start runs the UDP broadcaster. Presence changes are sent as deltas as
+// soon as they happen. While nothing changes, a small beacon is sent every
+// BroadcastInterval for discovery and the full user list, split across
+// datagrams of DiscoveryPacketSize, every PresenceKeepalive.
 func (b *Broadcaster) Start() error {
-	addr, err := net.ResolveUDPAddr("udp", b.cfg.UDPAddr())
-	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %v", err)
+	// Generate the instance ID before opening sockets, so its failure leaks none
+	instanceID := b.instanceID
+	if instanceID == "" {
+		var err error
+		if instanceID, err = NewInstanceID(); err != nil {
+			return err
+		}
 	}
 
-	conn, err := net.DialUDP("udp", nil, addr)
+	targets, err := openTargets(b.cfg)
 	if err != nil {
-		return fmt.Errorf("failed to dial UDP: %v", err)
+		return err
+	}
+	b.targets = targets
+	if b.cfg.PresenceUnicast && b.getEndpoints != nil {
+		if b.unicast, err = net.ListenUDP("udp", nil); err != nil {
+			closeTargets(b.targets)
+			return fmt.Errorf("failed to open unicast presence socket: %v", err)
+		}
 	}
-	b.conn = conn
 
-	b.logger.Info("UDP broadcaster started on %s", b.cfg.UDPAddr())
+	b.announce = NewAnnouncement(b.cfg, instanceID)
+
+	for _, t := range b.targets {
+		b.logger.Info("UDP broadcaster started on %s (server %q, instance %s)", t.name, b.announce.Name, instanceID)
+	}
 
+	var events <-chan presence.Event
+	if b.presence != nil {
+		ch, unsubscribe := b.presence.Subscribe(64)
+		defer unsubscribe()
+		events = ch
+	}
+	beacons := time.NewTicker(b.cfg.BroadcastInterval)
+	defer beacons.Stop()
+	keepalive := time.NewTicker(b.cfg.PresenceKeepalive)
+	defer keepalive.Stop()
+	var flush <-chan time.Time
+
+	b.sendSnapshot()
 	for {
 		select {
 		case <-b.done:
 			return nil
-		default:
-			if b.getUsers == nil {
-				continue
+		case <-events:
+			if flush == nil {
+				flush = time.After(coalesce)
 			}
-			userList := strings.Join(b.getUsers(), ",")
-			buf := b.pool.Get().([]byte)
-			defer b.pool.Put(buf)
-			copy(buf, []byte(userList))
-			b.conn.SetWriteDeadline(time.Now().Add(b.cfg.UDPTimeout))
-			_, err := b.conn.Write(buf[:len(userList)])
-			if err != nil {
-				b.logger.Error("UDP broadcast failed: %v", err)
+		case <-flush:
+			flush = nil
+			b.sendDelta()
+			b.welcome()
+		case <-beacons.C:
+			b.sendBeacon()
+		case <-keepalive.C:
+			b.sendSnapshot()
+		}
+	}
+}
+
+// state returns the current users, sorted so snapshots split stably, and their statuses
+func (b *Broadcaster) state() ([]string, map[string]string) {
+	var users []string
+	if b.getUsers != nil {
+		users = append(users, b.getUsers()...)
+	}
+	sort.Strings(users)
+	statuses := make(map[string]string)
+	if b.getStatuses != nil {
+		for user, status := range b.getStatuses() {
+			statuses[user] = status
+		}
+	}
+	return users, statuses
+}
+
+// sendSnapshot sends the full user list in as many datagrams as needed
+func (b *Broadcaster) sendSnapshot() {
+	users, statuses := b.state()
+	parts, err := b.snapshot(users, statuses, b.seq+1)
+	if err != nil {
+		b.logger.Error("Failed to encode discovery packet: %v", err)
+		return
+	}
+	b.seq++
+	b.broadcast(parts...)
+	b.sent = make(map[string]string, len(users))
+	for _, user := range users {
+		b.sent[user] = statuses[user]
+	}
+}
+
+// welcome unicasts the current snapshot to endpoints registered since the
+// last update, so new clients need not wait for the keepalive
+func (b *Broadcaster) welcome() {
+	if b.unicast == nil {
+		return
+	}
+	current := make(map[string]bool)
+	var fresh []*net.UDPAddr
+	for _, addr := range b.getEndpoints() {
+		current[addr.String()] = true
+		if !b.welcomed[addr.String()] {
+			fresh = append(fresh, addr)
+		}
+	}
+	b.welcomed = current
+	if len(fresh) == 0 {
+		return
+	}
+
+	users := make([]string, 0, len(b.sent))
+	for user := range b.sent {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	parts, err := b.snapshot(users, b.sent, b.seq)
+	if err != nil {
+		b.logger.Error("Failed to encode discovery packet: %v", err)
+		return
+	}
+	b.sendTo(fresh, parts...)
+}
+
+// snapshot splits users and their statuses into the parts of snapshot seq
+func (b *Broadcaster) snapshot(users []string, statuses map[string]string, seq uint64) ([]Announcement, error) {
+	announce := b.announce
+	announce.Kind = KindSnapshot
+	announce.UserCount = len(users)
+	announce.Seq = seq
+	chunks, err := chunkUsers(announce, users, statuses, b.cfg.DiscoveryPacketSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(chunks) > maxParts {
+		return nil, fmt.Errorf("user list needs %d discovery packets, more than the %d receivers accept", len(chunks), maxParts)
+	}
+
+	parts := make([]Announcement, len(chunks))
+	for i, chunk := range chunks {
+		part := announce
+		part.Part = i + 1
+		part.Parts = len(chunks)
+		part.Users = chunk
+		for _, user := range chunk {
+			if status := statuses[user]; status != "" {
+				if part.Statuses == nil {
+					part.Statuses = make(map[string]string)
+				}
+				part.Statuses[user] = status
 			}
-			time.Sleep(b.cfg.BroadcastInterval)
+		}
+		parts[i] = part
+	}
+	return parts, nil
+}
+
+// sendDelta sends the users who joined, left or changed status since the
+// last update. A delta too large for one datagram is sent as a snapshot.
+func (b *Broadcaster) sendDelta() {
+	users, statuses := b.state()
+	current := make(map[string]string, len(users))
+	var joined, left []string
+	changed := make(map[string]string)
+	for _, user := range users {
+		status := statuses[user]
+		current[user] = status
+		old, ok := b.sent[user]
+		if !ok {
+			joined = append(joined, user)
+			if status != "" {
+				changed[user] = status
+			}
+		} else if old != status {
+			changed[user] = status
+		}
+	}
+	for user := range b.sent {
+		if _, ok := current[user]; !ok {
+			left = append(left, user)
+		}
+	}
+	if len(joined) == 0 && len(left) == 0 && len(changed) == 0 {
+		return
+	}
+	sort.Strings(left)
+
+	announce := b.announce
+	announce.Kind = KindDelta
+	announce.UserCount = len(users)
+	announce.Prev = b.seq
+	announce.Seq = b.seq + 1
+	announce.Joined = joined
+	announce.Left = left
+	if len(changed) > 0 {
+		announce.Statuses = changed
+	}
+	payload, err := announce.Marshal()
+	if err != nil {
+		b.logger.Error("Failed to encode discovery packet: %v", err)
+		return
+	}
+	if len(payload) > payloadLimit(b.cfg.DiscoveryPacketSize) {
+		b.sendSnapshot()
+		return
+	}
+	b.seq++
+	b.broadcast(announce)
+	b.sent = current
+}
+
+// sendBeacon announces the server and the current Seq without the user list
+func (b *Broadcaster) sendBeacon() {
+	announce := b.announce
+	announce.Kind = KindBeacon
+	announce.UserCount = len(b.sent)
+	announce.Seq = b.seq
+	b.broadcast(announce)
+}
+
+// encode signs announce if a signer is set
+func (b *Broadcaster) encode(announce Announcement) ([]byte, error) {
+	if b.signer != nil {
+		return b.signer.Seal(announce)
+	}
+	return announce.Marshal()
+}
+
+// broadcast sends announcements to every target and registered endpoint
+func (b *Broadcaster) broadcast(announcements ...Announcement) {
+	var endpoints []*net.UDPAddr
+	if b.unicast != nil {
+		endpoints = b.getEndpoints()
+	}
+	for _, announce := range announcements {
+		packet, err := b.encode(announce)
+		if err != nil {
+			b.logger.Error("Failed to encode discovery packet: %v", err)
+			return
+		}
+		for _, t := range b.targets {
+			t.conn.SetWriteDeadline(time.Now().Add(b.cfg.UDPTimeout))
+			if err := t.write(packet); err != nil {
+				b.logger.Error("UDP broadcast to %s failed: %v", t.name, err)
+			}
+		}
+		b.writeTo(endpoints, packet)
+	}
+}
+
+// sendTo sends announcements to the given endpoints only
+func (b *Broadcaster) sendTo(endpoints []*net.UDPAddr, announcements ...Announcement) {
+	for _, announce := range announcements {
+		packet, err := b.encode(announce)
+		if err != nil {
+			b.logger.Error("Failed to encode discovery packet: %v", err)
+			return
+		}
+		b.writeTo(endpoints, packet)
+	}
+}
+
+// writeTo unicasts packet to every endpoint
+func (b *Broadcaster) writeTo(endpoints []*net.UDPAddr, packet []byte) {
+	for _, addr := range endpoints {
+		b.unicast.SetWriteDeadline(time.Now().Add(b.cfg.UDPTimeout))
+		if _, err := b.unicast.WriteToUDP(packet, addr); err != nil {
+			b.logger.Error("UDP presence update to %s failed: %v", addr, err)
 		}
 	}
 }
@@ -76,70 +356,145 @@ func (b *Broadcaster) Start() error {
 // Shutdown closes the UDP broadcaster
 func (b *Broadcaster) Shutdown() {
 	close(b.done)
-	if b.conn != nil {
-		b.conn.Close()
+	closeTargets(b.targets)
+	if b.unicast != nil {
+		b.unicast.Close()
 	}
 }
 
-// Receiver manages UDP user list reception
+// Receiver keeps a presence table per server and prints what changes
 type Receiver struct {
-	cfg    config.Config
-	logger *logger.Logger
-	conn   *net.UDPConn
-	done   chan struct{}
-	pool   *sync.Pool
+	cfg      config.Config
+	logger   *logger.Logger
+	listener *listener
+	verifier *Verifier
+	warned   map[string]bool    // Sender and reason of rejected packets already logged
+	rosters  map[string]*roster // User lists by server instance
+	done     chan struct{}
 }
 
 // NewReceiver creates a new UDP receiver
 func NewReceiver(cfg config.Config, logger *logger.Logger) *Receiver {
 	return &Receiver{
-		cfg:    cfg,
-		logger: logger,
-		done:   make(chan struct{}),
-		pool:   &sync.Pool{New: func() interface{} { return make([]byte, 1024) }},
+		cfg:     cfg,
+		logger:  logger,
+		warned:  make(map[string]bool),
+		rosters: make(map[string]*roster),
+		done:    make(chan struct{}),
 	}
 }
 
-// Start runs the UDP receiver
-func (r *Receiver) Start() error {
-	addr, err := net.ResolveUDPAddr("udp", r.cfg.UDPPort)
+// Open starts listening for presence updates and returns the ephemeral
+// port of the unicast socket, which the client registers with the server.
+// If another client on this host holds UDPPort, updates arrive by unicast only.
+func (r *Receiver) Open() (int, error) {
+	v, err := NewVerifier(r.cfg)
 	if err != nil {
-		return fmt.Errorf("failed to resolve UDP address: %v", err)
+		return 0, err
 	}
+	v.SetOnReject(r.reject)
 
-	conn, err := net.ListenUDP("udp", addr)
+	l, err := listen(r.cfg)
+	if err != nil {
+		r.logger.Error("UDP receiver cannot listen for broadcasts, using unicast only: %v", err)
+		l = newListener()
+	} else {
+		if r.cfg.BroadcastAddr != "" {
+			r.logger.Info("UDP receiver started on %s", r.cfg.UDPPort)
+		}
+		for _, group := range r.cfg.MulticastGroups {
+			r.logger.Info("UDP receiver joined multicast group %s", group)
+		}
+	}
+	port, err := l.addUnicast()
 	if err != nil {
-		return fmt.Errorf("failed to listen UDP: %v", err)
+		l.Close()
+		return 0, err
 	}
-	r.conn = conn
+	r.verifier = v
+	r.listener = l
+	return port, nil
+}
 
-	r.logger.Info("UDP receiver started on %s", r.cfg.UDPPort)
+// Start runs the UDP receiver, opening it first if Open was not called
+func (r *Receiver) Start() error {
+	if r.listener == nil {
+		if _, err := r.Open(); err != nil {
+			return err
+		}
+	}
+	v, l := r.verifier, r.listener
 
 	for {
 		select {
 		case <-r.done:
 			return nil
-		default:
-			buf := r.pool.Get().([]byte)
-			r.conn.SetReadDeadline(time.Now().Add(r.cfg.UDPTimeout))
-			n, _, err := r.conn.ReadFromUDP(buf)
+		case p := <-l.packets:
+			announce, err := r.verifier.Open(p.data)
 			if err != nil {
-				r.logger.Error("UDP read failed: %v", err)
-				r.pool.Put(buf)
+				v.reject(p.from.IP.String(), err)
 				continue
 			}
-			userList := string(buf[:n])
-			fmt.Printf("\nOnline users: %s\n", userList)
-			fmt.Print("Message: ")
-			r.pool.Put(buf)
+			ros, ok := r.rosters[announce.InstanceID]
+			if !ok {
+				ros = newRoster()
+				r.rosters[announce.InstanceID] = ros
+			}
+			first := !ros.known
+			c := ros.apply(announce)
+			if first && ros.known {
+				r.printAll(announce.Name, ros)
+			} else if !c.empty() {
+				r.printChange(announce.Name, ros, c)
+			}
 		}
 	}
 }
 
+// printAll prints the presence table of a server seen for the first time
+func (r *Receiver) printAll(server string, ros *roster) {
+	var users []string
+	for _, user := range ros.list() {
+		users = append(users, ros.describe(user))
+	}
+	fmt.Printf("\nOnline users on %s: %s\n", server, strings.Join(users, ", "))
+	fmt.Print("Message: ")
+}
+
+// printChange prints who joined, left or changed status on a server
+func (r *Receiver) printChange(server string, ros *roster, c change) {
+	var changes []string
+	for _, user := range c.joined {
+		changes = append(changes, "+"+ros.describe(user))
+	}
+	for _, user := range c.left {
+		changes = append(changes, "-"+user)
+	}
+	for _, user := range c.statuses {
+		status := ros.users[user]
+		if status == "" {
+			status = "available"
+		}
+		changes = append(changes, user+": "+status)
+	}
+	fmt.Printf("\nPresence on %s: %s\n", server, strings.Join(changes, ", "))
+	fmt.Print("Message: ")
+}
+
+// reject logs a dropped packet once per sender and reason
+func (r *Receiver) reject(from string, err error) {
+	key := from + " " + err.Error()
+	if r.warned[key] {
+		return
+	}
+	r.warned[key] = true
+	r.logger.Error("Dropped discovery packet from %s: %v", from, err)
+}
+
 // Shutdown closes the UDP receiver
 func (r *Receiver) Shutdown() {
 	close(r.done)
-	if r.conn != nil {
-		r.conn.Close()
+	if r.listener != nil {
+		r.listener.Close()
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,111 @@
+package web
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"chat/internal/database"
+	"chat/internal/tcp"
+)
+
+// Frame types sent by browsers
+const (
+	FrameLogin   = "login"   // Username and Password, must come first
+	FrameCode    = "code"    // Code answering a two-factor prompt
+	FrameMessage = "message" // Text is a chat message or a command
+)
+
+// Frame types sent to browsers
+const (
+	FrameSystem    = "system"  // Text is a system message
+	FrameChat      = "chat"    // From sent Text to everyone
+	FramePrivate   = "private" // From sent Text to this user only
+	FrameError     = "error"   // Text is an error reported by the server
+	FrameTwoFactor = "2fa"     // The server asks for a two-factor code
+	FrameInfo      = "info"    // Text is command output
+)
+
+// Frame is a JSON message exchanged with browsers
+type Frame struct {
+	Type     string `json:"type"`
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Code     string `json:"code,omitempty"`
+	From     string `json:"from,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Room     string `json:"room,omitempty"` // Room of a chat or system message, empty for the lobby
+	Time     string `json:"time,omitempty"` // RFC 3339, set for history replays
+}
+
+// lines returns the protocol lines for a frame from a browser. loggedIn
+// reports whether the login frame was already sent.
+func (f Frame) lines(loggedIn bool) ([]string, error) {
+	var fields []string
+	switch {
+	case f.Type == FrameLogin && !loggedIn:
+		if f.Username == "" || f.Password == "" {
+			return nil, fmt.Errorf("ERR021: login requires a username and password")
+		}
+		fields = []string{f.Username, f.Password}
+	case f.Type == FrameLogin:
+		return nil, fmt.Errorf("ERR021: already logged in")
+	case !loggedIn:
+		return nil, fmt.Errorf("ERR021: log in first")
+	case f.Type == FrameCode:
+		fields = []string{f.Code}
+	case f.Type == FrameMessage:
+		fields = []string{f.Text}
+	default:
+		return nil, fmt.Errorf("ERR021: unknown frame type %q", f.Type)
+	}
+	for _, field := range fields {
+		if strings.ContainsAny(field, "\r\n") {
+			return nil, fmt.Errorf("ERR021: frames cannot contain line breaks")
+		}
+	}
+	return fields, nil
+}
+
+// parseLine returns the frame for a protocol line from the server
+func parseLine(line string) Frame {
+	if line == tcp.SecondFactorPrompt {
+		return Frame{Type: FrameTwoFactor}
+	}
+	if strings.HasPrefix(line, "ERR") {
+		return Frame{Type: FrameError, Text: line}
+	}
+
+	var f Frame
+	// History replays are prefixed with the time the message was sent
+	if len(line) > len(database.TimeLayout)+3 && line[0] == '[' && line[len(database.TimeLayout)+1] == ']' {
+		if t, err := time.ParseInLocation(database.TimeLayout, line[1:len(database.TimeLayout)+1], time.UTC); err == nil {
+			f.Time = t.Format(time.RFC3339)
+			line = line[len(database.TimeLayout)+3:]
+		}
+	}
+
+	// Messages of rooms other than the lobby name the room first
+	if rest, ok := strings.CutPrefix(line, "[#"); ok {
+		if room, text, ok := strings.Cut(rest, "] "); ok && !strings.ContainsAny(room, " []") {
+			f.Room, line = room, text
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(line, "[SYSTEM] "):
+		f.Type, f.Text = FrameSystem, strings.TrimPrefix(line, "[SYSTEM] ")
+	case strings.HasPrefix(line, "[PRIVATE from "):
+		if from, text, ok := strings.Cut(strings.TrimPrefix(line, "[PRIVATE from "), "] "); ok {
+			f.Type, f.From, f.Text = FramePrivate, from, text
+		}
+	case strings.HasPrefix(line, "["):
+		if from, text, ok := strings.Cut(line[1:], "] "); ok && !strings.ContainsAny(from, " []") {
+			f.Type, f.From, f.Text = FrameChat, from, text
+		}
+	}
+	if f.Type == "" {
+		f.Type, f.Text = FrameInfo, line
+	}
+	return f
+}
@@ -0,0 +1,169 @@
+package web
+
+import (
+	"bufio"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+	"chat/pkg/logger"
+
+	"golang.org/x/net/websocket"
+)
+
+// maxFrameSize limits the frames a browser can send
+const maxFrameSize = 64 * 1024
+
+//go:embed static
+var static embed.FS
+
+// Gateway serves the browser client and bridges each WebSocket into the
+// chat server as a connection speaking the line protocol. It implements
+// net.Listener, so the server accepts browsers like any other transport.
+type Gateway struct {
+	cfg    config.Config
+	logger *logger.Logger
+	ln     net.Listener
+	mux    *http.ServeMux
+	srv    *http.Server
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Listen starts the HTTP server of the gateway on cfg.HTTPPort
+func Listen(cfg config.Config, logger *logger.Logger) (*Gateway, error) {
+	ln, err := net.Listen("tcp", cfg.HTTPPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start HTTP server: %v", err)
+	}
+	g := &Gateway{
+		cfg:    cfg,
+		logger: logger,
+		ln:     ln,
+		mux:    http.NewServeMux(),
+		accept: make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to load web client: %v", err)
+	}
+	g.mux.Handle("/", http.FileServer(http.FS(files)))
+	g.mux.Handle("/ws", websocket.Server{Handler: g.handleSocket})
+	g.srv = &http.Server{Handler: g.mux, ReadHeaderTimeout: cfg.TCPTimeout}
+
+	go func() {
+		if err := g.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("HTTP server failed: %v", err)
+		}
+	}()
+	return g, nil
+}
+
+// Handle serves pattern with h next to the browser client
+func (g *Gateway) Handle(pattern string, h http.Handler) {
+	g.mux.Handle(pattern, h)
+}
+
+// Accept waits for the next browser session
+func (g *Gateway) Accept() (net.Conn, error) {
+	select {
+	case conn := <-g.accept:
+		return conn, nil
+	case <-g.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the HTTP server. Open sockets end when the chat server
+// closes their connections.
+func (g *Gateway) Close() error {
+	var err error
+	g.once.Do(func() {
+		close(g.done)
+		err = g.srv.Close()
+	})
+	return err
+}
+
+// Addr returns the address of the HTTP server
+func (g *Gateway) Addr() net.Addr {
+	return g.ln.Addr()
+}
+
+// pipeConn is the server's end of a bridged socket, reporting the browser's address
+type pipeConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the address of the browser
+func (c pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// handleSocket bridges ws to the chat server until either side closes
+func (g *Gateway) handleSocket(ws *websocket.Conn) {
+	ws.MaxPayloadBytes = maxFrameSize
+	defer ws.Close()
+
+	serverEnd, gatewayEnd := net.Pipe()
+	defer gatewayEnd.Close()
+	remote, err := net.ResolveTCPAddr("tcp", ws.Request().RemoteAddr)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+	select {
+	case g.accept <- pipeConn{Conn: serverEnd, remote: remote}:
+	case <-g.done:
+		return
+	}
+
+	// Server lines become frames
+	go func() {
+		defer ws.Close()
+		scanner := bufio.NewScanner(gatewayEnd)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// Heartbeats only check that writes succeed, browsers need not answer
+			if line == "PING" || line == "" {
+				continue
+			}
+			ws.SetWriteDeadline(time.Now().Add(g.cfg.TCPTimeout))
+			if err := websocket.JSON.Send(ws, parseLine(line)); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Frames become server lines
+	loggedIn := false
+	for {
+		var f Frame
+		if err := websocket.JSON.Receive(ws, &f); err != nil {
+			return
+		}
+		lines, err := f.lines(loggedIn)
+		if err != nil {
+			ws.SetWriteDeadline(time.Now().Add(g.cfg.TCPTimeout))
+			websocket.JSON.Send(ws, Frame{Type: FrameError, Text: err.Error()})
+			continue
+		}
+		loggedIn = true
+		for _, line := range lines {
+			gatewayEnd.SetWriteDeadline(time.Now().Add(g.cfg.TCPTimeout))
+			if _, err := gatewayEnd.Write([]byte(line + "\n")); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/database"
+	"chat/internal/message"
+	"chat/internal/secret"
+	"chat/pkg/logger"
+)
+
+// Event types webhooks can be registered for
+const (
+	Message    = "message"    // A message to everyone
+	BotMessage = "pm"         // A private message to an account in BOT_USERS
+	Join       = "join"       // A user logged in
+	Leave      = "leave"      // A user disconnected or timed out
+	Moderation = "moderation" // An admin kicked a user or changed an account
+)
+
+// Events lists every event type
+var Events = []string{Message, BotMessage, Join, Leave, Moderation}
+
+// Headers sent with every delivery
+const (
+	HeaderEvent     = "X-Chat-Event"
+	HeaderDelivery  = "X-Chat-Delivery"
+	HeaderTimestamp = "X-Chat-Timestamp"
+	// HeaderSignature is "sha256=" followed by the hex HMAC-SHA256 of the
+	// timestamp, a dot and the body, keyed with the webhook's secret
+	HeaderSignature = "X-Chat-Signature"
+)
+
+// maxErrorBody limits how much of a failed response is kept as the error
+const maxErrorBody = 256
+
+// Event is the JSON payload of a delivery
+type Event struct {
+	ID     string    `json:"id"` // Same for every attempt, receivers can use it to drop duplicates
+	Type   string    `json:"event"`
+	Time   time.Time `json:"time"`
+	From   string    `json:"from,omitempty"`
+	To     string    `json:"to,omitempty"`
+	Room   string    `json:"room,omitempty"` // Room of a message, empty for the default room
+	Text   string    `json:"text,omitempty"`
+	User   string    `json:"user,omitempty"`   // User who joined, left or was moderated
+	Actor  string    `json:"actor,omitempty"`  // Admin who took a moderation action
+	Action string    `json:"action,omitempty"` // Moderation action, such as kick or account_deleted
+	Reason string    `json:"reason,omitempty"`
+}
+
+// delivery is one event on its way to one webhook
+type delivery struct {
+	hook     database.Webhook
+	event    string
+	id       string
+	payload  []byte
+	attempts int
+}
+
+// Dispatcher posts events to the webhooks registered for them. Deliveries
+// that keep failing are stored in the webhook_failures table.
+type Dispatcher struct {
+	cfg     config.Config
+	logger  *logger.Logger
+	store   database.Store
+	box     *secret.Box
+	client  *http.Client
+	events  chan Event
+	retries chan *delivery
+	pending map[*delivery]*time.Timer // Deliveries waiting for a retry, guarded by mu
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+// NewDispatcher creates a dispatcher. box opens the signing secrets of webhooks.
+func NewDispatcher(cfg config.Config, logger *logger.Logger, store database.Store, box *secret.Box) *Dispatcher {
+	return &Dispatcher{
+		cfg:     cfg,
+		logger:  logger,
+		store:   store,
+		box:     box,
+		client:  &http.Client{Timeout: cfg.WebhookTimeout},
+		events:  make(chan Event, cfg.WebhookQueueSize),
+		retries: make(chan *delivery, cfg.WebhookQueueSize),
+		pending: make(map[*delivery]*time.Timer),
+		done:    make(chan struct{}),
+	}
+}
+
+// Start delivers events until Shutdown is called
+func (d *Dispatcher) Start() {
+	d.logger.Info("Webhook dispatcher started (%d workers, %d attempts)", d.cfg.WebhookWorkers, d.cfg.WebhookMaxAttempts)
+	for i := 0; i < d.cfg.WebhookWorkers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	<-d.done
+}
+
+// Shutdown stops the workers and dead-letters deliveries still waiting for a
+// retry. Queued events that were not looked up yet are dropped.
+func (d *Dispatcher) Shutdown() {
+	close(d.done)
+	d.wg.Wait()
+
+	d.mu.Lock()
+	var waiting []*delivery
+	for del, timer := range d.pending {
+		timer.Stop()
+		waiting = append(waiting, del)
+	}
+	d.pending = make(map[*delivery]*time.Timer)
+	d.mu.Unlock()
+	// The workers are gone, nothing else receives retries
+	for len(d.retries) > 0 {
+		waiting = append(waiting, <-d.retries)
+	}
+	for _, del := range waiting {
+		d.deadLetter(del, "server shut down before the next attempt")
+	}
+	if n := len(d.events); n > 0 {
+		d.logger.Error("Dropped %d queued webhook events on shutdown", n)
+	}
+}
+
+// Publish queues e for the webhooks registered for its type. It never
+// blocks; events are dropped with an error logged if the queue is full.
+func (d *Dispatcher) Publish(e Event) {
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	select {
+	case d.events <- e:
+	default:
+		d.logger.Error("Webhook queue full, dropped %s event %s", e.Type, e.ID)
+	}
+}
+
+// Relay publishes a broadcast chat message: a public message as a Message
+// event and a private message to a bot account as a BotMessage event
+func (d *Dispatcher) Relay(msg message.Message) {
+	switch {
+	case msg.Type == message.TypeUser:
+		d.Publish(Event{Type: Message, From: msg.From, Room: msg.Room, Text: msg.Text()})
+	case msg.Type == message.TypePrivate && d.cfg.IsBot(msg.Target):
+		d.Publish(Event{Type: BotMessage, From: msg.From, To: msg.Target, Text: msg.Text()})
+	}
+}
+
+// work delivers queued events and retries
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case e := <-d.events:
+			d.dispatch(e)
+		case del := <-d.retries:
+			d.attempt(del)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// dispatch starts a delivery of e to every webhook registered for its type
+func (d *Dispatcher) dispatch(e Event) {
+	hooks, err := d.store.ListWebhooks(e.Type)
+	if err != nil {
+		d.logger.Error("Failed to look up webhooks for %s event %s: %v", e.Type, e.ID, err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		d.logger.Error("Failed to encode %s event %s: %v", e.Type, e.ID, err)
+		return
+	}
+	for _, hook := range hooks {
+		d.attempt(&delivery{hook: hook, event: e.Type, id: e.ID, payload: payload})
+	}
+}
+
+// attempt posts a delivery once, scheduling a retry or dead-lettering it if it fails
+func (d *Dispatcher) attempt(del *delivery) {
+	del.attempts++
+	retry, err := d.post(del.hook, del.event, del.id, del.payload)
+	if err == nil {
+		return
+	}
+	if !retry || del.attempts >= d.cfg.WebhookMaxAttempts {
+		d.deadLetter(del, err.Error())
+		return
+	}
+
+	backoff := d.backoff(del.attempts)
+	d.logger.Error("Webhook %d delivery %s failed (attempt %d of %d), retrying in %s: %v",
+		del.hook.ID, del.id, del.attempts, d.cfg.WebhookMaxAttempts, backoff, err)
+	d.mu.Lock()
+	select {
+	case <-d.done:
+		d.mu.Unlock()
+		d.deadLetter(del, "server shut down before the next attempt")
+		return
+	default:
+	}
+	d.pending[del] = time.AfterFunc(backoff, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// Shutdown takes over deliveries it finds pending
+		if _, ok := d.pending[del]; !ok {
+			return
+		}
+		delete(d.pending, del)
+		select {
+		case d.retries <- del:
+		default:
+			go d.deadLetter(del, "webhook retry queue full")
+		}
+	})
+	d.mu.Unlock()
+}
+
+// backoff returns the delay before the retry following attempt number attempts
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	// Doubling stops at the cap, so many attempts cannot overflow
+	backoff := d.cfg.WebhookBackoff
+	for i := 1; i < attempts && backoff < d.cfg.WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > d.cfg.WebhookMaxBackoff {
+		backoff = d.cfg.WebhookMaxBackoff
+	}
+	return backoff
+}
+
+// post sends a delivery and reports whether a failure is worth retrying
+func (d *Dispatcher) post(hook database.Webhook, event, id string, payload []byte) (bool, error) {
+	key, err := d.box.Open(hook.Secret)
+	if err != nil {
+		return false, fmt.Errorf("failed to open webhook secret: %v", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chat-webhooks")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, id)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	req.Header.Set(HeaderSignature, Sign(key, timestamp, payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+		return false, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	retry := resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, err
+}
+
+// deadLetter stores a delivery that will not be attempted again
+func (d *Dispatcher) deadLetter(del *delivery, lastError string) {
+	d.logger.Error("Webhook %d delivery %s failed after %d attempt(s): %s", del.hook.ID, del.id, del.attempts, lastError)
+	_, err := d.store.SaveWebhookFailure(database.WebhookFailure{
+		WebhookID: del.hook.ID,
+		Event:     del.event,
+		URL:       del.hook.URL,
+		Payload:   string(del.payload),
+		Attempts:  del.attempts,
+		LastError: lastError,
+		FailedAt:  time.Now(),
+	})
+	if err != nil {
+		d.logger.Error("Failed to dead-letter webhook delivery %s: %v", del.id, err)
+	}
+}
+
+// Register adds a webhook for event and returns its ID and signing secret
+func (d *Dispatcher) Register(event, rawURL string) (int64, string, error) {
+	known := false
+	for _, e := range Events {
+		known = known || e == event
+	}
+	if !known {
+		return 0, "", fmt.Errorf("unknown webhook event %q (available: %s)", event, strings.Join(Events, ", "))
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return 0, "", fmt.Errorf("webhook URL must be an absolute http or https URL")
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, "", fmt.Errorf("failed to generate webhook secret: %v", err)
+	}
+	key := hex.EncodeToString(buf)
+	sealed, err := d.box.Seal(key)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to encrypt webhook secret: %v", err)
+	}
+	id, err := d.store.CreateWebhook(event, u.String(), sealed, time.Now())
+	if err != nil {
+		return 0, "", err
+	}
+	return id, key, nil
+}
+
+// Replay posts a dead-lettered delivery once more and removes it if it succeeds
+func (d *Dispatcher) Replay(f database.WebhookFailure) error {
+	hooks, err := d.store.ListWebhooks(f.Event)
+	if err != nil {
+		return err
+	}
+	var hook *database.Webhook
+	for i := range hooks {
+		if hooks[i].ID == f.WebhookID {
+			hook = &hooks[i]
+		}
+	}
+	if hook == nil {
+		return fmt.Errorf("webhook %d no longer exists", f.WebhookID)
+	}
+	var e Event
+	if err := json.Unmarshal([]byte(f.Payload), &e); err != nil {
+		return fmt.Errorf("failed to decode stored payload: %v", err)
+	}
+	if _, err := d.post(*hook, f.Event, e.ID, []byte(f.Payload)); err != nil {
+		return err
+	}
+	return d.store.DeleteWebhookFailure(f.ID)
+}
+
+// Sign returns the signature header value for a payload sent at timestamp
+func Sign(key, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newID returns a random delivery ID
+func newID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
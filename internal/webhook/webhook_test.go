@@ -0,0 +1,269 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chat/internal/config"
+	"chat/internal/database"
+	"chat/internal/secret"
+	"chat/pkg/logger"
+)
+
+// request is a delivery seen by a receiver
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// receiver is an httptest server answering deliveries with scripted statuses
+type receiver struct {
+	*httptest.Server
+	statuses []int // Status of each request in turn, the last one repeats
+	requests []request
+	mu       sync.Mutex
+}
+
+// newReceiver starts a receiver that answers with statuses
+func newReceiver(t *testing.T, statuses ...int) *receiver {
+	t.Helper()
+	r := &receiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, request{header: req.Header.Clone(), body: body})
+		status := r.statuses[len(r.statuses)-1]
+		if len(r.requests) <= len(r.statuses) {
+			status = r.statuses[len(r.requests)-1]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// setStatuses changes the answers to the following requests
+func (r *receiver) setStatuses(statuses ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.statuses = append(make([]int, len(r.requests)), statuses...)
+}
+
+// received returns the requests seen so far
+func (r *receiver) received() []request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request(nil), r.requests...)
+}
+
+// testConfig returns a config with fast retries
+func testConfig() config.Config {
+	return config.Config{
+		WebhookTimeout:     time.Second,
+		WebhookMaxAttempts: 3,
+		WebhookBackoff:     10 * time.Millisecond,
+		WebhookMaxBackoff:  20 * time.Millisecond,
+		WebhookQueueSize:   16,
+		WebhookWorkers:     2,
+	}
+}
+
+// newDispatcher starts a dispatcher with a webhook for Message events on url
+// and returns it with its store and the webhook's signing secret
+func newDispatcher(t *testing.T, cfg config.Config, url string) (*Dispatcher, database.Store, string) {
+	t.Helper()
+	store, err := database.New("memory://", database.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	box, err := secret.New(make([]byte, secret.KeySize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDispatcher(cfg, logger.New("webhook"), store, box)
+	_, key, err := d.Register(Message, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.Start()
+	return d, store, key
+}
+
+// waitFor fails the test if cond does not hold within a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// failures returns the dead-lettered deliveries
+func failures(t *testing.T, store database.Store) []database.WebhookFailure {
+	t.Helper()
+	list, err := store.ListWebhookFailures(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestDeliverySigned(t *testing.T) {
+	rx := newReceiver(t, http.StatusOK)
+	d, store, key := newDispatcher(t, testConfig(), rx.URL)
+	defer d.Shutdown()
+
+	d.Publish(Event{Type: Message, From: "alice", Text: "hello"})
+	waitFor(t, "the delivery", func() bool { return len(rx.received()) == 1 })
+
+	req := rx.received()[0]
+	timestamp := req.header.Get(HeaderTimestamp)
+	if got, want := req.header.Get(HeaderSignature), Sign(key, timestamp, req.body); got != want {
+		t.Errorf("%s = %q, want %q", HeaderSignature, got, want)
+	}
+	if Sign("other secret", timestamp, req.body) == req.header.Get(HeaderSignature) {
+		t.Error("signature does not depend on the secret")
+	}
+	var e Event
+	if err := json.Unmarshal(req.body, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != Message || e.From != "alice" || e.Text != "hello" || e.ID == "" {
+		t.Errorf("event = %+v", e)
+	}
+	if req.header.Get(HeaderEvent) != Message || req.header.Get(HeaderDelivery) != e.ID {
+		t.Errorf("headers %s = %q, %s = %q", HeaderEvent, req.header.Get(HeaderEvent), HeaderDelivery, req.header.Get(HeaderDelivery))
+	}
+	if len(failures(t, store)) != 0 {
+		t.Error("a successful delivery was dead-lettered")
+	}
+}
+
+func TestRetryAfterServerError(t *testing.T) {
+	rx := newReceiver(t, http.StatusServiceUnavailable, http.StatusOK)
+	d, store, _ := newDispatcher(t, testConfig(), rx.URL)
+	defer d.Shutdown()
+
+	d.Publish(Event{Type: Message, From: "alice", Text: "hello"})
+	waitFor(t, "the retry", func() bool { return len(rx.received()) == 2 })
+
+	requests := rx.received()
+	if requests[0].header.Get(HeaderDelivery) != requests[1].header.Get(HeaderDelivery) {
+		t.Error("the retry has a different delivery ID")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := len(rx.received()); n != 2 {
+		t.Errorf("receiver got %d requests, want no more after a success", n)
+	}
+	if len(failures(t, store)) != 0 {
+		t.Error("a delivery that succeeded on retry was dead-lettered")
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	rx := newReceiver(t, http.StatusBadRequest)
+	d, store, _ := newDispatcher(t, testConfig(), rx.URL)
+	defer d.Shutdown()
+
+	d.Publish(Event{Type: Message, From: "alice", Text: "hello"})
+	waitFor(t, "the dead letter", func() bool { return len(failures(t, store)) == 1 })
+
+	time.Sleep(50 * time.Millisecond)
+	if n := len(rx.received()); n != 1 {
+		t.Errorf("receiver got %d requests, want 1 for a 4xx", n)
+	}
+	if f := failures(t, store)[0]; f.Attempts != 1 || !strings.Contains(f.LastError, "400") {
+		t.Errorf("failure = %+v", f)
+	}
+}
+
+func TestMaxAttemptsAndReplay(t *testing.T) {
+	rx := newReceiver(t, http.StatusInternalServerError)
+	cfg := testConfig()
+	d, store, _ := newDispatcher(t, cfg, rx.URL)
+	defer d.Shutdown()
+
+	d.Publish(Event{Type: Message, From: "alice", Text: "hello"})
+	waitFor(t, "the dead letter", func() bool { return len(failures(t, store)) == 1 })
+
+	if n := len(rx.received()); n != cfg.WebhookMaxAttempts {
+		t.Errorf("receiver got %d requests, want %d", n, cfg.WebhookMaxAttempts)
+	}
+	f := failures(t, store)[0]
+	if f.Attempts != cfg.WebhookMaxAttempts || f.Event != Message || f.URL != rx.URL || !strings.Contains(f.LastError, "500") {
+		t.Errorf("failure = %+v", f)
+	}
+
+	if err := d.Replay(f); err == nil {
+		t.Error("Replay succeeded while the receiver still fails")
+	}
+	if len(failures(t, store)) != 1 {
+		t.Error("a failed replay removed the dead letter")
+	}
+	rx.setStatuses(http.StatusOK)
+	if err := d.Replay(f); err != nil {
+		t.Fatal(err)
+	}
+	if len(failures(t, store)) != 0 {
+		t.Error("a successful replay kept the dead letter")
+	}
+	requests := rx.received()
+	if last := requests[len(requests)-1]; string(last.body) != f.Payload {
+		t.Errorf("replayed body = %s, want %s", last.body, f.Payload)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	d := NewDispatcher(config.Config{WebhookBackoff: 2 * time.Second, WebhookMaxBackoff: 5 * time.Minute}, logger.New("webhook"), nil, nil)
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 2 * time.Second},
+		{2, 4 * time.Second},
+		{3, 8 * time.Second},
+		{8, 256 * time.Second},
+		{9, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := d.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestShutdownDeadLettersPendingRetries(t *testing.T) {
+	rx := newReceiver(t, http.StatusServiceUnavailable)
+	cfg := testConfig()
+	cfg.WebhookBackoff, cfg.WebhookMaxBackoff = time.Hour, time.Hour
+	d, store, _ := newDispatcher(t, cfg, rx.URL)
+
+	d.Publish(Event{Type: Message, From: "alice", Text: "hello"})
+	waitFor(t, "the first attempt", func() bool { return len(rx.received()) == 1 })
+	// The retry is scheduled after the response is read
+	time.Sleep(50 * time.Millisecond)
+	if len(failures(t, store)) != 0 {
+		t.Fatal("the delivery was dead-lettered before shutdown")
+	}
+
+	d.Shutdown()
+	list := failures(t, store)
+	if len(list) != 1 {
+		t.Fatalf("%d dead letters after shutdown, want 1", len(list))
+	}
+	if list[0].Attempts != 1 || !strings.Contains(list[0].LastError, "shut down") {
+		t.Errorf("failure = %+v", list[0])
+	}
+}
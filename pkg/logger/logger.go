@@ -36,4 +36,9 @@ func (l *Logger) Fatal(format string, v ...interface{}) {
 // Printf logs a formatted message
 func (l *Logger) Printf(format string, v ...interface{}) {
 	l.logger.Printf(format, v...)
-}
\ No newline at end of file
+}
+
+// Fatal logs a fatal message using a default logger and exits
+func Fatal(format string, v ...interface{}) {
+	New("chat").Fatal(format, v...)
+}